@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	submissionStatusSubmitted     = "submitted"
+	submissionStatusApproved      = "approved"
+	submissionStatusNeedsRevision = "needs_revision"
+
+	submissionFilesDir  = "submissions"
+	maxSubmissionPhotos = 5
+	maxSubmissionPhoto  = 5 * 1024 * 1024
+)
+
+var submissionPhotoTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// AssignmentSubmission — ответ клиента на задание (текст и фото, например
+// страницы дневника питания) и его проверка автором курса.
+type AssignmentSubmission struct {
+	ID         int         `json:"id" gorm:"primaryKey"`
+	LessonID   int         `json:"lesson_id" gorm:"index;not null"`
+	CourseID   int         `json:"course_id" gorm:"index;not null"`
+	UserID     int         `json:"user_id" gorm:"index;not null"`
+	Text       string      `json:"text"`
+	Photos     StringArray `json:"-" gorm:"type:jsonb"`
+	Status     string      `json:"status" gorm:"index;default:'submitted'"`
+	Grade      *int        `json:"grade"`
+	Feedback   string      `json:"feedback"`
+	ReviewedAt *time.Time  `json:"reviewed_at"`
+	CreatedAt  time.Time   `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt  time.Time   `json:"updated_at" gorm:"autoUpdateTime"`
+	User       *User       `json:"user,omitempty" gorm:"foreignKey:UserID"`
+
+	PhotoURLs []string `json:"photo_urls" gorm:"-"`
+}
+
+func (s *AssignmentSubmission) AfterFind(tx *gorm.DB) error {
+	s.setPhotoURLs()
+	return nil
+}
+
+// setPhotoURLs заполняет ссылки на фото, сами файлы отдаются с проверкой доступа.
+func (s *AssignmentSubmission) setPhotoURLs() {
+	s.PhotoURLs = make([]string, len(s.Photos))
+	for i := range s.Photos {
+		s.PhotoURLs[i] = fmt.Sprintf("/api/submissions/%d/photos/%d", s.ID, i)
+	}
+}
+
+// publicUserFields ограничивает подгружаемого клиента полями для отображения.
+func publicUserFields(tx *gorm.DB) *gorm.DB {
+	return tx.Select("id", "username", "role", "full_name", "avatar_url", "avatars")
+}
+
+// notifyUser сохраняет уведомление и отправляет его по WebSocket.
+func notifyUser(ctx context.Context, tx *gorm.DB, userID int, kind, content string) {
+	notification := Notification{UserID: userID, Type: kind, Content: content}
+	if err := tx.Create(&notification).Error; err != nil {
+		slog.ErrorContext(ctx, "notifyUser: Ошибка создания уведомления", "type", kind, "error", err)
+		return
+	}
+	sendEvent(ctx, userID, "notification", notification)
+}
+
+func submitAssignment(c *gin.Context) {
+	if c.GetString("role") != "client" {
+		slog.WarnContext(c, "submitAssignment: Доступ запрещён")
+		respondError(c, errClientOnly)
+		return
+	}
+	lesson, _, ok := loadLesson(c, "submitAssignment")
+	if !ok {
+		return
+	}
+	if lesson.Kind != lessonKindAssignment {
+		respondError(c, errNotAnAssignment)
+		return
+	}
+	var input struct {
+		Text string `form:"text" binding:"max=10000"`
+	}
+	if err := c.ShouldBind(&input); err != nil {
+		slog.WarnContext(c, "submitAssignment: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	var files []*multipart.FileHeader
+	if form, err := c.MultipartForm(); err == nil {
+		files = form.File["photos"]
+	}
+	if len(files) > maxSubmissionPhotos {
+		respondError(c, errValidation.WithFields(FieldError{Field: "photos", Code: "max", Param: strconv.Itoa(maxSubmissionPhotos)}))
+		return
+	}
+	if input.Text == "" && len(files) == 0 {
+		respondError(c, errValidation.WithFields(FieldError{Field: "text", Code: "required"}))
+		return
+	}
+	userID := c.GetInt("userID")
+	// Новый ответ возможен, только если прошлый отправлен на доработку
+	var last AssignmentSubmission
+	err := reqDB(c).Where("user_id = ? AND lesson_id = ?", userID, lesson.ID).Order("created_at DESC").First(&last).Error
+	switch {
+	case err == nil && last.Status == submissionStatusSubmitted:
+		respondError(c, errSubmissionPending)
+		return
+	case err == nil && last.Status == submissionStatusApproved:
+		respondError(c, errAssignmentApproved)
+		return
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		slog.ErrorContext(c, "submitAssignment: Ошибка получения ответов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	photos := make(StringArray, 0, len(files))
+	cleanup := func() {
+		for _, name := range photos {
+			removeStoredFile(c, submissionFilesDir, name)
+		}
+	}
+	for _, file := range files {
+		if file.Size > maxSubmissionPhoto {
+			cleanup()
+			respondError(c, errFileTooLarge)
+			return
+		}
+		name, ok := saveSniffedFile(c, "submitAssignment", file, submissionFilesDir, submissionPhotoTypes)
+		if !ok {
+			cleanup()
+			return
+		}
+		photos = append(photos, name)
+	}
+	submission := AssignmentSubmission{
+		LessonID: lesson.ID,
+		CourseID: lesson.CourseID,
+		UserID:   userID,
+		Text:     input.Text,
+		Photos:   photos,
+		Status:   submissionStatusSubmitted,
+	}
+	err = reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&submission).Error; err != nil {
+			return err
+		}
+		_, err := upsertLessonProgress(tx, userID, lesson, nil, false)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(c, "submitAssignment: Ошибка сохранения ответа", "error", err)
+		cleanup()
+		respondError(c, errInternal)
+		return
+	}
+	submission.setPhotoURLs()
+	var course Course
+	if err := reqDB(c).Unscoped().Select("id", "title", "teacher_id").First(&course, lesson.CourseID).Error; err == nil {
+		notifyUser(c, reqDB(c), course.TeacherID, "assignment_submitted",
+			"Новый ответ на задание «"+lesson.Title+"» курса "+course.Title)
+		sendEvent(c, course.TeacherID, "assignment:submitted", submission)
+	}
+	slog.InfoContext(c, "submitAssignment: Ответ отправлен", "lesson_id", lesson.ID, "submission_id", submission.ID, "photos", len(photos))
+	c.JSON(http.StatusOK, submission)
+}
+
+// getLessonSubmissions: автор курса видит ответы всех клиентов, клиент — свои.
+func getLessonSubmissions(c *gin.Context) {
+	lesson, access, ok := loadLesson(c, "getLessonSubmissions")
+	if !ok {
+		return
+	}
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		respondError(c, apiErr)
+		return
+	}
+	q := reqDB(c).Where("lesson_id = ?", lesson.ID)
+	if access.manage {
+		q = q.Preload("User", publicUserFields)
+	} else {
+		q = q.Where("user_id = ?", c.GetInt("userID"))
+	}
+	submissions, err := fetchPage(c, q, page, newestFirst, func(s AssignmentSubmission) pageKey { return timeKey(s.CreatedAt, s.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getLessonSubmissions: Ошибка получения ответов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, submissions)
+}
+
+// getSubmissions — очередь проверки нутрициолога по всем его курсам.
+func getSubmissions(c *gin.Context) {
+	role := c.GetString("role")
+	if role != "nutri" && role != "admin" {
+		slog.WarnContext(c, "getSubmissions: Доступ запрещён")
+		respondError(c, errNutriOnly)
+		return
+	}
+	var input struct {
+		Status string `form:"status" binding:"omitempty,oneof=submitted approved needs_revision"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		respondError(c, bindError(err))
+		return
+	}
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		respondError(c, apiErr)
+		return
+	}
+	q := reqDB(c).Preload("User", publicUserFields)
+	if role != "admin" {
+		q = q.Where("course_id IN (?)", reqDB(c).Unscoped().Model(&Course{}).Select("id").Where("teacher_id = ?", c.GetInt("userID")))
+	}
+	if input.Status != "" {
+		q = q.Where("status = ?", input.Status)
+	}
+	submissions, err := fetchPage(c, q, page, newestFirst, func(s AssignmentSubmission) pageKey { return timeKey(s.CreatedAt, s.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getSubmissions: Ошибка получения ответов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, submissions)
+}
+
+// loadSubmission загружает ответ из :id. Доступ есть у автора ответа
+// и у того, кто может изменять курс.
+func loadSubmission(c *gin.Context, fn string) (AssignmentSubmission, Course, bool) {
+	var submission AssignmentSubmission
+	var course Course
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return submission, course, false
+	}
+	if err := reqDB(c).First(&submission, id).Error; err != nil {
+		slog.WarnContext(c, fn+": Ответ не найден", "submission_id", id, "error", err)
+		respondError(c, errSubmissionNotFound)
+		return submission, course, false
+	}
+	if err := reqDB(c).Unscoped().First(&course, submission.CourseID).Error; err != nil {
+		slog.ErrorContext(c, fn+": Курс не найден", "submission_id", id, "error", err)
+		respondError(c, errInternal)
+		return submission, course, false
+	}
+	userID := c.GetInt("userID")
+	if submission.UserID != userID && !canManageCourse(course, userID, c.GetString("role")) {
+		slog.WarnContext(c, fn+": Доступ запрещён", "submission_id", id)
+		respondError(c, errSubmissionNotFound)
+		return submission, course, false
+	}
+	return submission, course, true
+}
+
+func getSubmissionPhoto(c *gin.Context) {
+	submission, _, ok := loadSubmission(c, "getSubmissionPhoto")
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil || n < 0 || n >= len(submission.Photos) {
+		respondError(c, errAttachmentNotFound)
+		return
+	}
+	redirectToStoredFile(c, "getSubmissionPhoto", submissionFilesDir+"/"+submission.Photos[n], "")
+}
+
+// reviewSubmission сохраняет оценку и комментарий. Принятый ответ
+// завершает урок клиента.
+func reviewSubmission(c *gin.Context) {
+	submission, course, ok := loadSubmission(c, "reviewSubmission")
+	if !ok {
+		return
+	}
+	if !canManageCourse(course, c.GetInt("userID"), c.GetString("role")) {
+		slog.WarnContext(c, "reviewSubmission: Доступ запрещён", "submission_id", submission.ID)
+		respondError(c, errCourseOwnerOnly)
+		return
+	}
+	var input struct {
+		Status   string `json:"status" binding:"required,oneof=approved needs_revision"`
+		Grade    *int   `json:"grade" binding:"omitempty,min=0,max=100"`
+		Feedback string `json:"feedback" binding:"max=5000"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "reviewSubmission: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	var lesson Lesson
+	if err := reqDB(c).First(&lesson, submission.LessonID).Error; err != nil {
+		slog.WarnContext(c, "reviewSubmission: Урок не найден", "error", err)
+		respondError(c, errLessonNotFound)
+		return
+	}
+	now := time.Now()
+	submission.Status, submission.Grade, submission.Feedback, submission.ReviewedAt = input.Status, input.Grade, input.Feedback, &now
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&submission).Select("status", "grade", "feedback", "reviewed_at").Updates(&submission).Error
+		if err != nil || input.Status != submissionStatusApproved {
+			return err
+		}
+		_, err = upsertLessonProgress(tx, submission.UserID, lesson, nil, true)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(c, "reviewSubmission: Ошибка сохранения проверки", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	content := "Задание «" + lesson.Title + "» принято"
+	if input.Status == submissionStatusNeedsRevision {
+		content = "Задание «" + lesson.Title + "» отправлено на доработку"
+	}
+	notifyUser(c, reqDB(c), submission.UserID, "assignment_reviewed", content)
+	sendEvent(c, submission.UserID, "assignment:reviewed", submission)
+	slog.InfoContext(c, "reviewSubmission: Ответ проверен", "submission_id", submission.ID, "status", input.Status)
+	if input.Status == submissionStatusApproved {
+		issueCertificateIfComplete(c, submission.UserID, submission.CourseID)
+	}
+	c.JSON(http.StatusOK, submission)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// Bundle — комплект курсов одного нутрициолога по цене ниже суммы цен курсов.
+// При оплате цена комплекта делится между курсами пропорционально их ценам.
+type Bundle struct {
+	ID          int             `json:"id" gorm:"primaryKey"`
+	TeacherID   int             `json:"teacher_id" gorm:"index"`
+	Title       string          `json:"title" gorm:"not null"`
+	Description string          `json:"description"`
+	CourseIDs   IntArray        `json:"course_ids" gorm:"type:jsonb"`
+	NetPrice    decimal.Decimal `json:"net_price" gorm:"type:decimal(10,2)"`
+	GrossPrice  decimal.Decimal `json:"gross_price" gorm:"type:decimal(10,2)"`
+	Status      string          `json:"status" gorm:"default:'draft';index"`
+	CreatedAt   time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	DeletedAt   gorm.DeletedAt  `json:"-" gorm:"index"`
+	Teacher     User            `json:"teacher" gorm:"foreignKey:TeacherID"`
+
+	Courses []Course `json:"courses" gorm:"-"`
+	// FullPrice — сколько курсы комплекта стоят по отдельности
+	FullPrice decimal.Decimal `json:"full_price" gorm:"-"`
+}
+
+// loadBundleCourses заполняет курсы комплектов в порядке CourseIDs. Удалённые
+// курсы тоже подгружаются, чтобы состав комплекта не менялся незаметно.
+func loadBundleCourses(tx *gorm.DB, bundles []Bundle) error {
+	var ids []int
+	for _, b := range bundles {
+		ids = append(ids, b.CourseIDs...)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var courses []Course
+	if err := tx.Unscoped().Where("id IN ?", ids).Find(&courses).Error; err != nil {
+		return err
+	}
+	byID := make(map[int]Course, len(courses))
+	for _, course := range courses {
+		byID[course.ID] = course
+	}
+	for i := range bundles {
+		bundles[i].Courses = make([]Course, 0, len(bundles[i].CourseIDs))
+		bundles[i].FullPrice = decimal.Zero
+		for _, id := range bundles[i].CourseIDs {
+			if course, ok := byID[id]; ok {
+				bundles[i].Courses = append(bundles[i].Courses, course)
+				bundles[i].FullPrice = bundles[i].FullPrice.Add(course.GrossPrice)
+			}
+		}
+	}
+	return nil
+}
+
+func canManageBundle(bundle Bundle, userID int, role string) bool {
+	return role == "admin" || bundle.TeacherID == userID
+}
+
+func loadBundle(c *gin.Context, fn string) (Bundle, bool) {
+	var bundle Bundle
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return bundle, false
+	}
+	if err := reqDB(c).Preload("Teacher", publicUserFields).First(&bundle, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(c, fn+": Комплект не найден", "bundle_id", id)
+			respondError(c, errBundleNotFound)
+		} else {
+			slog.ErrorContext(c, fn+": Ошибка получения комплекта", "error", err)
+			respondError(c, errInternal)
+		}
+		return bundle, false
+	}
+	return bundle, true
+}
+
+func loadManagedBundle(c *gin.Context, fn string) (Bundle, bool) {
+	bundle, ok := loadBundle(c, fn)
+	if !ok {
+		return bundle, false
+	}
+	if !canManageBundle(bundle, c.GetInt("userID"), c.GetString("role")) {
+		slog.WarnContext(c, fn+": Доступ запрещён", "bundle_id", bundle.ID)
+		respondError(c, errCourseOwnerOnly)
+		return bundle, false
+	}
+	return bundle, true
+}
+
+// checkBundle проверяет, что все курсы комплекта принадлежат его автору, а
+// цена комплекта ниже суммы цен курсов. Опубликовать можно только комплект из
+// опубликованных курсов.
+func checkBundle(c *gin.Context, fn string, bundle Bundle) bool {
+	var courses []Course
+	if err := reqDB(c).Where("id IN ? AND teacher_id = ?", []int(bundle.CourseIDs), bundle.TeacherID).Find(&courses).Error; err != nil {
+		slog.ErrorContext(c, fn+": Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
+		return false
+	}
+	byID := make(map[int]Course, len(courses))
+	for _, course := range courses {
+		byID[course.ID] = course
+	}
+	full := decimal.Zero
+	for _, id := range bundle.CourseIDs {
+		course, ok := byID[id]
+		if !ok {
+			slog.WarnContext(c, fn+": Чужой или несуществующий курс", "course_id", id)
+			respondError(c, errValidation.WithFields(FieldError{Field: "course_ids", Code: "own_course", Param: strconv.Itoa(id)}))
+			return false
+		}
+		if bundle.Status == courseStatusPublished && course.Status != courseStatusPublished {
+			slog.WarnContext(c, fn+": Курс не опубликован", "course_id", id)
+			respondError(c, errValidation.WithFields(FieldError{Field: "course_ids", Code: "unpublished", Param: strconv.Itoa(id)}))
+			return false
+		}
+		full = full.Add(course.NetPrice)
+	}
+	if !bundle.NetPrice.LessThan(full) {
+		slog.WarnContext(c, fn+": Цена комплекта не ниже суммы цен курсов", "net_price", bundle.NetPrice, "full", full)
+		respondError(c, errValidation.WithFields(FieldError{Field: "net_price", Code: "bundle_price", Param: full.StringFixed(2)}))
+		return false
+	}
+	return true
+}
+
+// getBundles отдаёт опубликованные комплекты. Автор, запросивший свои
+// комплекты через teacher_id, и администратор видят также черновики и архив.
+func getBundles(c *gin.Context) {
+	var input struct {
+		TeacherID int `form:"teacher_id" binding:"omitempty,gt=0"`
+		CourseID  int `form:"course_id" binding:"omitempty,gt=0"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		slog.WarnContext(c, "getBundles: Неверные параметры", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getBundles: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	q := reqDB(c).Preload("Teacher", publicUserFields)
+	if input.TeacherID > 0 {
+		q = q.Where("teacher_id = ?", input.TeacherID)
+	}
+	if input.CourseID > 0 {
+		q = q.Where("course_ids @> ?::jsonb", fmt.Sprintf("[%d]", input.CourseID))
+	}
+	userID, role := c.GetInt("userID"), c.GetString("role")
+	if role != "admin" && (userID == 0 || input.TeacherID != userID) {
+		q = q.Where("status = ?", courseStatusPublished)
+	}
+	bundles, err := fetchPage(c, q, page, newestFirst, func(b Bundle) pageKey { return timeKey(b.CreatedAt, b.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getBundles: Ошибка получения комплектов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if err := loadBundleCourses(reqDB(c), bundles); err != nil {
+		slog.ErrorContext(c, "getBundles: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, bundles)
+}
+
+func getBundle(c *gin.Context) {
+	bundle, ok := loadBundle(c, "getBundle")
+	if !ok {
+		return
+	}
+	if bundle.Status != courseStatusPublished && !canManageBundle(bundle, c.GetInt("userID"), c.GetString("role")) {
+		slog.WarnContext(c, "getBundle: Комплект недоступен", "bundle_id", bundle.ID, "status", bundle.Status)
+		respondError(c, errBundleNotFound)
+		return
+	}
+	bundles := []Bundle{bundle}
+	if err := loadBundleCourses(reqDB(c), bundles); err != nil {
+		slog.ErrorContext(c, "getBundle: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, bundles[0])
+}
+
+func createBundle(c *gin.Context) {
+	if c.GetString("role") != "nutri" {
+		slog.WarnContext(c, "createBundle: Доступ запрещён")
+		respondError(c, errNutriOnly)
+		return
+	}
+	var input struct {
+		Title       string   `json:"title" binding:"required,notblank,max=200"`
+		Description string   `json:"description" binding:"max=5000"`
+		CourseIDs   IntArray `json:"course_ids" binding:"required,min=2,max=10,unique,dive,gt=0"`
+		NetPrice    float64  `json:"net_price" binding:"required,price"`
+		Status      string   `json:"status" binding:"omitempty,oneof=draft published"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createBundle: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	netPrice := decimal.NewFromFloat(input.NetPrice)
+	bundle := Bundle{
+		TeacherID:   c.GetInt("userID"),
+		Title:       input.Title,
+		Description: input.Description,
+		CourseIDs:   input.CourseIDs,
+		NetPrice:    netPrice,
+		GrossPrice:  netPrice.Mul(grossMultiplier),
+		Status:      input.Status,
+	}
+	if bundle.Status == "" {
+		bundle.Status = courseStatusDraft
+	}
+	if !checkBundle(c, "createBundle", bundle) {
+		return
+	}
+	if err := reqDB(c).Create(&bundle).Error; err != nil {
+		slog.ErrorContext(c, "createBundle: Ошибка создания комплекта", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	bundles := []Bundle{bundle}
+	if err := loadBundleCourses(reqDB(c), bundles); err != nil {
+		slog.ErrorContext(c, "createBundle: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "createBundle: Комплект создан", "bundle_id", bundle.ID, "courses", len(bundle.CourseIDs))
+	c.JSON(http.StatusOK, bundles[0])
+}
+
+func updateBundle(c *gin.Context) {
+	bundle, ok := loadManagedBundle(c, "updateBundle")
+	if !ok {
+		return
+	}
+	var input struct {
+		Title       *string   `json:"title" binding:"omitempty,notblank,max=200"`
+		Description *string   `json:"description" binding:"omitempty,max=5000"`
+		CourseIDs   *IntArray `json:"course_ids" binding:"omitempty,min=2,max=10,unique,dive,gt=0"`
+		NetPrice    *float64  `json:"net_price" binding:"omitempty,price"`
+		Status      *string   `json:"status" binding:"omitempty,oneof=draft published archived"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateBundle: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if input.Title != nil {
+		bundle.Title = *input.Title
+	}
+	if input.Description != nil {
+		bundle.Description = *input.Description
+	}
+	if input.CourseIDs != nil {
+		bundle.CourseIDs = *input.CourseIDs
+	}
+	if input.NetPrice != nil {
+		bundle.NetPrice = decimal.NewFromFloat(*input.NetPrice)
+		bundle.GrossPrice = bundle.NetPrice.Mul(grossMultiplier)
+	}
+	if input.Status != nil {
+		bundle.Status = *input.Status
+	}
+	if !checkBundle(c, "updateBundle", bundle) {
+		return
+	}
+	if err := reqDB(c).Select("title", "description", "course_ids", "net_price", "gross_price", "status").Save(&bundle).Error; err != nil {
+		slog.ErrorContext(c, "updateBundle: Ошибка обновления комплекта", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	bundles := []Bundle{bundle}
+	if err := loadBundleCourses(reqDB(c), bundles); err != nil {
+		slog.ErrorContext(c, "updateBundle: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "updateBundle: Комплект обновлён", "bundle_id", bundle.ID)
+	c.JSON(http.StatusOK, bundles[0])
+}
+
+// deleteBundle удаляет комплект мягко: записи по уже оплаченным комплектам
+// остаются, а из корзин он убирается.
+func deleteBundle(c *gin.Context) {
+	bundle, ok := loadManagedBundle(c, "deleteBundle")
+	if !ok {
+		return
+	}
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("bundle_id = ?", bundle.ID).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&bundle).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, "deleteBundle: Ошибка удаления комплекта", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "deleteBundle: Комплект удалён", "bundle_id", bundle.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Комплект удалён"})
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// В чеке ЮKassa не больше 100 позиций, а комплект раскладывается на
+	// позиции по курсам: 10 позиций корзины по 10 курсов в лимит укладываются.
+	maxCartItems = 10
+	// Длина описания позиции чека в ЮKassa
+	maxReceiptText = 128
+)
+
+// CartItem — позиция корзины клиента: отдельный курс или комплект.
+type CartItem struct {
+	ID        int       `json:"id" gorm:"primaryKey"`
+	UserID    int       `json:"-" gorm:"index"`
+	CourseID  *int      `json:"course_id,omitempty"`
+	BundleID  *int      `json:"bundle_id,omitempty"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	Course    *Course   `json:"course,omitempty" gorm:"foreignKey:CourseID"`
+	Bundle    *Bundle   `json:"bundle,omitempty" gorm:"foreignKey:BundleID"`
+}
+
+// PaymentItem — позиция платежа и строка чека. Комплект раскладывается на
+// курсы, поэтому у каждой позиции свой нутрициолог и своя доля выручки.
+type PaymentItem struct {
+	ID          int             `json:"id" gorm:"primaryKey"`
+	PaymentID   int             `json:"-" gorm:"index"`
+	CourseID    int             `json:"course_id"`
+	BundleID    *int            `json:"bundle_id,omitempty"`
+	TeacherID   int             `json:"teacher_id" gorm:"index"`
+	Title       string          `json:"title"`
+	GrossAmount decimal.Decimal `json:"gross_amount" gorm:"type:decimal(10,2)"`
+	Commission  decimal.Decimal `json:"commission" gorm:"type:decimal(10,2)"`
+	NetAmount   decimal.Decimal `json:"net_amount" gorm:"type:decimal(10,2)"`
+}
+
+// migratePaymentItems создаёт позиции для платежей, оформленных до появления
+// корзины: раньше платёж всегда был за один курс.
+func migratePaymentItems(db *gorm.DB) error {
+	err := db.Exec(`
+		INSERT INTO payment_items (payment_id, course_id, teacher_id, title, gross_amount, commission, net_amount)
+		SELECT p.id, p.course_id, c.teacher_id, c.title, p.gross_amount, p.commission, p.net_amount
+		FROM payments p JOIN courses c ON c.id = p.course_id
+		WHERE NOT EXISTS (SELECT 1 FROM payment_items i WHERE i.payment_id = p.id)
+	`).Error
+	if err != nil {
+		return fmt.Errorf("Ошибка переноса позиций платежей: %w", err)
+	}
+	return nil
+}
+
+// splitAmount делит сумму пропорционально весам с точностью до копейки.
+// Остаток округления достаётся последней части, поэтому сумма частей всегда
+// равна исходной. Если все веса нулевые, сумма делится поровну.
+func splitAmount(total decimal.Decimal, weights []decimal.Decimal) []decimal.Decimal {
+	sum := decimal.Zero
+	for _, w := range weights {
+		sum = sum.Add(w)
+	}
+	if sum.IsZero() {
+		weights = slices.Repeat([]decimal.Decimal{decimal.NewFromInt(1)}, len(weights))
+		sum = decimal.NewFromInt(int64(len(weights)))
+	}
+	parts := make([]decimal.Decimal, len(weights))
+	rest := total
+	for i, w := range weights[:len(weights)-1] {
+		parts[i] = total.Mul(w).Div(sum).Round(2)
+		rest = rest.Sub(parts[i])
+	}
+	parts[len(parts)-1] = rest
+	return parts
+}
+
+func receiptText(s string) string {
+	if utf8.RuneCountInString(s) <= maxReceiptText {
+		return s
+	}
+	return string([]rune(s)[:maxReceiptText-1]) + "…"
+}
+
+// resolveCheckout собирает позиции платежа из курсов и комплектов. Всё должно
+// быть опубликовано, курсы не должны повторяться, а клиент не должен быть уже
+// записан ни на один из них; при userID 0 запись не проверяется. Второе
+// значение — описание платежа для ЮKassa.
+func resolveCheckout(c *gin.Context, fn string, userID int, courseIDs, bundleIDs []int) ([]PaymentItem, string, bool) {
+	var courses []Course
+	if len(courseIDs) > 0 {
+		if err := reqDB(c).Where("id IN ?", courseIDs).Find(&courses).Error; err != nil {
+			slog.ErrorContext(c, fn+": Ошибка получения курсов", "error", err)
+			respondError(c, errInternal)
+			return nil, "", false
+		}
+	}
+	var bundles []Bundle
+	if len(bundleIDs) > 0 {
+		if err := reqDB(c).Where("id IN ?", bundleIDs).Find(&bundles).Error; err != nil {
+			slog.ErrorContext(c, fn+": Ошибка получения комплектов", "error", err)
+			respondError(c, errInternal)
+			return nil, "", false
+		}
+	}
+	var bundleCourses []Course
+	var inBundles []int
+	for _, b := range bundles {
+		inBundles = append(inBundles, b.CourseIDs...)
+	}
+	if len(inBundles) > 0 {
+		if err := reqDB(c).Where("id IN ?", inBundles).Find(&bundleCourses).Error; err != nil {
+			slog.ErrorContext(c, fn+": Ошибка получения курсов комплектов", "error", err)
+			respondError(c, errInternal)
+			return nil, "", false
+		}
+	}
+	courseByID := make(map[int]Course, len(courses)+len(bundleCourses))
+	for _, course := range slices.Concat(courses, bundleCourses) {
+		courseByID[course.ID] = course
+	}
+	bundleByID := make(map[int]Bundle, len(bundles))
+	for _, b := range bundles {
+		bundleByID[b.ID] = b
+	}
+
+	var items []PaymentItem
+	var description string
+	for _, id := range courseIDs {
+		course, ok := courseByID[id]
+		if !ok {
+			slog.WarnContext(c, fn+": Курс не найден", "course_id", id)
+			respondError(c, errCourseNotFound)
+			return nil, "", false
+		}
+		if course.Status != courseStatusPublished {
+			slog.WarnContext(c, fn+": Курс недоступен для покупки", "course_id", id, "status", course.Status)
+			respondError(c, errCourseNotAvailable)
+			return nil, "", false
+		}
+		items = append(items, PaymentItem{
+			CourseID:    course.ID,
+			TeacherID:   course.TeacherID,
+			Title:       course.Title,
+			GrossAmount: course.GrossPrice,
+			Commission:  course.GrossPrice.Sub(course.NetPrice),
+			NetAmount:   course.NetPrice,
+		})
+		description = "Оплата услуги " + course.Title
+	}
+	for _, id := range bundleIDs {
+		bundle, ok := bundleByID[id]
+		if !ok {
+			slog.WarnContext(c, fn+": Комплект не найден", "bundle_id", id)
+			respondError(c, errBundleNotFound)
+			return nil, "", false
+		}
+		if bundle.Status != courseStatusPublished {
+			slog.WarnContext(c, fn+": Комплект недоступен для покупки", "bundle_id", id, "status", bundle.Status)
+			respondError(c, errBundleNotAvailable)
+			return nil, "", false
+		}
+		var gross, net []decimal.Decimal
+		for _, courseID := range bundle.CourseIDs {
+			course, ok := courseByID[courseID]
+			if !ok || course.Status != courseStatusPublished {
+				slog.WarnContext(c, fn+": Курс комплекта недоступен", "bundle_id", id, "course_id", courseID)
+				respondError(c, errBundleNotAvailable)
+				return nil, "", false
+			}
+			gross = append(gross, course.GrossPrice)
+			net = append(net, course.NetPrice)
+		}
+		grossParts := splitAmount(bundle.GrossPrice, gross)
+		netParts := splitAmount(bundle.NetPrice, net)
+		for i, courseID := range bundle.CourseIDs {
+			course := courseByID[courseID]
+			items = append(items, PaymentItem{
+				CourseID:    course.ID,
+				BundleID:    &bundle.ID,
+				TeacherID:   course.TeacherID,
+				Title:       bundle.Title + ": " + course.Title,
+				GrossAmount: grossParts[i],
+				Commission:  grossParts[i].Sub(netParts[i]),
+				NetAmount:   netParts[i],
+			})
+		}
+		description = "Оплата комплекта " + bundle.Title
+	}
+	if len(courseIDs)+len(bundleIDs) > 1 {
+		description = "Оплата заказа из корзины"
+	}
+
+	purchased, duplicate := purchasedCourses(items)
+	if duplicate != 0 {
+		slog.WarnContext(c, fn+": Курс повторяется в заказе", "course_id", duplicate)
+		respondError(c, errCartConflict)
+		return nil, "", false
+	}
+	if userID == 0 {
+		return items, description, true
+	}
+	var enrolled int64
+	if err := reqDB(c).Model(&Enrollment{}).Where("user_id = ? AND course_id IN ?", userID, purchased).Count(&enrolled).Error; err != nil {
+		slog.ErrorContext(c, fn+": Ошибка проверки записей", "error", err)
+		respondError(c, errInternal)
+		return nil, "", false
+	}
+	if enrolled > 0 {
+		slog.WarnContext(c, fn+": Клиент уже записан на курс из заказа", "user_id", userID)
+		respondError(c, errAlreadyPaid)
+		return nil, "", false
+	}
+	return items, description, true
+}
+
+// purchasedCourses возвращает курсы заказа и первый повторяющийся из них, если
+// он есть: курс нельзя оплатить дважды, например отдельно и в комплекте.
+func purchasedCourses(items []PaymentItem) ([]int, int) {
+	purchased := make([]int, len(items))
+	for i, item := range items {
+		if slices.Contains(purchased[:i], item.CourseID) {
+			return nil, item.CourseID
+		}
+		purchased[i] = item.CourseID
+	}
+	return purchased, 0
+}
+
+// enrollUser записывает клиента на курсы, на которые он ещё не записан, и
+// возвращает число новых записей.
+func enrollUser(tx *gorm.DB, userID int, courseIDs []int) (int, error) {
+	var enrolled []int
+	if err := tx.Model(&Enrollment{}).Where("user_id = ? AND course_id IN ?", userID, courseIDs).Pluck("course_id", &enrolled).Error; err != nil {
+		return 0, err
+	}
+	created := 0
+	for _, courseID := range courseIDs {
+		if slices.Contains(enrolled, courseID) {
+			continue
+		}
+		if err := tx.Create(&Enrollment{CourseID: courseID, UserID: userID}).Error; err != nil {
+			return created, err
+		}
+		created++
+	}
+	return created, nil
+}
+
+// settlePayment засчитывает оплату: записывает клиента на все курсы платежа и
+// начисляет каждому нутрициологу его долю. Строка платежа блокируется, чтобы
+// одновременные возврат клиента и webhook не засчитали оплату дважды.
+// Возвращает false, если платёж уже был засчитан раньше.
+func settlePayment(ctx context.Context, tx *gorm.DB, paymentID int, transactionID string) (Payment, bool, error) {
+	var payment Payment
+	settled := false
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, paymentID).Error; err != nil {
+			return err
+		}
+		if payment.Status == "paid" {
+			return nil
+		}
+		if err := tx.Where("payment_id = ?", payment.ID).Order("id").Find(&payment.Items).Error; err != nil {
+			return err
+		}
+		payment.Status = "paid"
+		payment.TransactionID = transactionID
+		if err := tx.Model(&payment).Updates(map[string]any{"status": payment.Status, "transaction_id": transactionID}).Error; err != nil {
+			return err
+		}
+		var courseIDs, bundleIDs, teachers []int
+		shares := make(map[int]decimal.Decimal)
+		titles := make(map[int][]string)
+		for _, item := range payment.Items {
+			courseIDs = append(courseIDs, item.CourseID)
+			if item.BundleID != nil && !slices.Contains(bundleIDs, *item.BundleID) {
+				bundleIDs = append(bundleIDs, *item.BundleID)
+			}
+			if _, ok := shares[item.TeacherID]; !ok {
+				teachers = append(teachers, item.TeacherID)
+			}
+			shares[item.TeacherID] = shares[item.TeacherID].Add(item.NetAmount)
+			titles[item.TeacherID] = append(titles[item.TeacherID], item.Title)
+		}
+		// Подарок записывает на курсы не покупателя, а того, кто активирует код
+		gifted, err := activateGift(tx, payment.ID)
+		if err != nil {
+			return err
+		}
+		if !gifted {
+			if _, err := enrollUser(tx, payment.UserID, courseIDs); err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ? AND (course_id IN ? OR bundle_id IN ?)", payment.UserID, courseIDs, bundleIDs).Delete(&CartItem{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, teacherID := range teachers {
+			if err := tx.Model(&User{}).Where("id = ?", teacherID).Update("balance", gorm.Expr("balance + ?", shares[teacherID])).Error; err != nil {
+				return err
+			}
+		}
+		for _, teacherID := range teachers {
+			what := "услугу " + titles[teacherID][0]
+			if len(titles[teacherID]) > 1 {
+				what = "услуги " + strings.Join(titles[teacherID], ", ")
+			}
+			notifyUser(ctx, tx, teacherID, "payment", "Получена оплата за "+what+": "+shares[teacherID].StringFixed(2)+" руб.")
+		}
+		settled = true
+		return nil
+	})
+	return payment, settled, err
+}
+
+func clientOnly(c *gin.Context, fn string) bool {
+	if c.GetString("role") != "client" {
+		slog.WarnContext(c, fn+": Доступ запрещён")
+		respondError(c, errClientOnly)
+		return false
+	}
+	return true
+}
+
+// checkoutTarget — покупка одного курса или одного комплекта.
+type checkoutTarget struct {
+	CourseID int `json:"course_id" binding:"omitempty,gt=0"`
+	BundleID int `json:"bundle_id" binding:"omitempty,gt=0"`
+}
+
+func (t checkoutTarget) check(c *gin.Context, fn string) bool {
+	if (t.CourseID == 0) == (t.BundleID == 0) {
+		slog.WarnContext(c, fn+": Нужен либо курс, либо комплект", "course_id", t.CourseID, "bundle_id", t.BundleID)
+		respondError(c, errValidation.WithFields(FieldError{Field: "course_id", Code: "either"}))
+		return false
+	}
+	return true
+}
+
+func (t checkoutTarget) ids() (courseIDs, bundleIDs []int) {
+	if t.CourseID > 0 {
+		courseIDs = []int{t.CourseID}
+	}
+	if t.BundleID > 0 {
+		bundleIDs = []int{t.BundleID}
+	}
+	return courseIDs, bundleIDs
+}
+
+func loadCart(tx *gorm.DB, userID int) ([]CartItem, error) {
+	var items []CartItem
+	err := tx.Preload("Course", withDeletedCourse).Preload("Bundle", func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }).
+		Where("user_id = ?", userID).Order("id").Find(&items).Error
+	return items, err
+}
+
+func cartIDs(items []CartItem) (courseIDs, bundleIDs []int) {
+	for _, item := range items {
+		if item.CourseID != nil {
+			courseIDs = append(courseIDs, *item.CourseID)
+		}
+		if item.BundleID != nil {
+			bundleIDs = append(bundleIDs, *item.BundleID)
+		}
+	}
+	return courseIDs, bundleIDs
+}
+
+// getCart отдаёт корзину с суммой к оплате. Цены берутся текущие, позиции,
+// ставшие недоступными, остаются в корзине до оформления заказа.
+func getCart(c *gin.Context) {
+	if !clientOnly(c, "getCart") {
+		return
+	}
+	items, err := loadCart(reqDB(c), c.GetInt("userID"))
+	if err != nil {
+		slog.ErrorContext(c, "getCart: Ошибка получения корзины", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	var bundles []Bundle
+	for _, item := range items {
+		if item.Bundle != nil {
+			bundles = append(bundles, *item.Bundle)
+		}
+	}
+	if err := loadBundleCourses(reqDB(c), bundles); err != nil {
+		slog.ErrorContext(c, "getCart: Ошибка получения курсов комплектов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	total := decimal.Zero
+	for i := range items {
+		if items[i].Course != nil {
+			total = total.Add(items[i].Course.GrossPrice)
+		}
+		if items[i].Bundle != nil {
+			items[i].Bundle, bundles = &bundles[0], bundles[1:]
+			total = total.Add(items[i].Bundle.GrossPrice)
+		}
+	}
+	if items == nil {
+		items = []CartItem{}
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": total})
+}
+
+func addCartItem(c *gin.Context) {
+	if !clientOnly(c, "addCartItem") {
+		return
+	}
+	var input checkoutTarget
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "addCartItem: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if !input.check(c, "addCartItem") {
+		return
+	}
+	userID := c.GetInt("userID")
+	cart, err := loadCart(reqDB(c), userID)
+	if err != nil {
+		slog.ErrorContext(c, "addCartItem: Ошибка получения корзины", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if len(cart) >= maxCartItems {
+		slog.WarnContext(c, "addCartItem: Корзина заполнена", "user_id", userID)
+		respondError(c, errCartFull)
+		return
+	}
+	courseIDs, bundleIDs := input.ids()
+	items, _, ok := resolveCheckout(c, "addCartItem", userID, courseIDs, bundleIDs)
+	if !ok {
+		return
+	}
+	var inCart []int
+	for _, item := range cart {
+		if item.CourseID != nil {
+			inCart = append(inCart, *item.CourseID)
+		}
+		if item.Bundle != nil {
+			inCart = append(inCart, item.Bundle.CourseIDs...)
+		}
+	}
+	for _, item := range items {
+		if slices.Contains(inCart, item.CourseID) {
+			slog.WarnContext(c, "addCartItem: Курс уже есть в корзине", "course_id", item.CourseID)
+			respondError(c, errCartConflict)
+			return
+		}
+	}
+	item := CartItem{UserID: userID}
+	if input.CourseID > 0 {
+		item.CourseID = &input.CourseID
+	} else {
+		item.BundleID = &input.BundleID
+	}
+	if err := reqDB(c).Create(&item).Error; err != nil {
+		slog.ErrorContext(c, "addCartItem: Ошибка добавления в корзину", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "addCartItem: Позиция добавлена в корзину", "cart_item_id", item.ID)
+	getCart(c)
+}
+
+func deleteCartItem(c *gin.Context) {
+	if !clientOnly(c, "deleteCartItem") {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, "deleteCartItem: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return
+	}
+	res := reqDB(c).Where("id = ? AND user_id = ?", id, c.GetInt("userID")).Delete(&CartItem{})
+	if res.Error != nil {
+		slog.ErrorContext(c, "deleteCartItem: Ошибка удаления позиции", "error", res.Error)
+		respondError(c, errInternal)
+		return
+	}
+	if res.RowsAffected == 0 {
+		slog.WarnContext(c, "deleteCartItem: Позиция не найдена", "cart_item_id", id)
+		respondError(c, errCartItemNotFound)
+		return
+	}
+	getCart(c)
+}
+
+func clearCart(c *gin.Context) {
+	if !clientOnly(c, "clearCart") {
+		return
+	}
+	if err := reqDB(c).Where("user_id = ?", c.GetInt("userID")).Delete(&CartItem{}).Error; err != nil {
+		slog.ErrorContext(c, "clearCart: Ошибка очистки корзины", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Корзина очищена"})
+}
+
+// checkoutCart оформляет всю корзину одним платежом. Корзина очищается при
+// зачислении оплаты, поэтому после отказа от оплаты её можно оформить снова.
+func checkoutCart(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "payment.checkout")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	if !clientOnly(c, "checkoutCart") {
+		return
+	}
+	userID := c.GetInt("userID")
+	cart, err := loadCart(reqDB(c), userID)
+	if err != nil {
+		slog.ErrorContext(c, "checkoutCart: Ошибка получения корзины", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if len(cart) == 0 {
+		slog.WarnContext(c, "checkoutCart: Корзина пуста", "user_id", userID)
+		respondError(c, errCartEmpty)
+		return
+	}
+	courseIDs, bundleIDs := cartIDs(cart)
+	items, description, ok := resolveCheckout(c, "checkoutCart", userID, courseIDs, bundleIDs)
+	if !ok {
+		return
+	}
+	startCheckout(c, span, "checkoutCart", items, description, nil)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func decimals(values ...string) []decimal.Decimal {
+	result := make([]decimal.Decimal, len(values))
+	for i, v := range values {
+		result[i] = decimal.RequireFromString(v)
+	}
+	return result
+}
+
+func TestSplitAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   string
+		weights []string
+		want    []string
+	}{
+		{"пропорционально", "150", []string{"100", "200"}, []string{"50", "100"}},
+		{"остаток последней части", "100", []string{"1", "1", "1"}, []string{"33.33", "33.33", "33.34"}},
+		{"остаток с округлением вверх", "10", []string{"2", "1"}, []string{"6.67", "3.33"}},
+		{"копейки", "0.05", []string{"1", "1", "1", "1"}, []string{"0.01", "0.01", "0.01", "0.02"}},
+		{"один вес", "99.99", []string{"500"}, []string{"99.99"}},
+		{"нулевой вес", "90", []string{"0", "100", "200"}, []string{"0", "30", "60"}},
+		{"все веса нулевые", "100", []string{"0", "0", "0"}, []string{"33.33", "33.33", "33.34"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total := decimal.RequireFromString(tt.total)
+			parts := splitAmount(total, decimals(tt.weights...))
+			if len(parts) != len(tt.want) {
+				t.Fatalf("получено %d частей, ожидалось %d", len(parts), len(tt.want))
+			}
+			sum := decimal.Zero
+			for i, part := range parts {
+				if want := decimal.RequireFromString(tt.want[i]); !part.Equal(want) {
+					t.Errorf("часть %d: получено %s, ожидалось %s", i, part, want)
+				}
+				sum = sum.Add(part)
+			}
+			if !sum.Equal(total) {
+				t.Errorf("сумма частей %s не равна %s", sum, total)
+			}
+		})
+	}
+}
+
+// Сумма частей совпадает с исходной при любых весах.
+func TestSplitAmountSumsToTotal(t *testing.T) {
+	weights := decimals("1990", "2490.50", "0.01", "777", "3333.33")
+	for cents := int64(1); cents <= 100_000; cents += 997 {
+		total := decimal.New(cents, -2)
+		sum := decimal.Zero
+		for _, part := range splitAmount(total, weights) {
+			sum = sum.Add(part)
+		}
+		if !sum.Equal(total) {
+			t.Fatalf("%s: сумма частей %s", total, sum)
+		}
+	}
+}
+
+func TestPurchasedCourses(t *testing.T) {
+	bundleID := 7
+	tests := []struct {
+		name      string
+		items     []PaymentItem
+		want      []int
+		duplicate int
+	}{
+		{"без повторов", []PaymentItem{{CourseID: 1}, {CourseID: 2, BundleID: &bundleID}, {CourseID: 3, BundleID: &bundleID}}, []int{1, 2, 3}, 0},
+		{"курс отдельно и в комплекте", []PaymentItem{{CourseID: 1}, {CourseID: 2, BundleID: &bundleID}, {CourseID: 1, BundleID: &bundleID}}, nil, 1},
+		{"курс дважды", []PaymentItem{{CourseID: 5}, {CourseID: 5}}, nil, 5},
+		{"пустой заказ", nil, []int{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purchased, duplicate := purchasedCourses(tt.items)
+			if duplicate != tt.duplicate {
+				t.Errorf("повтор: получено %d, ожидалось %d", duplicate, tt.duplicate)
+			}
+			if !slices.Equal(purchased, tt.want) {
+				t.Errorf("курсы: получено %v, ожидалось %v", purchased, tt.want)
+			}
+		})
+	}
+}
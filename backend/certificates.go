@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pdf/fpdf"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Без похожих символов (0/O, 1/I), чтобы код было легко ввести вручную.
+const certificateCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+//go:embed templates/certificate.yaml
+var defaultCertificateTemplate []byte
+
+// Certificate выдаётся один раз на пару клиент–курс. Имена сохраняются на
+// момент выдачи, чтобы сертификат не менялся после правки профиля или курса.
+type Certificate struct {
+	ID          int       `json:"-" gorm:"primaryKey"`
+	Code        string    `json:"code" gorm:"uniqueIndex;not null"`
+	UserID      int       `json:"-" gorm:"uniqueIndex:idx_certificate_user_course;not null"`
+	CourseID    int       `json:"course_id" gorm:"uniqueIndex:idx_certificate_user_course;not null"`
+	FullName    string    `json:"full_name"`
+	CourseTitle string    `json:"course_title"`
+	TeacherName string    `json:"teacher_name"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+type certificateTemplate struct {
+	Orientation string `yaml:"orientation"`
+	Border      struct {
+		Margin float64 `yaml:"margin"`
+		Width  float64 `yaml:"width"`
+		Color  string  `yaml:"color"`
+	} `yaml:"border"`
+	Blocks []struct {
+		Text  string  `yaml:"text"`
+		Y     float64 `yaml:"y"`
+		Size  float64 `yaml:"size"`
+		Color string  `yaml:"color"`
+	} `yaml:"blocks"`
+}
+
+func newCertificateCode() (string, error) {
+	var b strings.Builder
+	size := big.NewInt(int64(len(certificateCodeAlphabet)))
+	for i := 0; i < 12; i++ {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(certificateCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// normalizeCertificateCode допускает ввод без дефисов и в нижнем регистре.
+func normalizeCertificateCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 12 {
+		return code
+	}
+	return code[:4] + "-" + code[4:8] + "-" + code[8:]
+}
+
+// issueCertificateIfComplete выдаёт сертификат, если клиент завершил все
+// уроки курса. Повторный вызов сертификат не дублирует.
+func issueCertificateIfComplete(c *gin.Context, userID, courseID int) {
+	progress, err := loadCourseProgress(reqDB(c), userID, []int{courseID})
+	if err != nil {
+		slog.ErrorContext(c, "issueCertificate: Ошибка расчёта прогресса", "error", err)
+		return
+	}
+	if p := progress[courseID]; p.TotalLessons == 0 || p.CompletedLessons < p.TotalLessons {
+		return
+	}
+	var user User
+	var course Course
+	if err := reqDB(c).Select("id", "full_name", "username").First(&user, userID).Error; err != nil {
+		slog.ErrorContext(c, "issueCertificate: Пользователь не найден", "error", err)
+		return
+	}
+	if err := reqDB(c).Unscoped().Preload("Teacher").First(&course, courseID).Error; err != nil {
+		slog.ErrorContext(c, "issueCertificate: Курс не найден", "error", err)
+		return
+	}
+	code, err := newCertificateCode()
+	if err != nil {
+		slog.ErrorContext(c, "issueCertificate: Ошибка генерации кода", "error", err)
+		return
+	}
+	cert := Certificate{
+		Code:        code,
+		UserID:      userID,
+		CourseID:    courseID,
+		FullName:    cmp.Or(user.FullName, user.Username),
+		CourseTitle: course.Title,
+		TeacherName: cmp.Or(course.Teacher.FullName, course.Teacher.Username),
+		IssuedAt:    time.Now(),
+	}
+	res := reqDB(c).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "course_id"}},
+		DoNothing: true,
+	}).Create(&cert)
+	if res.Error != nil {
+		slog.ErrorContext(c, "issueCertificate: Ошибка сохранения сертификата", "error", res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		return
+	}
+	slog.InfoContext(c, "issueCertificate: Сертификат выдан", "user_id", userID, "course_id", courseID, "code", code)
+	notifyUser(c, reqDB(c), userID, "certificate", "Курс "+course.Title+" завершён, сертификат "+code+" доступен в профиле")
+}
+
+func loadCertificateTemplate() (certificateTemplate, error) {
+	var tpl certificateTemplate
+	data := defaultCertificateTemplate
+	if cfg.CertificateTemplate != "" {
+		var err error
+		if data, err = os.ReadFile(cfg.CertificateTemplate); err != nil {
+			return tpl, fmt.Errorf("Ошибка чтения шаблона сертификата: %w", err)
+		}
+	}
+	if err := yaml.Unmarshal(data, &tpl); err != nil {
+		return tpl, fmt.Errorf("Ошибка разбора шаблона сертификата: %w", err)
+	}
+	return tpl, nil
+}
+
+func hexColor(s string) (int, int, int) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return 0, 0, 0
+	}
+	return int(v >> 16 & 0xff), int(v >> 8 & 0xff), int(v & 0xff)
+}
+
+// renderCertificate рисует PDF по шаблону: рамка и строки текста по центру.
+func renderCertificate(cert Certificate) ([]byte, error) {
+	tpl, err := loadCertificateTemplate()
+	if err != nil {
+		return nil, err
+	}
+	font, err := os.ReadFile(cfg.CertificateFont)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCertificatesNotConfigured, err)
+	}
+	data := map[string]string{
+		"FullName":    cert.FullName,
+		"CourseTitle": cert.CourseTitle,
+		"TeacherName": cert.TeacherName,
+		"Date":        cert.IssuedAt.Format("02.01.2006"),
+		"Code":        cert.Code,
+		"VerifyURL":   cfg.FrontendURL + "/certificates/" + cert.Code,
+	}
+	pdf := fpdf.New(cmp.Or(tpl.Orientation, "L"), "mm", "A4", "")
+	pdf.SetTitle("Сертификат "+cert.Code, true)
+	pdf.AddUTF8FontFromBytes("main", "", font)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+	width, height := pdf.GetPageSize()
+	if m := tpl.Border.Margin; tpl.Border.Width > 0 {
+		pdf.SetDrawColor(hexColor(tpl.Border.Color))
+		pdf.SetLineWidth(tpl.Border.Width)
+		pdf.Rect(m, m, width-2*m, height-2*m, "D")
+	}
+	for i, block := range tpl.Blocks {
+		t, err := template.New(strconv.Itoa(i)).Parse(block.Text)
+		if err != nil {
+			return nil, fmt.Errorf("Ошибка в строке %d шаблона сертификата: %w", i+1, err)
+		}
+		var text bytes.Buffer
+		if err := t.Execute(&text, data); err != nil {
+			return nil, fmt.Errorf("Ошибка в строке %d шаблона сертификата: %w", i+1, err)
+		}
+		size := cmp.Or(block.Size, 14)
+		pdf.SetFont("main", "", size)
+		pdf.SetTextColor(hexColor(block.Color))
+		pdf.SetXY(0, block.Y)
+		pdf.CellFormat(width, size*0.5, text.String(), "", 0, "C", false, 0, "")
+	}
+	var out bytes.Buffer
+	if err := pdf.Output(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func getCertificates(c *gin.Context) {
+	var certs []Certificate
+	if err := reqDB(c).Where("user_id = ?", c.GetInt("userID")).Order("issued_at DESC").Find(&certs).Error; err != nil {
+		slog.ErrorContext(c, "getCertificates: Ошибка получения сертификатов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, certs)
+}
+
+func findCertificate(c *gin.Context, fn string) (Certificate, bool) {
+	var cert Certificate
+	code := normalizeCertificateCode(c.Param("code"))
+	if err := reqDB(c).Where("code = ?", code).First(&cert).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(c, fn+": Сертификат не найден", "code", code)
+			respondError(c, errCertificateNotFound)
+		} else {
+			slog.ErrorContext(c, fn+": Ошибка получения сертификата", "error", err)
+			respondError(c, errInternal)
+		}
+		return cert, false
+	}
+	return cert, true
+}
+
+// verifyCertificate — публичная проверка подлинности по коду.
+func verifyCertificate(c *gin.Context) {
+	cert, ok := findCertificate(c, "verifyCertificate")
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, cert)
+}
+
+func downloadCertificate(c *gin.Context) {
+	cert, ok := findCertificate(c, "downloadCertificate")
+	if !ok {
+		return
+	}
+	if cert.UserID != c.GetInt("userID") && c.GetString("role") != "admin" {
+		slog.WarnContext(c, "downloadCertificate: Доступ запрещён", "code", cert.Code)
+		respondError(c, errCertificateNotFound)
+		return
+	}
+	pdf, err := renderCertificate(cert)
+	if err != nil {
+		slog.ErrorContext(c, "downloadCertificate: Ошибка формирования PDF", "error", err)
+		if errors.Is(err, errCertificatesNotConfigured) {
+			respondError(c, errCertificatesNotConfigured)
+		} else {
+			respondError(c, errInternal)
+		}
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="certificate-`+cert.Code+`.pdf"`)
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
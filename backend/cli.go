@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+	"gorm.io/gorm"
+)
+
+type cliCommand struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"create-admin", "создать учетную запись администратора", cmdCreateAdmin},
+		{"seed", "загрузить демо-данные из файла фикстур", cmdSeed},
+		{"recalc-balances", "пересчитать балансы нутрициологов по оплаченным платежам", cmdRecalcBalances},
+		{"purge-test-data", "удалить тестовых пользователей и связанные с ними данные", cmdPurgeTestData},
+		{"migrate-files", "перенести загруженные файлы из локальных директорий в хранилище", cmdMigrateFiles},
+		{"map-services", "сопоставить услуги курсов и профилей со справочником", cmdMapServices},
+	}
+}
+
+func runCLI(args []string) error {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printCLIUsage()
+		return nil
+	}
+	for _, cmd := range cliCommands {
+		if cmd.name == args[0] {
+			if err := loadConfig(); err != nil {
+				return err
+			}
+			return cmd.run(args[1:])
+		}
+	}
+	printCLIUsage()
+	return fmt.Errorf("неизвестная команда %q", args[0])
+}
+
+func printCLIUsage() {
+	fmt.Fprintln(os.Stderr, "Использование: education [команда] [флаги]")
+	fmt.Fprintln(os.Stderr, "Без команды запускается HTTP-сервер.")
+	fmt.Fprintln(os.Stderr, "\nКоманды:")
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+func cmdCreateAdmin(args []string) error {
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	username := fs.String("username", "", "имя пользователя")
+	email := fs.String("email", "", "email")
+	fullName := fs.String("full-name", "Администратор", "полное имя")
+	fs.Parse(args)
+
+	in := bufio.NewReader(os.Stdin)
+	var err error
+	if *username == "" {
+		if *username, err = prompt(in, "Имя пользователя: "); err != nil {
+			return err
+		}
+	}
+	if *email == "" {
+		if *email, err = prompt(in, "Email: "); err != nil {
+			return err
+		}
+	}
+	if !usernamePattern.MatchString(*username) || *email == "" {
+		return errors.New("нужны email и имя пользователя из 3–32 символов: латинские буквы, цифры, _ . -")
+	}
+	password, err := promptPassword(in, "Пароль: ")
+	if err != nil {
+		return err
+	}
+	if !passwordStrong(password) {
+		return errors.New("пароль должен быть от 8 до 72 символов и содержать буквы и цифры")
+	}
+	confirm, err := promptPassword(in, "Повторите пароль: ")
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return errors.New("пароли не совпадают")
+	}
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("Ошибка хеширования пароля: %w", err)
+	}
+	admin := User{
+		Username: *username,
+		Email:    *email,
+		Password: string(hashedPassword),
+		Role:     "admin",
+		FullName: *fullName,
+	}
+	if err := db.Create(&admin).Error; err != nil {
+		return fmt.Errorf("Ошибка создания администратора: %w", err)
+	}
+	fmt.Printf("Создан администратор %s (id %d)\n", admin.Username, admin.ID)
+	return nil
+}
+
+func prompt(in *bufio.Reader, label string) (string, error) {
+	fmt.Print(label)
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func promptPassword(in *bufio.Reader, label string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(in, label)
+	}
+	fmt.Print(label)
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+type seedUser struct {
+	Username    string      `json:"username"`
+	Email       string      `json:"email"`
+	Password    string      `json:"password"`
+	FullName    string      `json:"full_name"`
+	Description string      `json:"description"`
+	Services    StringArray `json:"services"`
+}
+
+type seedCourse struct {
+	Teacher     string      `json:"teacher"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Services    StringArray `json:"services"`
+	NetPrice    float64     `json:"net_price"`
+	VideoURL    string      `json:"video_url"`
+	Duration    int         `json:"duration_weeks"`
+	Format      string      `json:"format"`
+}
+
+type seedReview struct {
+	Author  string `json:"author"`
+	Course  string `json:"course"`
+	Content string `json:"content"`
+	Rating  int    `json:"rating"`
+}
+
+type seedCategory struct {
+	Slug   string         `json:"slug"`
+	Parent string         `json:"parent"`
+	Names  LocalizedNames `json:"names"`
+}
+
+type seedService struct {
+	Slug     string         `json:"slug"`
+	Category string         `json:"category"`
+	Names    LocalizedNames `json:"names"`
+	Aliases  StringArray    `json:"aliases"`
+}
+
+type seedFixtures struct {
+	Categories []seedCategory `json:"categories"`
+	Services   []seedService  `json:"services"`
+	Nutris     []seedUser     `json:"nutris"`
+	Clients    []seedUser     `json:"clients"`
+	Courses    []seedCourse   `json:"courses"`
+	Reviews    []seedReview   `json:"reviews"`
+}
+
+func cmdSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	file := fs.String("file", "fixtures/demo.json", "путь к файлу фикстур")
+	fs.Parse(args)
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return fmt.Errorf("Ошибка чтения фикстур: %w", err)
+	}
+	var fixtures seedFixtures
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return fmt.Errorf("Ошибка разбора фикстур: %w", err)
+	}
+	if err := initDB(); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := seedTaxonomy(tx, fixtures); err != nil {
+			return err
+		}
+		users := make(map[string]User)
+		for _, u := range fixtures.Nutris {
+			user, err := seedUserRecord(tx, u, "nutri")
+			if err != nil {
+				return err
+			}
+			users[u.Username] = user
+		}
+		for _, u := range fixtures.Clients {
+			user, err := seedUserRecord(tx, u, "client")
+			if err != nil {
+				return err
+			}
+			users[u.Username] = user
+		}
+		courses := make(map[string]Course)
+		for _, sc := range fixtures.Courses {
+			teacher, ok := users[sc.Teacher]
+			if !ok {
+				return fmt.Errorf("курс %q: нутрициолог %q не описан в фикстурах", sc.Title, sc.Teacher)
+			}
+			var course Course
+			err := tx.Where("teacher_id = ? AND title = ?", teacher.ID, sc.Title).First(&course).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				netPrice := decimal.NewFromFloat(sc.NetPrice)
+				course = Course{
+					TeacherID:     teacher.ID,
+					Title:         sc.Title,
+					Services:      sc.Services,
+					Description:   sc.Description,
+					NetPrice:      netPrice,
+					GrossPrice:    netPrice.Mul(grossMultiplier),
+					VideoURL:      sc.VideoURL,
+					DurationWeeks: sc.Duration,
+					Format:        sc.Format,
+				}
+				if err := tx.Create(&course).Error; err != nil {
+					return fmt.Errorf("Ошибка создания курса %q: %w", sc.Title, err)
+				}
+				fmt.Printf("Создан курс %q\n", course.Title)
+			} else if err != nil {
+				return err
+			}
+			courses[sc.Title] = course
+		}
+		for _, sr := range fixtures.Reviews {
+			author, ok := users[sr.Author]
+			if !ok {
+				return fmt.Errorf("отзыв: автор %q не описан в фикстурах", sr.Author)
+			}
+			course, ok := courses[sr.Course]
+			if !ok {
+				return fmt.Errorf("отзыв: курс %q не описан в фикстурах", sr.Course)
+			}
+			// Отзыв возможен только после записи на курс
+			enrollment := Enrollment{CourseID: course.ID, UserID: author.ID}
+			if err := tx.Where(&enrollment).FirstOrCreate(&enrollment).Error; err != nil {
+				return fmt.Errorf("Ошибка создания записи: %w", err)
+			}
+			review := Review{AuthorID: author.ID, CourseID: course.ID, Content: sr.Content, Rating: sr.Rating}
+			if err := tx.Where(&review).FirstOrCreate(&review).Error; err != nil {
+				return fmt.Errorf("Ошибка создания отзыва: %w", err)
+			}
+		}
+		// Услуги из фикстур заданы текстом, ID проставляются по справочнику
+		if _, err := remapServices(tx, true); err != nil {
+			return fmt.Errorf("Ошибка сопоставления услуг: %w", err)
+		}
+		fmt.Printf("Загружено: %d разделов, %d услуг, %d нутрициологов, %d клиентов, %d курсов, %d отзывов\n",
+			len(fixtures.Categories), len(fixtures.Services), len(fixtures.Nutris), len(fixtures.Clients), len(fixtures.Courses), len(fixtures.Reviews))
+		return nil
+	})
+}
+
+// seedTaxonomy создаёт разделы и услуги, которых ещё нет. Родительский
+// раздел должен быть описан в фикстурах раньше дочернего.
+func seedTaxonomy(tx *gorm.DB, fixtures seedFixtures) error {
+	categories := make(map[string]int)
+	for _, sc := range fixtures.Categories {
+		category := Category{Slug: sc.Slug, Names: sc.Names}
+		if sc.Parent != "" {
+			parentID, ok := categories[sc.Parent]
+			if !ok {
+				return fmt.Errorf("раздел %q: родитель %q не описан в фикстурах выше", sc.Slug, sc.Parent)
+			}
+			category.ParentID = &parentID
+		}
+		if err := tx.Where("slug = ?", sc.Slug).FirstOrCreate(&category).Error; err != nil {
+			return fmt.Errorf("Ошибка создания раздела %q: %w", sc.Slug, err)
+		}
+		categories[sc.Slug] = category.ID
+	}
+	for _, ss := range fixtures.Services {
+		tag := ServiceTag{Slug: ss.Slug, Names: ss.Names, Aliases: ss.Aliases}
+		if ss.Category != "" {
+			categoryID, ok := categories[ss.Category]
+			if !ok {
+				return fmt.Errorf("услуга %q: раздел %q не описан в фикстурах", ss.Slug, ss.Category)
+			}
+			tag.CategoryID = &categoryID
+		}
+		if err := tx.Where("slug = ?", ss.Slug).FirstOrCreate(&tag).Error; err != nil {
+			return fmt.Errorf("Ошибка создания услуги %q: %w", ss.Slug, err)
+		}
+	}
+	return nil
+}
+
+func seedUserRecord(tx *gorm.DB, u seedUser, role string) (User, error) {
+	var user User
+	err := tx.Where("username = ?", u.Username).First(&user).Error
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return user, fmt.Errorf("Ошибка хеширования пароля: %w", err)
+	}
+	user = User{
+		Username:    u.Username,
+		Email:       u.Email,
+		Password:    string(hashedPassword),
+		Role:        role,
+		FullName:    u.FullName,
+		Description: u.Description,
+		Services:    u.Services,
+	}
+	if err := tx.Create(&user).Error; err != nil {
+		return user, fmt.Errorf("Ошибка создания пользователя %q: %w", u.Username, err)
+	}
+	fmt.Printf("Создан пользователь %s (%s)\n", user.Username, role)
+	return user, nil
+}
+
+func cmdRecalcBalances(args []string) error {
+	fs := flag.NewFlagSet("recalc-balances", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "только показать расхождения, не изменяя балансы")
+	fs.Parse(args)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	var rows []struct {
+		ID           int
+		Username     string
+		Balance      decimal.Decimal
+		PayoutAmount decimal.Decimal
+		Earned       decimal.Decimal
+	}
+	err := db.Raw(`
+		SELECT u.id, u.username, u.balance, u.payout_amount,
+		       COALESCE((SELECT SUM(i.net_amount) FROM payment_items i JOIN payments p ON p.id = i.payment_id
+		                 WHERE i.teacher_id = u.id AND p.status = 'paid'), 0) AS earned
+		FROM users u
+		WHERE u.role = 'nutri'
+		ORDER BY u.id
+	`).Scan(&rows).Error
+	if err != nil {
+		return fmt.Errorf("Ошибка расчета балансов: %w", err)
+	}
+	changed := 0
+	for _, row := range rows {
+		expected := row.Earned.Sub(row.PayoutAmount)
+		if expected.Equal(row.Balance) {
+			continue
+		}
+		changed++
+		fmt.Printf("%-20s баланс %s -> %s\n", row.Username, row.Balance.StringFixed(2), expected.StringFixed(2))
+		if *dryRun {
+			continue
+		}
+		if err := db.Model(&User{}).Where("id = ?", row.ID).Update("balance", expected).Error; err != nil {
+			return fmt.Errorf("Ошибка обновления баланса пользователя %d: %w", row.ID, err)
+		}
+	}
+	fmt.Printf("Проверено %d нутрициологов, расхождений: %d\n", len(rows), changed)
+	return nil
+}
+
+// cmdMapServices сопоставляет свободный ввод услуг со справочником и
+// печатает значения, для которых нужно добавить услугу или синоним.
+func cmdMapServices(args []string) error {
+	fs := flag.NewFlagSet("map-services", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "только показать результат, не изменяя записи")
+	fs.Parse(args)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	var result remapResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = remapServices(tx, !*dryRun)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Ошибка сопоставления услуг: %w", err)
+	}
+	for _, u := range result.Unmapped {
+		fmt.Printf("%-40s курсов: %d, профилей: %d\n", u.Value, u.Courses, u.Users)
+	}
+	fmt.Printf("Изменено курсов: %d, профилей: %d, значений без услуги в справочнике: %d\n",
+		result.Courses, result.Users, len(result.Unmapped))
+	return nil
+}
+
+func cmdPurgeTestData(args []string) error {
+	fs := flag.NewFlagSet("purge-test-data", flag.ExitOnError)
+	domain := fs.String("domain", "example.com", "домен email тестовых пользователей")
+	yes := fs.Bool("yes", false, "удалить без подтверждения")
+	fs.Parse(args)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	var users []User
+	if err := db.Where("email LIKE ? AND role <> ?", "%@"+*domain, "admin").Find(&users).Error; err != nil {
+		return fmt.Errorf("Ошибка поиска тестовых пользователей: %w", err)
+	}
+	if len(users) == 0 {
+		fmt.Println("Тестовые пользователи не найдены")
+		return nil
+	}
+	ids := make([]int, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+		fmt.Printf("  %s <%s> (%s)\n", u.Username, u.Email, u.Role)
+	}
+	if !*yes {
+		answer, err := prompt(bufio.NewReader(os.Stdin), fmt.Sprintf("Удалить %d пользователей и их данные? [y/N]: ", len(users)))
+		if err != nil || strings.ToLower(answer) != "y" {
+			fmt.Println("Отменено")
+			return nil
+		}
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var courses []int
+		if err := tx.Unscoped().Model(&Course{}).Where("teacher_id IN ?", ids).Pluck("id", &courses).Error; err != nil {
+			return fmt.Errorf("Ошибка поиска курсов: %w", err)
+		}
+		steps := []struct {
+			model interface{}
+			query string
+			args  []interface{}
+		}{
+			{&Recommendation{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&LessonProgress{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&Certificate{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&QuizAttempt{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&AssignmentSubmission{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&QuizQuestion{}, "lesson_id IN (SELECT id FROM lessons WHERE course_id IN ?)", []interface{}{courses}},
+			{&Video{}, "course_id IN ?", []interface{}{courses}},
+			{&Lesson{}, "course_id IN ?", []interface{}{courses}},
+			{&CourseModule{}, "course_id IN ?", []interface{}{courses}},
+			{&Review{}, "author_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&Enrollment{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&CartItem{}, "user_id IN ? OR course_id IN ? OR bundle_id IN (SELECT id FROM bundles WHERE teacher_id IN ?)", []interface{}{ids, courses, ids}},
+			{&Bundle{}, "teacher_id IN ?", []interface{}{ids}},
+			{&Gift{}, "payer_id IN ? OR recipient_id IN ?", []interface{}{ids, ids}},
+			{&PaymentItem{}, "course_id IN ? OR payment_id IN (SELECT id FROM payments WHERE user_id IN ?)", []interface{}{courses, ids}},
+			{&Payment{}, "user_id IN ? OR course_id IN ?", []interface{}{ids, courses}},
+			{&Message{}, "sender_id IN ? OR receiver_id IN ?", []interface{}{ids, ids}},
+			{&Dialog{}, "sender_id IN ? OR receiver_id IN ?", []interface{}{ids, ids}},
+			{&Notification{}, "user_id IN ?", []interface{}{ids}},
+			{&Course{}, "teacher_id IN ?", []interface{}{ids}},
+			{&User{}, "id IN ?", []interface{}{ids}},
+		}
+		for _, step := range steps {
+			res := tx.Unscoped().Where(step.query, step.args...).Delete(step.model)
+			if res.Error != nil {
+				return fmt.Errorf("Ошибка удаления %T: %w", step.model, res.Error)
+			}
+			fmt.Printf("%-22T удалено %d\n", step.model, res.RowsAffected)
+		}
+		return nil
+	})
+}
+
+// cmdMigrateFiles переносит файлы, загруженные до появления хранилища, из
+// локальных директорий в текущее хранилище. Ключи совпадают с прежними
+// путями, поэтому ссылки в БД менять не нужно.
+func cmdMigrateFiles(args []string) error {
+	fs := flag.NewFlagSet("migrate-files", flag.ExitOnError)
+	from := fs.String("from", "./Uploads,./uploads", "исходные директории через запятую")
+	remove := fs.Bool("remove", false, "удалить исходные файлы после переноса")
+	dryRun := fs.Bool("dry-run", false, "только показать файлы для переноса")
+	fs.Parse(args)
+
+	if err := initStorage(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	copied, skipped := 0, 0
+	for _, root := range strings.Split(*from, ",") {
+		for _, dir := range []string{avatarFilesDir, lessonFilesDir, submissionFilesDir} {
+			entries, err := os.ReadDir(filepath.Join(root, dir))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					continue
+				}
+				src := filepath.Join(root, dir, e.Name())
+				key := dir + "/" + e.Name()
+				// На нечувствительной к регистру ФС Uploads и uploads — одна директория
+				if local, ok := storage.(localStorage); ok {
+					dst, err := local.path(key)
+					if err != nil {
+						return err
+					}
+					srcInfo, err1 := os.Stat(src)
+					dstInfo, err2 := os.Stat(dst)
+					if err1 == nil && err2 == nil && os.SameFile(srcInfo, dstInfo) {
+						skipped++
+						continue
+					}
+				}
+				if _, err := storage.Size(ctx, key); err == nil {
+					fmt.Printf("  %s уже в хранилище\n", key)
+					skipped++
+					continue
+				}
+				fmt.Printf("  %s -> %s\n", src, key)
+				if *dryRun {
+					continue
+				}
+				if err := copyToStorage(ctx, src, key); err != nil {
+					return fmt.Errorf("Ошибка переноса %s: %w", src, err)
+				}
+				copied++
+				if *remove {
+					if err := os.Remove(src); err != nil {
+						return fmt.Errorf("Ошибка удаления %s: %w", src, err)
+					}
+				}
+			}
+		}
+	}
+	fmt.Printf("Перенесено %d, пропущено %d\n", copied, skipped)
+
+	if err := initDB(); err != nil {
+		return err
+	}
+	var avatars []string
+	if err := db.Model(&User{}).Where("avatar_url LIKE ?", "/avatars/%").Pluck("avatar_url", &avatars).Error; err != nil {
+		return fmt.Errorf("Ошибка проверки аватаров: %w", err)
+	}
+	missing := 0
+	for _, url := range avatars {
+		if _, err := storage.Size(ctx, avatarFilesDir+"/"+strings.TrimPrefix(url, "/avatars/")); err != nil {
+			fmt.Printf("  аватар %s не найден в хранилище\n", url)
+			missing++
+		}
+	}
+	if missing > 0 {
+		fmt.Printf("Не найдено аватаров: %d из %d\n", missing, len(avatars))
+	}
+	return nil
+}
+
+func copyToStorage(ctx context.Context, src, key string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return storage.Put(ctx, key, f)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Env         string `yaml:"env"`
+	Port        string `yaml:"port"`
+	DSN         string `yaml:"dsn"`
+	JWTSecret   string `yaml:"jwt_secret"`
+	AESKey      string `yaml:"aes_key"`
+	ShopID      string `yaml:"shop_id"`
+	SecretKey   string `yaml:"secret_key"`
+	FrontendURL string `yaml:"frontend_url"`
+	LogLevelRaw string `yaml:"log_level"`
+	// Пустой токен отключает /metrics
+	MetricsToken string `yaml:"metrics_token"`
+	// none, stdout или otlp
+	TracingExporter string `yaml:"tracing_exporter"`
+	OTLPEndpoint    string `yaml:"otlp_endpoint"`
+	// TTF-шрифт с кириллицей для PDF-сертификатов
+	CertificateFont string `yaml:"certificate_font"`
+	// Пустой путь — встроенный шаблон templates/certificate.yaml
+	CertificateTemplate string `yaml:"certificate_template"`
+	// Без ffmpeg загруженные видео остаются в очереди на обработку, а
+	// изображения сохраняются только в JPEG
+	FFmpegPath  string `yaml:"ffmpeg_path"`
+	FFprobePath string `yaml:"ffprobe_path"`
+	// local или s3
+	StorageBackend string `yaml:"storage_backend"`
+	StorageDir     string `yaml:"storage_dir"`
+	// S3-совместимое хранилище, для разработки — MinIO
+	S3Endpoint  string `yaml:"s3_endpoint"`
+	S3Region    string `yaml:"s3_region"`
+	S3Bucket    string `yaml:"s3_bucket"`
+	S3AccessKey string `yaml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key"`
+	// Без SMTP письма не отправляются, коды подарков видны покупателю в
+	// профиле
+	SMTPAddr     string `yaml:"smtp_addr"`
+	SMTPUser     string `yaml:"smtp_user"`
+	SMTPPassword string `yaml:"smtp_password"`
+	MailFrom     string `yaml:"mail_from"`
+
+	LogLevel slog.Level `yaml:"-"`
+}
+
+var cfg Config
+
+// Порядок приоритета: значения по умолчанию, YAML-файл, профиль окружения
+// из YAML, переменные окружения (включая .env).
+func loadConfig() error {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Ошибка загрузки .env файла: %w", err)
+	}
+	c := Config{
+		Env:         "development",
+		Port:        "8080",
+		FrontendURL: "http://localhost:3000",
+		LogLevelRaw: "info",
+
+		TracingExporter: "none",
+		CertificateFont: "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf",
+		FFmpegPath:      "ffmpeg",
+		FFprobePath:     "ffprobe",
+		StorageBackend:  "local",
+		StorageDir:      "./uploads",
+	}
+	if env := os.Getenv("APP_ENV"); env != "" {
+		c.Env = env
+	}
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		path = "config.yaml"
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			path = ""
+		}
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return err
+		}
+	}
+	c.loadEnv()
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("Неверная конфигурация:\n%w", err)
+	}
+	cfg = c
+	return nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Ошибка чтения %s: %w", path, err)
+	}
+	file := struct {
+		Config   `yaml:",inline"`
+		Profiles map[string]yaml.Node `yaml:"profiles"`
+	}{Config: *c}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("Ошибка разбора %s: %w", path, err)
+	}
+	// APP_ENV из окружения важнее поля env в файле
+	if env := os.Getenv("APP_ENV"); env != "" {
+		file.Env = env
+	}
+	if profile, ok := file.Profiles[file.Env]; ok {
+		if err := profile.Decode(&file.Config); err != nil {
+			return fmt.Errorf("Ошибка разбора профиля %s в %s: %w", file.Env, path, err)
+		}
+	}
+	*c = file.Config
+	return nil
+}
+
+func (c *Config) loadEnv() {
+	vars := []struct {
+		name  string
+		field *string
+	}{
+		{"APP_ENV", &c.Env},
+		{"PORT", &c.Port},
+		{"DSN", &c.DSN},
+		{"JWT_SECRET", &c.JWTSecret},
+		{"AES_KEY", &c.AESKey},
+		{"SHOP_ID", &c.ShopID},
+		{"SECRET_KEY", &c.SecretKey},
+		{"FRONTEND_URL", &c.FrontendURL},
+		{"LOG_LEVEL", &c.LogLevelRaw},
+		{"METRICS_TOKEN", &c.MetricsToken},
+		{"TRACING_EXPORTER", &c.TracingExporter},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT", &c.OTLPEndpoint},
+		{"CERTIFICATE_FONT", &c.CertificateFont},
+		{"CERTIFICATE_TEMPLATE", &c.CertificateTemplate},
+		{"FFMPEG_PATH", &c.FFmpegPath},
+		{"FFPROBE_PATH", &c.FFprobePath},
+		{"STORAGE_BACKEND", &c.StorageBackend},
+		{"STORAGE_DIR", &c.StorageDir},
+		{"S3_ENDPOINT", &c.S3Endpoint},
+		{"S3_REGION", &c.S3Region},
+		{"S3_BUCKET", &c.S3Bucket},
+		{"S3_ACCESS_KEY", &c.S3AccessKey},
+		{"S3_SECRET_KEY", &c.S3SecretKey},
+		{"SMTP_ADDR", &c.SMTPAddr},
+		{"SMTP_USER", &c.SMTPUser},
+		{"SMTP_PASSWORD", &c.SMTPPassword},
+		{"MAIL_FROM", &c.MailFrom},
+	}
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v.name); ok && value != "" {
+			*v.field = value
+		}
+	}
+	c.FrontendURL = strings.TrimRight(c.FrontendURL, "/")
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	switch c.Env {
+	case "development", "staging", "production":
+	default:
+		errs = append(errs, fmt.Errorf("APP_ENV: неизвестное окружение %q (development, staging, production)", c.Env))
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT: неверный порт %q", c.Port))
+	}
+	if c.DSN == "" {
+		errs = append(errs, errors.New("DSN: строка подключения к БД не задана"))
+	}
+	if len(c.JWTSecret) < 32 {
+		errs = append(errs, fmt.Errorf("JWT_SECRET: должен содержать не менее 32 символов, задано %d", len(c.JWTSecret)))
+	}
+	if key, err := hex.DecodeString(c.AESKey); err != nil {
+		errs = append(errs, fmt.Errorf("AES_KEY: ожидается hex-строка: %v", err))
+	} else if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		errs = append(errs, fmt.Errorf("AES_KEY: длина ключа должна быть 16, 24 или 32 байта, задано %d", len(key)))
+	}
+	if (c.ShopID == "") != (c.SecretKey == "") {
+		errs = append(errs, errors.New("SHOP_ID и SECRET_KEY должны быть заданы вместе"))
+	} else if c.ShopID == "" && c.Env == "production" {
+		errs = append(errs, errors.New("SHOP_ID и SECRET_KEY обязательны в production"))
+	}
+	if u, err := url.Parse(c.FrontendURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("FRONTEND_URL: ожидается абсолютный http(s) URL, задано %q", c.FrontendURL))
+	} else if c.Env == "production" && u.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("FRONTEND_URL: в production требуется https, задано %q", c.FrontendURL))
+	}
+	if c.MetricsToken != "" && len(c.MetricsToken) < 16 {
+		errs = append(errs, errors.New("METRICS_TOKEN: должен содержать не менее 16 символов"))
+	}
+	switch c.TracingExporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("TRACING_EXPORTER: неизвестный экспортер %q (none, stdout, otlp)", c.TracingExporter))
+	}
+	if c.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.OTLPEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT: ожидается URL, задано %q", c.OTLPEndpoint))
+		}
+	}
+	switch c.StorageBackend {
+	case "local":
+		if c.StorageDir == "" {
+			errs = append(errs, errors.New("STORAGE_DIR: директория хранилища не задана"))
+		}
+	case "s3":
+		if u, err := url.Parse(c.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("S3_ENDPOINT: ожидается http(s) URL, задано %q", c.S3Endpoint))
+		}
+		if c.S3Bucket == "" || c.S3AccessKey == "" || c.S3SecretKey == "" {
+			errs = append(errs, errors.New("S3_BUCKET, S3_ACCESS_KEY и S3_SECRET_KEY обязательны для хранилища s3"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_BACKEND: неизвестное хранилище %q (local, s3)", c.StorageBackend))
+	}
+	if c.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("SMTP_ADDR: ожидается host:port, задано %q", c.SMTPAddr))
+		}
+		if _, err := mail.ParseAddress(c.MailFrom); err != nil {
+			errs = append(errs, fmt.Errorf("MAIL_FROM: неверный адрес отправителя %q", c.MailFrom))
+		}
+	}
+	if level, err := parseLogLevel(c.LogLevelRaw); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL: неизвестный уровень %q (debug, info, warn, error)", c.LogLevelRaw))
+	} else {
+		c.LogLevel = level
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) paymentsConfigured() bool {
+	return c.ShopID != "" && c.SecretKey != ""
+}
+
+func (c *Config) mailConfigured() bool {
+	return c.SMTPAddr != ""
+}
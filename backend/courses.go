@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+const (
+	courseStatusDraft     = "draft"
+	courseStatusPublished = "published"
+	courseStatusArchived  = "archived"
+)
+
+// grossMultiplier — наценка платформы: клиент платит NetPrice * 1.5.
+var grossMultiplier = decimal.NewFromFloat(1.5)
+
+// publishedCourses оставляет курсы, доступные в каталоге и для покупки.
+// Мягко удалённые курсы gorm отфильтровывает сам.
+func publishedCourses(tx *gorm.DB) *gorm.DB {
+	return tx.Where("courses.status = ?", courseStatusPublished)
+}
+
+// withDeletedCourse подгружает курс записи даже после мягкого удаления,
+// чтобы у оплативших клиентов сохранялся доступ.
+func withDeletedCourse(tx *gorm.DB) *gorm.DB {
+	return tx.Unscoped()
+}
+
+func isEnrolled(tx *gorm.DB, userID, courseID int) (bool, error) {
+	var count int64
+	err := tx.Model(&Enrollment{}).Where("user_id = ? AND course_id = ?", userID, courseID).Count(&count).Error
+	return count > 0, err
+}
+
+// canManageCourse — изменять курс может только его автор или администратор.
+func canManageCourse(course Course, userID int, role string) bool {
+	return role == "admin" || course.TeacherID == userID
+}
+
+// AfterFind прячет ссылку на видео курса при любой загрузке, чтобы она не
+// попала в каталог, поиск или профиль. Обработчики показывают её через
+// revealVideo после проверки доступа.
+func (c *Course) AfterFind(tx *gorm.DB) error {
+	c.videoURL, c.VideoURL = c.VideoURL, ""
+	return nil
+}
+
+func (c *Course) revealVideo() {
+	if c.VideoURL == "" {
+		c.VideoURL = c.videoURL
+	}
+}
+
+// canViewCourse: опубликованный курс виден всем, остальные — автору,
+// администратору и записанным клиентам.
+func canViewCourse(tx *gorm.DB, course Course, userID int, role string) (bool, error) {
+	if course.Status == courseStatusPublished && !course.DeletedAt.Valid {
+		return true, nil
+	}
+	if userID == 0 {
+		return false, nil
+	}
+	if canManageCourse(course, userID, role) {
+		return true, nil
+	}
+	return isEnrolled(tx, userID, course.ID)
+}
+
+// loadManagedCourse загружает курс из параметра :id и проверяет права на изменение.
+func loadManagedCourse(c *gin.Context, fn string) (Course, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return Course{}, false
+	}
+	return checkCourseManager(c, fn, id)
+}
+
+// checkCourseManager загружает курс и проверяет права на изменение.
+func checkCourseManager(c *gin.Context, fn string, courseID int) (Course, bool) {
+	var course Course
+	if err := reqDB(c).First(&course, courseID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(c, fn+": Курс не найден", "course_id", courseID)
+			respondError(c, errCourseNotFound)
+		} else {
+			slog.ErrorContext(c, fn+": Ошибка получения курса", "error", err)
+			respondError(c, errInternal)
+		}
+		return course, false
+	}
+	if !canManageCourse(course, c.GetInt("userID"), c.GetString("role")) {
+		slog.WarnContext(c, fn+": Доступ запрещён", "course_id", courseID)
+		respondError(c, errCourseOwnerOnly)
+		return course, false
+	}
+	return course, true
+}
+
+func updateCourse(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "updateCourse")
+	if !ok {
+		return
+	}
+	var input struct {
+		Title       *string      `json:"title" binding:"omitempty,notblank,max=200"`
+		Services    *StringArray `json:"services" binding:"omitempty,services"`
+		ServiceIDs  *IntArray    `json:"service_ids" binding:"omitempty,max=10,unique,dive,gt=0"`
+		CategoryID  *int         `json:"category_id" binding:"omitempty,min=0"`
+		Description *string      `json:"description" binding:"omitempty,max=5000"`
+		NetPrice    *float64     `json:"net_price" binding:"omitempty,price"`
+		VideoURL    *string      `json:"video_url" binding:"omitempty,weburl"`
+		Duration    *int         `json:"duration_weeks" binding:"omitempty,min=1,max=104"`
+		Format      *string      `json:"format" binding:"omitempty,oneof=self_paced group individual"`
+		Status      *string      `json:"status" binding:"omitempty,oneof=draft published archived"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateCourse: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	updates := make(map[string]any)
+	if input.Title != nil {
+		updates["title"] = *input.Title
+	}
+	if !serviceUpdates(c, "updateCourse", input.Services, input.ServiceIDs, updates) {
+		return
+	}
+	// category_id: 0 убирает курс из раздела
+	if input.CategoryID != nil {
+		if *input.CategoryID == 0 {
+			updates["category_id"] = nil
+		} else if !checkCategoryInput(c, "updateCourse", "category_id", *input.CategoryID) {
+			return
+		} else {
+			updates["category_id"] = *input.CategoryID
+		}
+	}
+	if input.Description != nil {
+		updates["description"] = *input.Description
+	}
+	if input.NetPrice != nil {
+		netPrice := decimal.NewFromFloat(*input.NetPrice)
+		updates["net_price"] = netPrice
+		updates["gross_price"] = netPrice.Mul(grossMultiplier)
+	}
+	if input.VideoURL != nil {
+		updates["video_url"] = *input.VideoURL
+	}
+	if input.Duration != nil {
+		updates["duration_weeks"] = *input.Duration
+	}
+	if input.Format != nil {
+		updates["format"] = *input.Format
+	}
+	if input.Status != nil && *input.Status != course.Status {
+		// Купленный курс нельзя вернуть в черновик, только архивировать
+		if *input.Status == courseStatusDraft {
+			var enrollments int64
+			if err := reqDB(c).Model(&Enrollment{}).Where("course_id = ?", course.ID).Count(&enrollments).Error; err != nil {
+				slog.ErrorContext(c, "updateCourse: Ошибка проверки записей", "error", err)
+				respondError(c, errInternal)
+				return
+			}
+			if enrollments > 0 {
+				slog.WarnContext(c, "updateCourse: Курс с записями нельзя сделать черновиком", "course_id", course.ID)
+				respondError(c, errCourseHasEnrollments)
+				return
+			}
+		}
+		updates["status"] = *input.Status
+	}
+	if len(updates) > 0 {
+		if err := reqDB(c).Model(&course).Updates(updates).Error; err != nil {
+			slog.ErrorContext(c, "updateCourse: Ошибка обновления курса", "error", err)
+			respondError(c, errInternal)
+			return
+		}
+	}
+	if err := reqDB(c).Preload("Teacher", publicUserFields).First(&course, course.ID).Error; err != nil {
+		slog.ErrorContext(c, "updateCourse: Ошибка получения курса", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	course.revealVideo()
+	slog.InfoContext(c, "updateCourse: Курс обновлён", "course_id", course.ID, "fields", len(updates))
+	c.JSON(http.StatusOK, course)
+}
+
+// deleteCourse удаляет курс мягко: из каталога он пропадает, а записанные
+// клиенты сохраняют доступ.
+func deleteCourse(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "deleteCourse")
+	if !ok {
+		return
+	}
+	if err := reqDB(c).Delete(&course).Error; err != nil {
+		slog.ErrorContext(c, "deleteCourse: Ошибка удаления курса", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "deleteCourse: Курс удалён", "course_id", course.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Курс удалён"})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/text/language"
+)
+
+// APIError — ошибка API со стабильным кодом. Текст сообщения берётся из
+// каталога по коду и языку запроса, клиенты должны опираться на code.
+type APIError struct {
+	Status int
+	Code   string
+	Fields []FieldError
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+func newAPIError(status int, code string) *APIError {
+	return &APIError{Status: status, Code: code}
+}
+
+func (e *APIError) Error() string {
+	return e.Code
+}
+
+func (e *APIError) WithFields(fields ...FieldError) *APIError {
+	clone := *e
+	clone.Fields = append(append([]FieldError(nil), e.Fields...), fields...)
+	return &clone
+}
+
+var (
+	errInvalidInput      = newAPIError(http.StatusBadRequest, "invalid_input")
+	errValidation        = newAPIError(http.StatusUnprocessableEntity, "validation_failed")
+	errInvalidID         = newAPIError(http.StatusBadRequest, "invalid_id")
+	errInvalidCursor     = newAPIError(http.StatusBadRequest, "invalid_cursor")
+	errCardNotSet        = newAPIError(http.StatusBadRequest, "card_not_set")
+	errAmountNotPositive = newAPIError(http.StatusBadRequest, "amount_not_positive")
+	errNegativePayout    = newAPIError(http.StatusBadRequest, "negative_payout_amount")
+	errChatWithSelf      = newAPIError(http.StatusBadRequest, "chat_with_self")
+	errFileMissing       = newAPIError(http.StatusBadRequest, "file_missing")
+	errFileTooLarge      = newAPIError(http.StatusRequestEntityTooLarge, "file_too_large")
+	errInvalidOrder      = newAPIError(http.StatusBadRequest, "invalid_order")
+	errNotAQuiz          = newAPIError(http.StatusBadRequest, "not_a_quiz")
+	errNotAnAssignment   = newAPIError(http.StatusBadRequest, "not_an_assignment")
+	errNotAVideo         = newAPIError(http.StatusBadRequest, "not_a_video")
+	errInvalidImage      = newAPIError(http.StatusBadRequest, "invalid_image")
+	errImageDimensions   = newAPIError(http.StatusBadRequest, "image_dimensions")
+	errCategoryCycle     = newAPIError(http.StatusBadRequest, "category_cycle")
+
+	errAttachmentNotAllowed = newAPIError(http.StatusBadRequest, "attachment_not_allowed")
+	errUnsupportedFileType  = newAPIError(http.StatusUnsupportedMediaType, "unsupported_file_type")
+	errAttachmentTooLarge   = newAPIError(http.StatusRequestEntityTooLarge, "attachment_too_large")
+	errVideoTooLarge        = newAPIError(http.StatusRequestEntityTooLarge, "video_too_large")
+
+	errTokenMissing       = newAPIError(http.StatusUnauthorized, "token_missing")
+	errTokenInvalid       = newAPIError(http.StatusUnauthorized, "token_invalid")
+	errInvalidCredentials = newAPIError(http.StatusUnauthorized, "invalid_credentials")
+
+	errAdminOnly                = newAPIError(http.StatusForbidden, "admin_only")
+	errClientOnly               = newAPIError(http.StatusForbidden, "client_only")
+	errNutriOnly                = newAPIError(http.StatusForbidden, "nutri_only")
+	errReviewRequiresEnrollment = newAPIError(http.StatusForbidden, "review_requires_enrollment")
+	errCourseOwnerOnly          = newAPIError(http.StatusForbidden, "course_owner_only")
+	errLessonRequiresEnrollment = newAPIError(http.StatusForbidden, "lesson_requires_enrollment")
+	errLessonLocked             = newAPIError(http.StatusForbidden, "lesson_locked")
+	errVideoLinkInvalid         = newAPIError(http.StatusForbidden, "video_link_invalid")
+	errFileLinkInvalid          = newAPIError(http.StatusForbidden, "file_link_invalid")
+
+	errUserNotFound    = newAPIError(http.StatusNotFound, "user_not_found")
+	errCourseNotFound  = newAPIError(http.StatusNotFound, "course_not_found")
+	errPaymentNotFound = newAPIError(http.StatusNotFound, "payment_not_found")
+	errModuleNotFound  = newAPIError(http.StatusNotFound, "module_not_found")
+	errLessonNotFound  = newAPIError(http.StatusNotFound, "lesson_not_found")
+
+	errSubmissionNotFound  = newAPIError(http.StatusNotFound, "submission_not_found")
+	errCertificateNotFound = newAPIError(http.StatusNotFound, "certificate_not_found")
+	errCategoryNotFound    = newAPIError(http.StatusNotFound, "category_not_found")
+	errServiceNotFound     = newAPIError(http.StatusNotFound, "service_not_found")
+	errBundleNotFound      = newAPIError(http.StatusNotFound, "bundle_not_found")
+	errCartItemNotFound    = newAPIError(http.StatusNotFound, "cart_item_not_found")
+	errGiftNotFound        = newAPIError(http.StatusNotFound, "gift_not_found")
+
+	errAttachmentNotFound = newAPIError(http.StatusNotFound, "attachment_not_found")
+	errVideoNotFound      = newAPIError(http.StatusNotFound, "video_not_found")
+	errFileNotFound       = newAPIError(http.StatusNotFound, "file_not_found")
+
+	errAlreadyPaid           = newAPIError(http.StatusConflict, "already_paid")
+	errPaymentNotInitialized = newAPIError(http.StatusConflict, "payment_not_initialized")
+	errCourseNotAvailable    = newAPIError(http.StatusConflict, "course_not_available")
+	errCourseHasEnrollments  = newAPIError(http.StatusConflict, "course_has_enrollments")
+	errQuizEmpty             = newAPIError(http.StatusConflict, "quiz_empty")
+	errSubmissionPending     = newAPIError(http.StatusConflict, "submission_pending")
+	errAssignmentApproved    = newAPIError(http.StatusConflict, "assignment_approved")
+	errSlugTaken             = newAPIError(http.StatusConflict, "slug_taken")
+	errCategoryNotEmpty      = newAPIError(http.StatusConflict, "category_not_empty")
+	errBundleNotAvailable    = newAPIError(http.StatusConflict, "bundle_not_available")
+	errCartConflict          = newAPIError(http.StatusConflict, "cart_conflict")
+	errCartFull              = newAPIError(http.StatusConflict, "cart_full")
+	errCartEmpty             = newAPIError(http.StatusConflict, "cart_empty")
+	errGiftRedeemed          = newAPIError(http.StatusConflict, "gift_redeemed")
+	errGiftExpired           = newAPIError(http.StatusConflict, "gift_expired")
+	errGiftRecipientEnrolled = newAPIError(http.StatusConflict, "gift_recipient_enrolled")
+	errInsufficientBalance   = newAPIError(http.StatusUnprocessableEntity, "insufficient_balance")
+	errInternal              = newAPIError(http.StatusInternalServerError, "internal_error")
+	errPaymentProviderError  = newAPIError(http.StatusBadGateway, "payment_provider_error")
+	errPaymentProviderDown   = newAPIError(http.StatusBadGateway, "payment_provider_unavailable")
+	errPaymentsNotConfigured = newAPIError(http.StatusServiceUnavailable, "payments_not_configured")
+
+	errCertificatesNotConfigured = newAPIError(http.StatusServiceUnavailable, "certificates_not_configured")
+	errMailNotConfigured         = newAPIError(http.StatusServiceUnavailable, "mail_not_configured")
+)
+
+// Русский каталог используется по умолчанию и для отсутствующих переводов.
+var messageCatalog = map[string]map[string]string{
+	"ru": {
+		"invalid_input":                "Неверные данные",
+		"validation_failed":            "Проверьте правильность заполнения полей",
+		"invalid_id":                   "Неверный ID",
+		"invalid_cursor":               "Неверный курсор страницы",
+		"card_not_set":                 "Карта не указана",
+		"amount_not_positive":          "Сумма должна быть больше 0",
+		"negative_payout_amount":       "Выплаченная сумма не может быть отрицательной",
+		"chat_with_self":               "Нельзя начать чат с самим собой",
+		"file_missing":                 "Ошибка загрузки файла",
+		"file_too_large":               "Файл превышает 5MB",
+		"invalid_order":                "Список должен содержать все элементы ровно по одному разу",
+		"not_a_quiz":                   "Урок не является тестом",
+		"not_an_assignment":            "Урок не является заданием",
+		"not_a_video":                  "Урок не является видеоуроком",
+		"invalid_image":                "Файл повреждён или не является изображением",
+		"image_dimensions":             "Изображение слишком маленькое или слишком большое",
+		"category_cycle":               "Раздел нельзя вложить в самого себя или в свой подраздел",
+		"attachment_not_allowed":       "К уроку этого типа нельзя прикрепить файл",
+		"unsupported_file_type":        "Неподдерживаемый тип файла",
+		"attachment_too_large":         "Файл превышает 20MB",
+		"video_too_large":              "Видео превышает 2GB",
+		"token_missing":                "Токен не предоставлен",
+		"token_invalid":                "Неверный токен",
+		"invalid_credentials":          "Неверное имя пользователя или пароль",
+		"admin_only":                   "Доступ только для администраторов",
+		"client_only":                  "Доступ только для клиентов",
+		"nutri_only":                   "Доступ только для нутрициологов",
+		"review_requires_enrollment":   "Отзыв возможен только после оплаты",
+		"course_owner_only":            "Изменять курс может только его автор или администратор",
+		"lesson_requires_enrollment":   "Урок доступен только после оплаты курса",
+		"lesson_locked":                "Урок ещё не открыт",
+		"video_link_invalid":           "Ссылка на видео недействительна или устарела",
+		"file_link_invalid":            "Ссылка на файл недействительна или устарела",
+		"user_not_found":               "Пользователь не найден",
+		"course_not_found":             "Курс не найден",
+		"payment_not_found":            "Платеж не найден",
+		"module_not_found":             "Модуль не найден",
+		"lesson_not_found":             "Урок не найден",
+		"submission_not_found":         "Ответ на задание не найден",
+		"certificate_not_found":        "Сертификат не найден",
+		"category_not_found":           "Раздел не найден",
+		"service_not_found":            "Услуга не найдена",
+		"bundle_not_found":             "Комплект не найден",
+		"cart_item_not_found":          "Позиция корзины не найдена",
+		"gift_not_found":               "Подарок не найден",
+		"attachment_not_found":         "У урока нет файла",
+		"video_not_found":              "У урока нет загруженного видео",
+		"file_not_found":               "Файл не найден",
+		"already_paid":                 "Вы уже оплатили этот курс",
+		"payment_not_initialized":      "Платеж не инициализирован",
+		"course_not_available":         "Курс недоступен для покупки",
+		"course_has_enrollments":       "На курс уже записаны клиенты, его можно только архивировать",
+		"quiz_empty":                   "В тесте пока нет вопросов",
+		"submission_pending":           "Предыдущий ответ ещё не проверен",
+		"assignment_approved":          "Задание уже принято",
+		"slug_taken":                   "Такой slug уже используется",
+		"category_not_empty":           "В разделе есть подразделы или услуги",
+		"bundle_not_available":         "Комплект недоступен для покупки",
+		"cart_conflict":                "Курс уже есть в корзине или в заказе",
+		"cart_full":                    "В корзине не может быть больше 10 позиций",
+		"cart_empty":                   "Корзина пуста",
+		"gift_redeemed":                "Подарок уже активирован",
+		"gift_expired":                 "Срок действия подарка истёк",
+		"gift_recipient_enrolled":      "Получатель уже записан на подаренные курсы",
+		"insufficient_balance":         "Недостаточно средств на балансе",
+		"internal_error":               "Внутренняя ошибка сервера, попробуйте позже",
+		"payment_provider_error":       "Платежная система отклонила запрос",
+		"payment_provider_unavailable": "Платежная система недоступна, попробуйте позже",
+		"payments_not_configured":      "Прием платежей временно недоступен",
+		"certificates_not_configured":  "Выдача PDF-сертификатов не настроена",
+		"mail_not_configured":          "Отправка писем не настроена",
+
+		"field.required":     "Обязательное поле",
+		"field.invalid_type": "Неверный тип значения",
+		"field.email":        "Неверный email",
+		"field.min":          "Слишком короткое значение, минимум {param}",
+		"field.max":          "Слишком длинное значение, максимум {param}",
+		"field.len":          "Длина должна быть {param}",
+		"field.gt":           "Значение должно быть больше {param}",
+		"field.gte":          "Значение должно быть не меньше {param}",
+		"field.lte":          "Значение должно быть не больше {param}",
+		"field.oneof":        "Допустимые значения: {param}",
+		"field.username":     "От 3 до 32 символов: латинские буквы, цифры, _ . -",
+		"field.password":     "Пароль от 8 до 72 символов, с буквами и цифрами",
+		"field.notblank":     "Поле не может быть пустым",
+		"field.weburl":       "Ожидается ссылка http:// или https://",
+		"field.price":        "Цена должна быть больше 0, не больше 1000000 и не точнее копейки",
+		"field.services":     "Не более 10 уникальных услуг, каждая до 50 символов",
+		"field.card_number":  "Номер карты должен состоять из 16 цифр",
+		"field.slug":         "До 64 символов: строчные латинские буквы и цифры через дефис",
+		"field.localized":    "Нужно название на русском, допустимые языки: ru, en, до 100 символов",
+		"field.unknown_id":   "Нет в справочнике: {param}",
+		"field.unique":       "Значения не должны повторяться",
+		"field.own_course":   "Курс не найден среди ваших курсов: {param}",
+		"field.unpublished":  "Курс не опубликован: {param}",
+		"field.bundle_price": "Цена комплекта должна быть ниже суммы цен курсов ({param})",
+		"field.either":       "Укажите либо course_id, либо bundle_id",
+		"field.not_self":     "Нельзя сделать подарок самому себе",
+	},
+	"en": {
+		"invalid_input":                "Invalid request data",
+		"validation_failed":            "Some fields are invalid",
+		"invalid_id":                   "Invalid ID",
+		"invalid_cursor":               "Invalid page cursor",
+		"card_not_set":                 "Card is not set",
+		"amount_not_positive":          "Amount must be greater than 0",
+		"negative_payout_amount":       "Payout amount cannot be negative",
+		"chat_with_self":               "You cannot start a chat with yourself",
+		"file_missing":                 "File upload failed",
+		"file_too_large":               "File exceeds 5MB",
+		"invalid_order":                "The list must contain every item exactly once",
+		"not_a_quiz":                   "This lesson is not a quiz",
+		"not_an_assignment":            "This lesson is not an assignment",
+		"not_a_video":                  "This lesson is not a video lesson",
+		"invalid_image":                "The file is corrupted or is not an image",
+		"image_dimensions":             "The image is too small or too large",
+		"category_cycle":               "A category cannot be nested in itself or its subcategory",
+		"attachment_not_allowed":       "Files cannot be attached to this type of lesson",
+		"unsupported_file_type":        "Unsupported file type",
+		"attachment_too_large":         "File exceeds 20MB",
+		"video_too_large":              "Video exceeds 2GB",
+		"token_missing":                "Token not provided",
+		"token_invalid":                "Invalid token",
+		"invalid_credentials":          "Invalid username or password",
+		"admin_only":                   "Administrators only",
+		"client_only":                  "Clients only",
+		"nutri_only":                   "Nutritionists only",
+		"review_requires_enrollment":   "You can review a course only after paying for it",
+		"course_owner_only":            "Only the course author or an administrator can change this course",
+		"lesson_requires_enrollment":   "This lesson is available only after paying for the course",
+		"lesson_locked":                "This lesson is not released yet",
+		"video_link_invalid":           "The video link is invalid or has expired",
+		"file_link_invalid":            "The file link is invalid or has expired",
+		"user_not_found":               "User not found",
+		"course_not_found":             "Course not found",
+		"payment_not_found":            "Payment not found",
+		"module_not_found":             "Module not found",
+		"lesson_not_found":             "Lesson not found",
+		"submission_not_found":         "Submission not found",
+		"certificate_not_found":        "Certificate not found",
+		"category_not_found":           "Category not found",
+		"service_not_found":            "Service not found",
+		"bundle_not_found":             "Bundle not found",
+		"cart_item_not_found":          "Cart item not found",
+		"gift_not_found":               "Gift not found",
+		"attachment_not_found":         "This lesson has no file",
+		"video_not_found":              "This lesson has no uploaded video",
+		"file_not_found":               "File not found",
+		"already_paid":                 "You have already paid for this course",
+		"payment_not_initialized":      "Payment is not initialized",
+		"course_not_available":         "This course is not available for purchase",
+		"course_has_enrollments":       "Clients are already enrolled in this course, it can only be archived",
+		"quiz_empty":                   "This quiz has no questions yet",
+		"submission_pending":           "Your previous submission has not been reviewed yet",
+		"assignment_approved":          "This assignment has already been approved",
+		"slug_taken":                   "This slug is already in use",
+		"category_not_empty":           "The category has subcategories or services",
+		"bundle_not_available":         "This bundle is not available for purchase",
+		"cart_conflict":                "This course is already in the cart or the order",
+		"cart_full":                    "The cart cannot hold more than 10 items",
+		"cart_empty":                   "The cart is empty",
+		"gift_redeemed":                "This gift has already been redeemed",
+		"gift_expired":                 "This gift has expired",
+		"gift_recipient_enrolled":      "The recipient is already enrolled in the gifted courses",
+		"insufficient_balance":         "Insufficient balance",
+		"internal_error":               "Internal server error, please try again later",
+		"payment_provider_error":       "The payment provider rejected the request",
+		"payment_provider_unavailable": "The payment provider is unavailable, please try again later",
+		"payments_not_configured":      "Payments are temporarily unavailable",
+		"certificates_not_configured":  "PDF certificates are not configured",
+		"mail_not_configured":          "Email sending is not configured",
+
+		"field.required":     "This field is required",
+		"field.invalid_type": "Invalid value type",
+		"field.email":        "Invalid email",
+		"field.min":          "Too short, minimum is {param}",
+		"field.max":          "Too long, maximum is {param}",
+		"field.len":          "Length must be {param}",
+		"field.gt":           "Must be greater than {param}",
+		"field.gte":          "Must be at least {param}",
+		"field.lte":          "Must be at most {param}",
+		"field.oneof":        "Allowed values: {param}",
+		"field.username":     "3 to 32 characters: Latin letters, digits, _ . -",
+		"field.password":     "Password must be 8 to 72 characters with letters and digits",
+		"field.notblank":     "Must not be blank",
+		"field.weburl":       "Must be an http:// or https:// link",
+		"field.price":        "Price must be greater than 0, at most 1000000 and have at most 2 decimal places",
+		"field.services":     "At most 10 unique services, up to 50 characters each",
+		"field.card_number":  "Card number must be 16 digits",
+		"field.slug":         "Up to 64 characters: lowercase Latin letters and digits separated by hyphens",
+		"field.localized":    "A Russian name is required, allowed languages: ru, en, up to 100 characters",
+		"field.unknown_id":   "Not in the directory: {param}",
+		"field.unique":       "Values must not repeat",
+		"field.own_course":   "Not one of your courses: {param}",
+		"field.unpublished":  "Course is not published: {param}",
+		"field.bundle_price": "Bundle price must be below the total price of its courses ({param})",
+		"field.either":       "Specify either course_id or bundle_id",
+		"field.not_self":     "You cannot send a gift to yourself",
+	},
+}
+
+// requestLanguage выбирает первый поддерживаемый язык из Accept-Language.
+func requestLanguage(c *gin.Context) string {
+	tags, _, _ := language.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	for _, tag := range tags {
+		base, _ := tag.Base()
+		if _, ok := messageCatalog[base.String()]; ok {
+			return base.String()
+		}
+	}
+	return "ru"
+}
+
+func localize(lang, key, param string) string {
+	msg, ok := messageCatalog[lang][key]
+	if !ok {
+		msg, ok = messageCatalog["ru"][key]
+	}
+	if !ok {
+		return key
+	}
+	return strings.ReplaceAll(msg, "{param}", param)
+}
+
+func respondError(c *gin.Context, err *APIError) {
+	lang := requestLanguage(c)
+	body := gin.H{
+		"error":      localize(lang, err.Code, ""),
+		"code":       err.Code,
+		"request_id": requestIDFrom(c),
+	}
+	if len(err.Fields) > 0 {
+		fields := make([]FieldError, len(err.Fields))
+		for i, f := range err.Fields {
+			f.Message = localize(lang, "field."+f.Code, f.Param)
+			fields[i] = f
+		}
+		body["fields"] = fields
+	}
+	c.AbortWithStatusJSON(err.Status, body)
+}
+
+// bindError превращает ошибку разбора или валидации тела запроса в ответ
+// с указанием полей.
+func bindError(err error) *APIError {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return errValidation.WithFields(validationFields(validationErrs)...)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return errInvalidInput.WithFields(FieldError{Field: typeErr.Field, Code: "invalid_type"})
+	}
+	return errInvalidInput
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxFacetValues = 20
+
+// Границы корзин фасетов: цена в рублях (gross_price), длительность в неделях.
+var (
+	priceBuckets    = []int{1000, 3000, 5000, 10000}
+	durationBuckets = []int{4, 8, 12}
+	ratingLevels    = []int{4, 3, 2, 1}
+)
+
+type facetCount struct {
+	Value string `json:"value"`
+	Label string `json:"label,omitempty"`
+	Count int    `json:"count"`
+}
+
+type courseFacetSet struct {
+	Services   []facetCount `json:"services"`
+	ServiceIDs []facetCount `json:"service_ids"`
+	Categories []facetCount `json:"categories"`
+	Formats    []facetCount `json:"formats"`
+	Nutris     []facetCount `json:"nutris"`
+	Price      []facetCount `json:"price"`
+	Rating     []facetCount `json:"rating"`
+	Duration   []facetCount `json:"duration"`
+}
+
+// bucketLabels строит подписи корзин вида "0-1000", "1000-3000", "10000+".
+// Для длительности (целые недели) следующая корзина начинается с upper+1.
+func bucketLabels(bounds []int, first, step int) []string {
+	labels := make([]string, 0, len(bounds)+1)
+	lower := first
+	for _, upper := range bounds {
+		labels = append(labels, fmt.Sprintf("%d-%d", lower, upper))
+		lower = upper + step
+	}
+	return append(labels, fmt.Sprintf("%d+", lower))
+}
+
+func bucketCase(col, cmp string, bounds []int, labels []string) string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for i, upper := range bounds {
+		fmt.Fprintf(&b, " WHEN %s %s %d THEN '%s'", col, cmp, upper, labels[i])
+	}
+	fmt.Fprintf(&b, " ELSE '%s' END", labels[len(labels)-1])
+	return b.String()
+}
+
+// orderedBuckets возвращает все корзины по порядку, включая пустые.
+func orderedBuckets(labels []string, counts []facetCount) []facetCount {
+	byValue := make(map[string]int, len(counts))
+	for _, fc := range counts {
+		byValue[fc.Value] = fc.Count
+	}
+	out := make([]facetCount, len(labels))
+	for i, label := range labels {
+		out[i] = facetCount{Value: label, Count: byValue[label]}
+	}
+	return out
+}
+
+func courseFacets(c *gin.Context, f courseFilter) (courseFacetSet, error) {
+	var set courseFacetSet
+	var err error
+	scan := func(dim string, out *[]facetCount, build func(q *gorm.DB) *gorm.DB) {
+		if err != nil {
+			return
+		}
+		err = build(filteredCourses(c, f, dim)).Scan(out).Error
+	}
+
+	scan("services", &set.Services, func(q *gorm.DB) *gorm.DB {
+		return q.Joins("CROSS JOIN LATERAL jsonb_array_elements_text(CASE WHEN jsonb_typeof(cs.services) = 'array' THEN cs.services ELSE '[]'::jsonb END) AS s(value)").
+			Select("s.value AS value, COUNT(*) AS count").Group("s.value").Order("count DESC, value").Limit(maxFacetValues)
+	})
+	lang := requestLanguage(c)
+	scan("service_ids", &set.ServiceIDs, func(q *gorm.DB) *gorm.DB {
+		return q.Joins("CROSS JOIN LATERAL jsonb_array_elements_text(CASE WHEN jsonb_typeof(cs.service_ids) = 'array' THEN cs.service_ids ELSE '[]'::jsonb END) AS s(value)").
+			Joins("JOIN service_tags st ON st.id = s.value::int").
+			Select("s.value AS value, COALESCE(NULLIF(st.names->>?, ''), st.names->>'ru') AS label, COUNT(*) AS count", lang).
+			Group("s.value, st.names").Order("count DESC, label").Limit(maxFacetValues)
+	})
+	// Курсы считаются в своём разделе, без суммирования по родительским
+	scan("category", &set.Categories, func(q *gorm.DB) *gorm.DB {
+		return q.Joins("JOIN categories cat ON cat.id = cs.category_id").
+			Select("cs.category_id::text AS value, COALESCE(NULLIF(cat.names->>?, ''), cat.names->>'ru') AS label, COUNT(*) AS count", lang).
+			Group("cs.category_id, cat.names").Order("count DESC, label").Limit(maxFacetValues)
+	})
+	scan("format", &set.Formats, func(q *gorm.DB) *gorm.DB {
+		return q.Select("cs.format AS value, COUNT(*) AS count").Where("cs.format <> ''").Group("cs.format").Order("count DESC, value")
+	})
+	scan("nutri", &set.Nutris, func(q *gorm.DB) *gorm.DB {
+		return q.Joins("JOIN users u ON u.id = cs.teacher_id").
+			Select("cs.teacher_id::text AS value, u.full_name AS label, COUNT(*) AS count").
+			Group("cs.teacher_id, u.full_name").Order("count DESC, label").Limit(maxFacetValues)
+	})
+
+	priceLabels := bucketLabels(priceBuckets, 0, 0)
+	var price []facetCount
+	scan("price", &price, func(q *gorm.DB) *gorm.DB {
+		expr := bucketCase("cs.price", "<", priceBuckets, priceLabels)
+		return q.Select(expr + " AS value, COUNT(*) AS count").Group("value")
+	})
+	set.Price = orderedBuckets(priceLabels, price)
+
+	durationLabels := bucketLabels(durationBuckets, 1, 1)
+	var duration []facetCount
+	scan("duration", &duration, func(q *gorm.DB) *gorm.DB {
+		expr := bucketCase("cs.duration_weeks", "<=", durationBuckets, durationLabels)
+		return q.Select(expr + " AS value, COUNT(*) AS count").Where("cs.duration_weeks > 0").Group("value")
+	})
+	set.Duration = orderedBuckets(durationLabels, duration)
+
+	// Рейтинг считается накопительно: "4" — курсы с оценкой от 4 и выше
+	var rating []facetCount
+	scan("rating", &rating, func(q *gorm.DB) *gorm.DB {
+		return q.Select("FLOOR(cs.rating)::int::text AS value, COUNT(*) AS count").Where("cs.rating > 0").Group("value")
+	})
+	byFloor := make(map[string]int, len(rating))
+	for _, fc := range rating {
+		byFloor[fc.Value] = fc.Count
+	}
+	total := byFloor["5"]
+	for _, level := range ratingLevels {
+		value := strconv.Itoa(level)
+		total += byFloor[value]
+		set.Rating = append(set.Rating, facetCount{Value: value, Count: total})
+	}
+	return set, err
+}
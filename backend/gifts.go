@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	giftStatusPending  = "pending"
+	giftStatusActive   = "active"
+	giftStatusRedeemed = "redeemed"
+	giftStatusExpired  = "expired"
+
+	giftTTL           = 365 * 24 * time.Hour
+	giftCheckInterval = time.Minute
+	giftMailBatch     = 20
+	// После стольких неудачных попыток письмо больше не отправляется, пока
+	// покупатель не запросит повторную отправку
+	giftMailAttempts = 5
+)
+
+// Gift — курс или комплект, оплаченный в подарок. Код становится действительным
+// после оплаты, отправляется получателю на почту и записывает на курсы того,
+// кто его активирует.
+type Gift struct {
+	ID             int        `json:"id" gorm:"primaryKey"`
+	PayerID        int        `json:"payer_id" gorm:"index"`
+	PaymentID      int        `json:"payment_id" gorm:"uniqueIndex"`
+	Code           string     `json:"code" gorm:"uniqueIndex;not null"`
+	Title          string     `json:"title"`
+	CourseIDs      IntArray   `json:"course_ids" gorm:"type:jsonb"`
+	BundleID       *int       `json:"bundle_id,omitempty"`
+	RecipientEmail string     `json:"recipient_email"`
+	Message        string     `json:"message"`
+	Status         string     `json:"status" gorm:"default:'pending';index"`
+	RecipientID    *int       `json:"recipient_id,omitempty"`
+	EmailedAt      *time.Time `json:"emailed_at"`
+	MailAttempts   int        `json:"mail_attempts" gorm:"default:0"`
+	MailError      string     `json:"mail_error,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	RedeemedAt     *time.Time `json:"redeemed_at"`
+	CreatedAt      time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	Payer          *User      `json:"payer,omitempty" gorm:"foreignKey:PayerID"`
+
+	Courses []Course `json:"courses,omitempty" gorm:"-"`
+}
+
+// activateGift выпускает подарок оплаченного платежа. Возвращает false, если
+// платёж не подарочный.
+func activateGift(tx *gorm.DB, paymentID int) (bool, error) {
+	expires := time.Now().Add(giftTTL)
+	res := tx.Model(&Gift{}).Where("payment_id = ? AND status = ?", paymentID, giftStatusPending).
+		Updates(map[string]any{"status": giftStatusActive, "expires_at": expires})
+	return res.RowsAffected > 0, res.Error
+}
+
+// processGifts переводит просроченные подарки в expired и отправляет письма
+// по новым. Письмо, которое не удалось отправить, уходит при следующем запуске;
+// после giftMailAttempts неудач попытки прекращаются, чтобы один неверный адрес
+// не задерживал остальную очередь.
+func processGifts(ctx context.Context) error {
+	var expired []Gift
+	if err := db.WithContext(ctx).Where("status = ? AND expires_at < ?", giftStatusActive, time.Now()).Find(&expired).Error; err != nil {
+		return err
+	}
+	for _, gift := range expired {
+		res := db.WithContext(ctx).Model(&Gift{}).Where("id = ? AND status = ?", gift.ID, giftStatusActive).Update("status", giftStatusExpired)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			slog.InfoContext(ctx, "processGifts: Срок подарка истёк", "gift_id", gift.ID)
+			notifyUser(ctx, db.WithContext(ctx), gift.PayerID, "gift", "Срок действия подарка «"+gift.Title+"» для "+gift.RecipientEmail+" истёк")
+		}
+	}
+	if !cfg.mailConfigured() {
+		return nil
+	}
+	var pending []Gift
+	err := db.WithContext(ctx).Preload("Payer", publicUserFields).Where("status = ? AND emailed_at IS NULL AND mail_attempts < ?", giftStatusActive, giftMailAttempts).
+		Order("id").Limit(giftMailBatch).Find(&pending).Error
+	if err != nil {
+		return err
+	}
+	for _, gift := range pending {
+		if err := sendMail(ctx, gift.RecipientEmail, "Вам подарили курс", giftMailBody(gift)); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.WarnContext(ctx, "processGifts: Ошибка отправки письма", "gift_id", gift.ID, "attempt", gift.MailAttempts+1, "error", err)
+			msg := []rune(err.Error())
+			if len(msg) > 500 {
+				msg = msg[:500]
+			}
+			updates := map[string]any{"mail_attempts": gorm.Expr("mail_attempts + 1"), "mail_error": string(msg)}
+			if err := db.WithContext(ctx).Model(&gift).Updates(updates).Error; err != nil {
+				return err
+			}
+			if gift.MailAttempts+1 >= giftMailAttempts {
+				notifyUser(ctx, db.WithContext(ctx), gift.PayerID, "gift", "Не удалось отправить подарок «"+gift.Title+"» на "+gift.RecipientEmail+": проверьте адрес и отправьте письмо повторно")
+			}
+			continue
+		}
+		if err := db.WithContext(ctx).Model(&gift).Updates(map[string]any{"emailed_at": time.Now(), "mail_error": ""}).Error; err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "processGifts: Письмо с подарком отправлено", "gift_id", gift.ID)
+	}
+	return nil
+}
+
+func giftMailBody(gift Gift) string {
+	from := "Пользователь платформы"
+	if gift.Payer != nil {
+		from = gift.Payer.FullName
+		if from == "" {
+			from = gift.Payer.Username
+		}
+	}
+	var b strings.Builder
+	b.WriteString("Здравствуйте!\n\n")
+	b.WriteString(from + " дарит вам «" + gift.Title + "».\n")
+	if gift.Message != "" {
+		b.WriteString("\n" + gift.Message + "\n")
+	}
+	b.WriteString("\nКод подарка: " + gift.Code + "\n")
+	b.WriteString("Активируйте его до " + gift.ExpiresAt.Format("02.01.2006") + ": " + cfg.FrontendURL + "/gifts/" + gift.Code + "\n")
+	b.WriteString("Для активации войдите в аккаунт клиента или зарегистрируйтесь.\n")
+	return b.String()
+}
+
+func createGift(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "payment.gift")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	if !clientOnly(c, "createGift") {
+		return
+	}
+	var input struct {
+		checkoutTarget
+		RecipientEmail string `json:"recipient_email" binding:"required,email,max=254"`
+		Message        string `json:"message" binding:"max=1000"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createGift: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if !input.check(c, "createGift") {
+		return
+	}
+	userID := c.GetInt("userID")
+	var recipient User
+	err := reqDB(c).Select("id").Where("LOWER(email) = LOWER(?)", input.RecipientEmail).Limit(1).Find(&recipient).Error
+	if err != nil {
+		slog.ErrorContext(c, "createGift: Ошибка поиска получателя", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if recipient.ID == userID {
+		slog.WarnContext(c, "createGift: Подарок самому себе", "user_id", userID)
+		respondError(c, errValidation.WithFields(FieldError{Field: "recipient_email", Code: "not_self"}))
+		return
+	}
+	courseIDs, bundleIDs := input.ids()
+	items, description, ok := resolveCheckout(c, "createGift", 0, courseIDs, bundleIDs)
+	if !ok {
+		return
+	}
+	gift := Gift{PayerID: userID, RecipientEmail: input.RecipientEmail, Message: input.Message, Status: giftStatusPending}
+	for _, item := range items {
+		gift.CourseIDs = append(gift.CourseIDs, item.CourseID)
+	}
+	if input.BundleID > 0 {
+		gift.BundleID = &input.BundleID
+		if err := reqDB(c).Model(&Bundle{}).Where("id = ?", input.BundleID).Pluck("title", &gift.Title).Error; err != nil {
+			slog.ErrorContext(c, "createGift: Ошибка получения комплекта", "error", err)
+			respondError(c, errInternal)
+			return
+		}
+	} else {
+		gift.Title = items[0].Title
+	}
+	// Получатель с аккаунтом не должен уже проходить подаренные курсы
+	if recipient.ID > 0 {
+		var enrolled int64
+		if err := reqDB(c).Model(&Enrollment{}).Where("user_id = ? AND course_id IN ?", recipient.ID, []int(gift.CourseIDs)).Count(&enrolled).Error; err != nil {
+			slog.ErrorContext(c, "createGift: Ошибка проверки записей", "error", err)
+			respondError(c, errInternal)
+			return
+		}
+		if enrolled > 0 {
+			slog.WarnContext(c, "createGift: Получатель уже записан на курс", "recipient_id", recipient.ID)
+			respondError(c, errGiftRecipientEnrolled)
+			return
+		}
+	}
+	// Код тех же формата и алфавита, что у сертификатов
+	if gift.Code, err = newCertificateCode(); err != nil {
+		slog.ErrorContext(c, "createGift: Ошибка генерации кода", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	startCheckout(c, span, "createGift", items, "Подарок: "+description, &gift)
+}
+
+// getGifts отдаёт оплаченные подарки покупателя. Код виден покупателю, чтобы
+// его можно было передать получателю и без письма.
+func getGifts(c *gin.Context) {
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getGifts: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	gifts, err := fetchPage(c, reqDB(c).Where("payer_id = ? AND status <> ?", c.GetInt("userID"), giftStatusPending), page, newestFirst,
+		func(g Gift) pageKey { return timeKey(g.CreatedAt, g.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getGifts: Ошибка получения подарков", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gifts)
+}
+
+// getAdminGifts — все оплаченные подарки, по умолчанию ещё не активированные.
+func getAdminGifts(c *gin.Context) {
+	if !adminOnly(c, "getAdminGifts") {
+		return
+	}
+	var input struct {
+		Status string `form:"status" binding:"omitempty,oneof=active redeemed expired"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		slog.WarnContext(c, "getAdminGifts: Неверные параметры", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if input.Status == "" {
+		input.Status = giftStatusActive
+	}
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getAdminGifts: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	gifts, err := fetchPage(c, reqDB(c).Preload("Payer", publicUserFields).Where("status = ?", input.Status), page, newestFirst,
+		func(g Gift) pageKey { return timeKey(g.CreatedAt, g.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getAdminGifts: Ошибка получения подарков", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gifts)
+}
+
+// getGift показывает подарок по коду до активации: что подарено, от кого и до
+// какого числа действует код.
+func getGift(c *gin.Context) {
+	var gift Gift
+	code := normalizeCertificateCode(c.Param("code"))
+	err := reqDB(c).Preload("Payer", publicUserFields).Where("code = ? AND status <> ?", code, giftStatusPending).First(&gift).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(c, "getGift: Подарок не найден", "code", code)
+			respondError(c, errGiftNotFound)
+		} else {
+			slog.ErrorContext(c, "getGift: Ошибка получения подарка", "error", err)
+			respondError(c, errInternal)
+		}
+		return
+	}
+	if err := reqDB(c).Unscoped().Where("id IN ?", []int(gift.CourseIDs)).Find(&gift.Courses).Error; err != nil {
+		slog.ErrorContext(c, "getGift: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gift)
+}
+
+// resendGift отправляет письмо с подарком ещё раз, при необходимости на
+// исправленный адрес.
+func resendGift(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, "resendGift: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return
+	}
+	var input struct {
+		RecipientEmail string `json:"recipient_email" binding:"omitempty,email,max=254"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "resendGift: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	var gift Gift
+	if err := reqDB(c).Where("id = ? AND payer_id = ? AND status <> ?", id, c.GetInt("userID"), giftStatusPending).First(&gift).Error; err != nil {
+		slog.WarnContext(c, "resendGift: Подарок не найден", "gift_id", id)
+		respondError(c, errGiftNotFound)
+		return
+	}
+	if gift.Status != giftStatusActive {
+		slog.WarnContext(c, "resendGift: Подарок уже недействителен", "gift_id", id, "status", gift.Status)
+		respondError(c, giftStatusError(gift.Status))
+		return
+	}
+	if !cfg.mailConfigured() {
+		slog.ErrorContext(c, "resendGift: SMTP не настроен")
+		respondError(c, errMailNotConfigured)
+		return
+	}
+	updates := map[string]any{"emailed_at": nil, "mail_attempts": 0, "mail_error": ""}
+	if input.RecipientEmail != "" {
+		updates["recipient_email"] = input.RecipientEmail
+	}
+	if err := reqDB(c).Model(&gift).Updates(updates).Error; err != nil {
+		slog.ErrorContext(c, "resendGift: Ошибка обновления подарка", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "resendGift: Письмо поставлено в очередь", "gift_id", gift.ID)
+	c.JSON(http.StatusOK, gift)
+}
+
+func giftStatusError(status string) *APIError {
+	switch status {
+	case giftStatusRedeemed:
+		return errGiftRedeemed
+	case giftStatusExpired:
+		return errGiftExpired
+	}
+	return errGiftNotFound
+}
+
+// redeemGift активирует код: клиент записывается на подаренные курсы, а
+// покупатель получает уведомление. Код действует один раз.
+func redeemGift(c *gin.Context) {
+	if !clientOnly(c, "redeemGift") {
+		return
+	}
+	var input struct {
+		Code string `json:"code" binding:"required,max=20"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "redeemGift: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	userID := c.GetInt("userID")
+	code := normalizeCertificateCode(input.Code)
+	var gift Gift
+	var apiErr *APIError
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&gift).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			apiErr = errGiftNotFound
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if gift.Status == giftStatusActive && gift.ExpiresAt.Before(time.Now()) {
+			gift.Status = giftStatusExpired
+		}
+		if gift.Status != giftStatusActive {
+			apiErr = giftStatusError(gift.Status)
+			return nil
+		}
+		created, err := enrollUser(tx, userID, gift.CourseIDs)
+		if err != nil {
+			return err
+		}
+		if created == 0 {
+			apiErr = errGiftRecipientEnrolled
+			return nil
+		}
+		now := time.Now()
+		gift.Status, gift.RecipientID, gift.RedeemedAt = giftStatusRedeemed, &userID, &now
+		if err := tx.Model(&gift).Select("status", "recipient_id", "redeemed_at").Updates(&gift).Error; err != nil {
+			return err
+		}
+		notifyUser(c, tx, gift.PayerID, "gift", "Подарок «"+gift.Title+"» для "+gift.RecipientEmail+" активирован")
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(c, "redeemGift: Ошибка активации подарка", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if apiErr != nil {
+		slog.WarnContext(c, "redeemGift: Код не активирован", "code", code, "reason", apiErr.Code)
+		respondError(c, apiErr)
+		return
+	}
+	slog.InfoContext(c, "redeemGift: Подарок активирован", "gift_id", gift.ID, "user_id", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Подарок активирован", "course_ids": gift.CourseIDs})
+}
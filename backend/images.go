@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	coverFilesDir  = "covers"
+	maxImageUpload = 5 * 1024 * 1024
+	// Ограничение защищает от файлов, которые занимают мегабайты на диске,
+	// но разворачиваются в гигабайты пикселей.
+	maxImagePixels = 40_000_000
+	imageQuality   = 85
+)
+
+var imageUploadTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+type imageSize struct {
+	width, height int
+}
+
+// imageKind описывает, где хранятся изображения и какие размеры для них
+// готовятся. Файлы лежат в хранилище как <dir>/<uuid>/<ширина>.jpg и .webp
+// и раздаются по тем же путям от корня сервера.
+type imageKind struct {
+	dir   string
+	sizes []imageSize
+	// main — размер, ссылка на который сохраняется в основном поле модели.
+	main int
+}
+
+var (
+	avatarImage = imageKind{dir: avatarFilesDir, sizes: []imageSize{{64, 64}, {128, 128}, {256, 256}}, main: 2}
+	coverImage  = imageKind{dir: coverFilesDir, sizes: []imageSize{{480, 270}, {960, 540}, {1920, 1080}}, main: 1}
+)
+
+type ImageVariant struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	URL     string `json:"url"`
+	WebPURL string `json:"webp_url,omitempty"`
+}
+
+type ImageVariants []ImageVariant
+
+func (iv *ImageVariants) Scan(value interface{}) error {
+	if value == nil {
+		*iv = ImageVariants{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to scan ImageVariants: expected []byte, got %T", value)
+	}
+	return json.Unmarshal(bytes, iv)
+}
+
+func (iv ImageVariants) Value() (driver.Value, error) {
+	if len(iv) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(iv)
+}
+
+var errImagePixels = errors.New("недопустимый размер изображения")
+
+// saveImage проверяет загруженный файл и сохраняет его в хранилище в
+// нескольких размерах. Изображение перекодируется заново, поэтому EXIF и
+// прочие метаданные в сохранённые файлы не попадают. Возвращает ссылку на
+// основной размер и список всех размеров.
+func saveImage(c *gin.Context, fn string, file *multipart.FileHeader, kind imageKind) (string, ImageVariants, bool) {
+	if file.Size > maxImageUpload {
+		slog.WarnContext(c, fn+": Файл слишком большой", "size", file.Size)
+		respondError(c, errFileTooLarge)
+		return "", nil, false
+	}
+	src, _, ok := openSniffedFile(c, fn, file, imageUploadTypes)
+	if !ok {
+		return "", nil, false
+	}
+	defer src.Close()
+	img, err := decodeImage(src, kind)
+	if err != nil {
+		slog.WarnContext(c, fn+": Некорректное изображение", "error", err)
+		if errors.Is(err, errImagePixels) {
+			respondError(c, errImageDimensions)
+		} else {
+			respondError(c, errInvalidImage)
+		}
+		return "", nil, false
+	}
+	prefix := kind.dir + "/" + uuid.New().String()
+	variants, err := storeImageVariants(c, prefix, img, kind)
+	if err != nil {
+		if err := storage.DeletePrefix(c, prefix); err != nil {
+			slog.WarnContext(c, fn+": Ошибка удаления файлов", "prefix", prefix, "error", err)
+		}
+		slog.ErrorContext(c, fn+": Ошибка сохранения изображения", "error", err)
+		respondError(c, errInternal)
+		return "", nil, false
+	}
+	return variants[kind.main].URL, variants, true
+}
+
+func decodeImage(src io.ReadSeeker, kind imageKind) (image.Image, error) {
+	conf, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	smallest := kind.sizes[0]
+	if conf.Width*conf.Height > maxImagePixels || conf.Width < smallest.width || conf.Height < smallest.height {
+		return nil, fmt.Errorf("%w: %dx%d", errImagePixels, conf.Width, conf.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// Поворот из EXIF применяется к пикселям, иначе после удаления
+	// метаданных фото с телефона окажется лёжа на боку
+	img, err := imaging.Decode(src, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// storeImageVariants кадрирует изображение под каждый размер и сохраняет
+// JPEG и WebP. Размеры больше исходника не создаются, чтобы не растягивать
+// картинку; вместо них в списке остаётся наибольший доступный.
+func storeImageVariants(ctx context.Context, prefix string, img image.Image, kind imageKind) (ImageVariants, error) {
+	bounds := img.Bounds()
+	variants := make(ImageVariants, 0, len(kind.sizes))
+	webp := true
+	for _, size := range kind.sizes {
+		if len(variants) > 0 && (size.width > bounds.Dx() || size.height > bounds.Dy()) {
+			variants = append(variants, variants[len(variants)-1])
+			continue
+		}
+		// Прозрачные области заливаются белым: в JPEG альфа-канала нет
+		resized := imaging.Fill(img, size.width, size.height, imaging.Center, imaging.Lanczos)
+		flat := imaging.Overlay(imaging.New(size.width, size.height, color.White), resized, image.Point{}, 1)
+
+		key := fmt.Sprintf("%s/%d", prefix, size.width)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: imageQuality}); err != nil {
+			return nil, err
+		}
+		if err := storage.Put(ctx, key+".jpg", bytes.NewReader(buf.Bytes())); err != nil {
+			return nil, err
+		}
+		variant := ImageVariant{Width: size.width, Height: size.height, URL: "/" + key + ".jpg"}
+		if webp {
+			data, err := encodeWebP(ctx, flat)
+			if err != nil {
+				// Без WebP клиенты получают только JPEG
+				slog.WarnContext(ctx, "storeImageVariants: Ошибка кодирования WebP", "error", err)
+				webp = false
+			} else if err := storage.Put(ctx, key+".webp", bytes.NewReader(data)); err != nil {
+				return nil, err
+			} else {
+				variant.WebPURL = "/" + key + ".webp"
+			}
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// encodeWebP кодирует изображение через ffmpeg с libwebp: в стандартной
+// библиотеке Go кодировщика WebP нет.
+func encodeWebP(ctx context.Context, img *image.NRGBA) ([]byte, error) {
+	size := img.Bounds().Size()
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgba", "-s", fmt.Sprintf("%dx%d", size.X, size.Y), "-i", "pipe:0",
+		"-frames:v", "1", "-c:v", "libwebp", "-quality", "80", "-f", "webp", "pipe:1")
+	cmd.Stdin = bytes.NewReader(img.Pix)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// removeImage удаляет файлы изображения, на которое ссылается url. Ссылки на
+// внешние ресурсы не трогает, старые аватары без размеров удаляет одним
+// файлом.
+func removeImage(ctx context.Context, kind imageKind, url string) {
+	rel, ok := strings.CutPrefix(url, "/"+kind.dir+"/")
+	if !ok || rel == "" {
+		return
+	}
+	var err error
+	if id, _, nested := strings.Cut(rel, "/"); nested {
+		err = storage.DeletePrefix(ctx, kind.dir+"/"+id)
+	} else {
+		err = storage.Delete(ctx, kind.dir+"/"+rel)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "removeImage: Ошибка удаления изображения", "url", url, "error", err)
+	}
+}
+
+// serveCover отдаёт обложки курсов, как serveAvatar — аватары.
+func serveCover(c *gin.Context) {
+	serveStoredFile(c, "serveCover", coverFilesDir+c.Param("file"), "", "public, max-age=86400")
+}
+
+func uploadCourseCover(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "uploadCourseCover")
+	if !ok {
+		return
+	}
+	file, err := c.FormFile("cover")
+	if err != nil {
+		slog.WarnContext(c, "uploadCourseCover: Ошибка получения файла", "error", err)
+		respondError(c, errFileMissing)
+		return
+	}
+	url, variants, ok := saveImage(c, "uploadCourseCover", file, coverImage)
+	if !ok {
+		return
+	}
+	if err := setCourseCover(c, course.ID, url, variants); err != nil {
+		removeImage(c, coverImage, url)
+		slog.ErrorContext(c, "uploadCourseCover: Ошибка сохранения обложки", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	removeImage(c, coverImage, course.CoverURL)
+	if err := reqDB(c).Preload("Teacher", publicUserFields).First(&course, course.ID).Error; err != nil {
+		slog.ErrorContext(c, "uploadCourseCover: Ошибка получения курса", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	course.revealVideo()
+	slog.InfoContext(c, "uploadCourseCover: Обложка загружена", "course_id", course.ID)
+	c.JSON(http.StatusOK, course)
+}
+
+func deleteCourseCover(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "deleteCourseCover")
+	if !ok {
+		return
+	}
+	if err := setCourseCover(c, course.ID, "", nil); err != nil {
+		slog.ErrorContext(c, "deleteCourseCover: Ошибка удаления обложки", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	removeImage(c, coverImage, course.CoverURL)
+	slog.InfoContext(c, "deleteCourseCover: Обложка удалена", "course_id", course.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Обложка удалена"})
+}
+
+func setCourseCover(c *gin.Context, courseID int, url string, variants ImageVariants) error {
+	return reqDB(c).Model(&Course{}).Where("id = ?", courseID).
+		Updates(map[string]interface{}{"cover_url": url, "cover_variants": variants}).Error
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	lessonKindVideo      = "video"
+	lessonKindText       = "text"
+	lessonKindPDF        = "pdf"
+	lessonKindMealPlan   = "meal_plan"
+	lessonKindQuiz       = "quiz"
+	lessonKindAssignment = "assignment"
+
+	lessonFilesDir      = "lessons"
+	maxLessonAttachment = 20 * 1024 * 1024
+)
+
+// Допустимые типы вложений по результату http.DetectContentType.
+var lessonAttachmentTypes = map[string][]string{
+	lessonKindPDF:      {"application/pdf"},
+	lessonKindMealPlan: {"application/pdf", "image/jpeg", "image/png"},
+}
+
+// CourseModule — раздел курса, уроки внутри упорядочены по Position.
+type CourseModule struct {
+	ID        int       `json:"id" gorm:"primaryKey"`
+	CourseID  int       `json:"course_id" gorm:"index;not null"`
+	Title     string    `json:"title"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	Lessons   []Lesson  `json:"lessons" gorm:"foreignKey:ModuleID"`
+}
+
+// Lesson — урок модуля. Body, VideoURL и вложение отдаются только
+// записанным клиентам после открытия урока, автору и администратору.
+// Видеоурок использует внешний VideoURL или загруженное видео (Video).
+type Lesson struct {
+	ID               int       `json:"id" gorm:"primaryKey"`
+	ModuleID         int       `json:"module_id" gorm:"index;not null"`
+	CourseID         int       `json:"course_id" gorm:"index;not null"`
+	Title            string    `json:"title"`
+	Kind             string    `json:"kind"`
+	Position         int       `json:"position"`
+	ReleaseAfterDays int       `json:"release_after_days" gorm:"default:0"` // дней от даты записи на курс
+	Body             string    `json:"body,omitempty"`
+	VideoURL         string    `json:"video_url,omitempty"`
+	AttachmentName   string    `json:"attachment_name,omitempty"`
+	AttachmentPath   string    `json:"-"`
+	PassScore        int       `json:"pass_score,omitempty"` // для тестов, % верных ответов; 0 — defaultPassScore
+	CreatedAt        time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt        time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+
+	AvailableAt *time.Time `json:"available_at,omitempty" gorm:"-"`
+	Locked      bool       `json:"locked" gorm:"-"`
+}
+
+// outline убирает содержимое урока для оглавления.
+func (l Lesson) outline() Lesson {
+	l.Body, l.VideoURL, l.AttachmentPath = "", "", ""
+	return l
+}
+
+// lessonAccess описывает доступ пользователя к урокам курса.
+type lessonAccess struct {
+	manage     bool
+	enrolledAt *time.Time
+}
+
+func (a lessonAccess) availableAt(l Lesson) *time.Time {
+	if a.enrolledAt == nil {
+		return nil
+	}
+	at := a.enrolledAt.AddDate(0, 0, l.ReleaseAfterDays)
+	return &at
+}
+
+func (a lessonAccess) released(l Lesson) bool {
+	if a.manage {
+		return true
+	}
+	at := a.availableAt(l)
+	return at != nil && !time.Now().Before(*at)
+}
+
+func courseLessonAccess(tx *gorm.DB, course Course, userID int, role string) (lessonAccess, error) {
+	if userID == 0 {
+		return lessonAccess{}, nil
+	}
+	if canManageCourse(course, userID, role) {
+		return lessonAccess{manage: true}, nil
+	}
+	// Повторная оплата не сдвигает расписание, считаем от первой записи
+	var enrollment Enrollment
+	err := tx.Where("user_id = ? AND course_id = ?", userID, course.ID).Order("created_at").First(&enrollment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return lessonAccess{}, nil
+	}
+	if err != nil {
+		return lessonAccess{}, err
+	}
+	return lessonAccess{enrolledAt: &enrollment.CreatedAt}, nil
+}
+
+func sortModules(modules []CourseModule) {
+	slices.SortFunc(modules, func(a, b CourseModule) int {
+		return cmp.Or(cmp.Compare(a.Position, b.Position), cmp.Compare(a.ID, b.ID))
+	})
+	for i := range modules {
+		slices.SortFunc(modules[i].Lessons, func(a, b Lesson) int {
+			return cmp.Or(cmp.Compare(a.Position, b.Position), cmp.Compare(a.ID, b.ID))
+		})
+	}
+}
+
+// getCourseModules возвращает оглавление курса без содержимого уроков.
+// Записанным клиентам дополнительно сообщается дата открытия каждого урока.
+func getCourseModules(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, "getCourseModules: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return
+	}
+	userID, role := c.GetInt("userID"), c.GetString("role")
+	var course Course
+	if err := reqDB(c).Unscoped().First(&course, id).Error; err != nil {
+		slog.WarnContext(c, "getCourseModules: Курс не найден", "error", err)
+		respondError(c, errCourseNotFound)
+		return
+	}
+	visible, err := canViewCourse(reqDB(c), course, userID, role)
+	if err != nil {
+		slog.ErrorContext(c, "getCourseModules: Ошибка проверки доступа", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if !visible {
+		respondError(c, errCourseNotFound)
+		return
+	}
+	access, err := courseLessonAccess(reqDB(c), course, userID, role)
+	if err != nil {
+		slog.ErrorContext(c, "getCourseModules: Ошибка проверки записи", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	var modules []CourseModule
+	if err := reqDB(c).Preload("Lessons").Where("course_id = ?", course.ID).Find(&modules).Error; err != nil {
+		slog.ErrorContext(c, "getCourseModules: Ошибка получения модулей", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	sortModules(modules)
+	for i := range modules {
+		for j, lesson := range modules[i].Lessons {
+			lesson = lesson.outline()
+			lesson.AvailableAt = access.availableAt(lesson)
+			lesson.Locked = !access.released(lesson)
+			modules[i].Lessons[j] = lesson
+		}
+	}
+	c.JSON(http.StatusOK, modules)
+}
+
+// loadLesson загружает урок из :id и проверяет доступ к его содержимому.
+func loadLesson(c *gin.Context, fn string) (Lesson, lessonAccess, bool) {
+	var lesson Lesson
+	var access lessonAccess
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return lesson, access, false
+	}
+	if err := reqDB(c).First(&lesson, id).Error; err != nil {
+		slog.WarnContext(c, fn+": Урок не найден", "lesson_id", id, "error", err)
+		respondError(c, errLessonNotFound)
+		return lesson, access, false
+	}
+	// Оплатившие клиенты сохраняют доступ и к удалённому курсу
+	var course Course
+	if err := reqDB(c).Unscoped().First(&course, lesson.CourseID).Error; err != nil {
+		slog.ErrorContext(c, fn+": Курс урока не найден", "lesson_id", id, "error", err)
+		respondError(c, errInternal)
+		return lesson, access, false
+	}
+	access, err = courseLessonAccess(reqDB(c), course, c.GetInt("userID"), c.GetString("role"))
+	if err != nil {
+		slog.ErrorContext(c, fn+": Ошибка проверки записи", "error", err)
+		respondError(c, errInternal)
+		return lesson, access, false
+	}
+	if !access.manage && access.enrolledAt == nil {
+		slog.WarnContext(c, fn+": Нет записи на курс", "lesson_id", id)
+		respondError(c, errLessonRequiresEnrollment)
+		return lesson, access, false
+	}
+	lesson.AvailableAt = access.availableAt(lesson)
+	if !access.released(lesson) {
+		slog.WarnContext(c, fn+": Урок ещё не открыт", "lesson_id", id, "available_at", lesson.AvailableAt)
+		respondError(c, errLessonLocked)
+		return lesson, access, false
+	}
+	return lesson, access, true
+}
+
+func getLesson(c *gin.Context) {
+	lesson, _, ok := loadLesson(c, "getLesson")
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, lesson)
+}
+
+func downloadLessonAttachment(c *gin.Context) {
+	lesson, _, ok := loadLesson(c, "downloadLessonAttachment")
+	if !ok {
+		return
+	}
+	if lesson.AttachmentPath == "" {
+		respondError(c, errAttachmentNotFound)
+		return
+	}
+	redirectToStoredFile(c, "downloadLessonAttachment", lessonFilesDir+"/"+lesson.AttachmentPath, lesson.AttachmentName)
+}
+
+func loadManagedModule(c *gin.Context, fn string) (CourseModule, bool) {
+	var module CourseModule
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return module, false
+	}
+	if err := reqDB(c).First(&module, id).Error; err != nil {
+		slog.WarnContext(c, fn+": Модуль не найден", "module_id", id, "error", err)
+		respondError(c, errModuleNotFound)
+		return module, false
+	}
+	_, ok := checkCourseManager(c, fn, module.CourseID)
+	return module, ok
+}
+
+func loadManagedLesson(c *gin.Context, fn string) (Lesson, bool) {
+	var lesson Lesson
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return lesson, false
+	}
+	if err := reqDB(c).First(&lesson, id).Error; err != nil {
+		slog.WarnContext(c, fn+": Урок не найден", "lesson_id", id, "error", err)
+		respondError(c, errLessonNotFound)
+		return lesson, false
+	}
+	_, ok := checkCourseManager(c, fn, lesson.CourseID)
+	return lesson, ok
+}
+
+// nextPosition возвращает позицию для нового элемента в конце списка.
+func nextPosition(tx *gorm.DB, model any, col string, id int) (int, error) {
+	var pos int
+	err := tx.Model(model).Where(col+" = ?", id).Select("COALESCE(MAX(position), -1) + 1").Scan(&pos).Error
+	return pos, err
+}
+
+func createModule(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "createModule")
+	if !ok {
+		return
+	}
+	var input struct {
+		Title string `json:"title" binding:"required,notblank,max=200"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createModule: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	pos, err := nextPosition(reqDB(c), &CourseModule{}, "course_id", course.ID)
+	if err != nil {
+		slog.ErrorContext(c, "createModule: Ошибка расчёта позиции", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	module := CourseModule{CourseID: course.ID, Title: input.Title, Position: pos, Lessons: []Lesson{}}
+	if err := reqDB(c).Create(&module).Error; err != nil {
+		slog.ErrorContext(c, "createModule: Ошибка создания модуля", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "createModule: Модуль создан", "course_id", course.ID, "module_id", module.ID)
+	c.JSON(http.StatusOK, module)
+}
+
+func updateModule(c *gin.Context) {
+	module, ok := loadManagedModule(c, "updateModule")
+	if !ok {
+		return
+	}
+	var input struct {
+		Title string `json:"title" binding:"required,notblank,max=200"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateModule: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if err := reqDB(c).Model(&module).Update("title", input.Title).Error; err != nil {
+		slog.ErrorContext(c, "updateModule: Ошибка обновления модуля", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, module)
+}
+
+// deleteModule удаляет модуль вместе с уроками и их файлами.
+func deleteModule(c *gin.Context) {
+	module, ok := loadManagedModule(c, "deleteModule")
+	if !ok {
+		return
+	}
+	var lessons []Lesson
+	var videos []Video
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("module_id = ?", module.ID).Find(&lessons).Error; err != nil {
+			return err
+		}
+		var err error
+		if videos, err = deleteLessonData(tx, tx.Model(&Lesson{}).Select("id").Where("module_id = ?", module.ID)); err != nil {
+			return err
+		}
+		if err := tx.Where("module_id = ?", module.ID).Delete(&Lesson{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&module).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, "deleteModule: Ошибка удаления модуля", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	for _, lesson := range lessons {
+		removeStoredFile(c, lessonFilesDir, lesson.AttachmentPath)
+	}
+	removeVideoFiles(c, videos)
+	slog.InfoContext(c, "deleteModule: Модуль удалён", "module_id", module.ID, "lessons", len(lessons))
+	c.JSON(http.StatusOK, gin.H{"message": "Модуль удалён"})
+}
+
+// deleteLessonData удаляет прогресс, тесты, ответы клиентов и видео по
+// урокам. lessonIDs — список ID или подзапрос. Возвращает видео, файлы
+// которых нужно удалить после коммита.
+func deleteLessonData(tx *gorm.DB, lessonIDs any) ([]Video, error) {
+	var videos []Video
+	if err := tx.Select("id", "source_key").Where("lesson_id IN (?)", lessonIDs).Find(&videos).Error; err != nil {
+		return nil, err
+	}
+	for _, model := range []any{&LessonProgress{}, &QuizQuestion{}, &QuizAttempt{}, &AssignmentSubmission{}, &Video{}} {
+		if err := tx.Where("lesson_id IN (?)", lessonIDs).Delete(model).Error; err != nil {
+			return nil, err
+		}
+	}
+	return videos, nil
+}
+
+// reorder проставляет позиции по переданному порядку ID. Список должен
+// содержать ровно все элементы родителя.
+func reorder(c *gin.Context, model any, col string, parentID int, ids []int) error {
+	return reqDB(c).Transaction(func(tx *gorm.DB) error {
+		var existing []int
+		if err := tx.Model(model).Where(col+" = ?", parentID).Pluck("id", &existing).Error; err != nil {
+			return err
+		}
+		sorted := slices.Clone(ids)
+		slices.Sort(sorted)
+		slices.Sort(existing)
+		if !slices.Equal(slices.Compact(sorted), existing) || len(ids) != len(existing) {
+			return errInvalidOrder
+		}
+		for pos, id := range ids {
+			if err := tx.Model(model).Where("id = ?", id).Update("position", pos).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type orderInput struct {
+	IDs []int `json:"ids" binding:"required"`
+}
+
+func reorderModules(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "reorderModules")
+	if !ok {
+		return
+	}
+	var input orderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "reorderModules: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if err := reorder(c, &CourseModule{}, "course_id", course.ID, input.IDs); err != nil {
+		respondReorderError(c, "reorderModules", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Порядок модулей сохранён"})
+}
+
+func reorderLessons(c *gin.Context) {
+	module, ok := loadManagedModule(c, "reorderLessons")
+	if !ok {
+		return
+	}
+	var input orderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "reorderLessons: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if err := reorder(c, &Lesson{}, "module_id", module.ID, input.IDs); err != nil {
+		respondReorderError(c, "reorderLessons", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Порядок уроков сохранён"})
+}
+
+func respondReorderError(c *gin.Context, fn string, err error) {
+	if errors.Is(err, errInvalidOrder) {
+		slog.WarnContext(c, fn+": Список ID не совпадает с элементами")
+		respondError(c, errInvalidOrder)
+		return
+	}
+	slog.ErrorContext(c, fn+": Ошибка сохранения порядка", "error", err)
+	respondError(c, errInternal)
+}
+
+type lessonInput struct {
+	Title            *string `json:"title" binding:"omitempty,notblank,max=200"`
+	Kind             *string `json:"kind" binding:"omitempty,oneof=video text pdf meal_plan quiz assignment"`
+	ReleaseAfterDays *int    `json:"release_after_days" binding:"omitempty,min=0,max=365"`
+	Body             *string `json:"body" binding:"omitempty,max=50000"`
+	VideoURL         *string `json:"video_url" binding:"omitempty,weburl"`
+}
+
+func (in lessonInput) apply(l *Lesson) {
+	if in.Title != nil {
+		l.Title = *in.Title
+	}
+	if in.Kind != nil {
+		l.Kind = *in.Kind
+	}
+	if in.ReleaseAfterDays != nil {
+		l.ReleaseAfterDays = *in.ReleaseAfterDays
+	}
+	if in.Body != nil {
+		l.Body = *in.Body
+	}
+	if in.VideoURL != nil {
+		l.VideoURL = *in.VideoURL
+	}
+}
+
+// lessonFieldErrors проверяет поля, обязательные для типа урока.
+func lessonFieldErrors(l Lesson) []FieldError {
+	var fields []FieldError
+	if l.Title == "" {
+		fields = append(fields, FieldError{Field: "title", Code: "required"})
+	}
+	switch l.Kind {
+	case "":
+		fields = append(fields, FieldError{Field: "kind", Code: "required"})
+	case lessonKindText, lessonKindAssignment:
+		if l.Body == "" {
+			fields = append(fields, FieldError{Field: "body", Code: "required"})
+		}
+	}
+	return fields
+}
+
+func createLesson(c *gin.Context) {
+	module, ok := loadManagedModule(c, "createLesson")
+	if !ok {
+		return
+	}
+	var input lessonInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createLesson: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	lesson := Lesson{ModuleID: module.ID, CourseID: module.CourseID}
+	input.apply(&lesson)
+	if fields := lessonFieldErrors(lesson); len(fields) > 0 {
+		slog.WarnContext(c, "createLesson: Не заполнены поля урока", "fields", len(fields))
+		respondError(c, errValidation.WithFields(fields...))
+		return
+	}
+	pos, err := nextPosition(reqDB(c), &Lesson{}, "module_id", module.ID)
+	if err != nil {
+		slog.ErrorContext(c, "createLesson: Ошибка расчёта позиции", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	lesson.Position = pos
+	if err := reqDB(c).Create(&lesson).Error; err != nil {
+		slog.ErrorContext(c, "createLesson: Ошибка создания урока", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "createLesson: Урок создан", "module_id", module.ID, "lesson_id", lesson.ID, "kind", lesson.Kind)
+	c.JSON(http.StatusOK, lesson)
+}
+
+func updateLesson(c *gin.Context) {
+	lesson, ok := loadManagedLesson(c, "updateLesson")
+	if !ok {
+		return
+	}
+	var input lessonInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateLesson: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	input.apply(&lesson)
+	if fields := lessonFieldErrors(lesson); len(fields) > 0 {
+		slog.WarnContext(c, "updateLesson: Не заполнены поля урока", "fields", len(fields))
+		respondError(c, errValidation.WithFields(fields...))
+		return
+	}
+	// Файл, не подходящий новому типу урока, удаляем
+	stale := ""
+	if _, ok := lessonAttachmentTypes[lesson.Kind]; !ok && lesson.AttachmentPath != "" {
+		stale = lesson.AttachmentPath
+		lesson.AttachmentPath, lesson.AttachmentName = "", ""
+	}
+	if err := reqDB(c).Save(&lesson).Error; err != nil {
+		slog.ErrorContext(c, "updateLesson: Ошибка обновления урока", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	removeStoredFile(c, lessonFilesDir, stale)
+	c.JSON(http.StatusOK, lesson)
+}
+
+func deleteLesson(c *gin.Context) {
+	lesson, ok := loadManagedLesson(c, "deleteLesson")
+	if !ok {
+		return
+	}
+	var videos []Video
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if videos, err = deleteLessonData(tx, []int{lesson.ID}); err != nil {
+			return err
+		}
+		return tx.Delete(&lesson).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, "deleteLesson: Ошибка удаления урока", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	removeStoredFile(c, lessonFilesDir, lesson.AttachmentPath)
+	removeVideoFiles(c, videos)
+	slog.InfoContext(c, "deleteLesson: Урок удалён", "lesson_id", lesson.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Урок удалён"})
+}
+
+// uploadLessonAttachment сохраняет PDF или план питания урока. Файлы
+// отдаются через downloadLessonAttachment после проверки доступа.
+func uploadLessonAttachment(c *gin.Context) {
+	lesson, ok := loadManagedLesson(c, "uploadLessonAttachment")
+	if !ok {
+		return
+	}
+	allowed, ok := lessonAttachmentTypes[lesson.Kind]
+	if !ok {
+		slog.WarnContext(c, "uploadLessonAttachment: Тип урока не поддерживает файлы", "kind", lesson.Kind)
+		respondError(c, errAttachmentNotAllowed)
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		slog.WarnContext(c, "uploadLessonAttachment: Ошибка получения файла", "error", err)
+		respondError(c, errFileMissing)
+		return
+	}
+	if file.Size > maxLessonAttachment {
+		slog.WarnContext(c, "uploadLessonAttachment: Файл слишком большой", "size", file.Size)
+		respondError(c, errAttachmentTooLarge)
+		return
+	}
+	filename, ok := saveSniffedFile(c, "uploadLessonAttachment", file, lessonFilesDir, allowed)
+	if !ok {
+		return
+	}
+	old := lesson.AttachmentPath
+	lesson.AttachmentPath, lesson.AttachmentName = filename, filepath.Base(file.Filename)
+	if err := reqDB(c).Model(&lesson).Updates(map[string]any{"attachment_path": filename, "attachment_name": lesson.AttachmentName}).Error; err != nil {
+		slog.ErrorContext(c, "uploadLessonAttachment: Ошибка сохранения урока", "error", err)
+		removeStoredFile(c, lessonFilesDir, filename)
+		respondError(c, errInternal)
+		return
+	}
+	removeStoredFile(c, lessonFilesDir, old)
+	slog.InfoContext(c, "uploadLessonAttachment: Файл загружен", "lesson_id", lesson.ID, "size", file.Size)
+	c.JSON(http.StatusOK, lesson)
+}
+
+// openSniffedFile открывает загруженный файл и проверяет его тип по
+// содержимому, а не по расширению. Файл возвращается перемотанным в начало
+// вместе с определённым типом.
+func openSniffedFile(c *gin.Context, fn string, file *multipart.FileHeader, allowed []string) (multipart.File, string, bool) {
+	src, err := file.Open()
+	if err != nil {
+		slog.ErrorContext(c, fn+": Ошибка чтения файла", "error", err)
+		respondError(c, errInternal)
+		return nil, "", false
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		src.Close()
+		slog.WarnContext(c, fn+": Ошибка чтения файла", "error", err)
+		respondError(c, errFileMissing)
+		return nil, "", false
+	}
+	contentType := sniffContentType(head[:n])
+	if !slices.Contains(allowed, contentType) {
+		src.Close()
+		slog.WarnContext(c, fn+": Неподдерживаемый тип файла", "content_type", contentType)
+		respondError(c, errUnsupportedFileType)
+		return nil, "", false
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		src.Close()
+		slog.ErrorContext(c, fn+": Ошибка чтения файла", "error", err)
+		respondError(c, errInternal)
+		return nil, "", false
+	}
+	return src, contentType, true
+}
+
+// sniffContentType дополняет http.DetectContentType форматом QuickTime,
+// в котором снимают видео телефоны.
+func sniffContentType(head []byte) string {
+	contentType := http.DetectContentType(head)
+	if contentType == "application/octet-stream" && len(head) >= 12 && string(head[4:12]) == "ftypqt  " {
+		return "video/quicktime"
+	}
+	return contentType
+}
+
+// storedFileExts — расширения сохраняемых файлов по типу содержимого. По
+// расширению хранилище выставляет Content-Type при отдаче, поэтому брать его
+// из имени, присланного клиентом, нельзя: PNG с именем x.html отдался бы как
+// text/html.
+var storedFileExts = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// saveSniffedFile проверяет тип файла и сохраняет его в хранилище под
+// случайным именем внутри dir.
+func saveSniffedFile(c *gin.Context, fn string, file *multipart.FileHeader, dir string, allowed []string) (string, bool) {
+	src, contentType, ok := openSniffedFile(c, fn, file, allowed)
+	if !ok {
+		return "", false
+	}
+	defer src.Close()
+	ext, ok := storedFileExts[contentType]
+	if !ok {
+		slog.ErrorContext(c, fn+": Нет расширения для типа файла", "content_type", contentType)
+		respondError(c, errUnsupportedFileType)
+		return "", false
+	}
+	filename := uuid.New().String() + ext
+	if err := storage.Put(c, dir+"/"+filename, src); err != nil {
+		slog.ErrorContext(c, fn+": Ошибка сохранения файла", "error", err)
+		respondError(c, errInternal)
+		return "", false
+	}
+	return filename, true
+}
+
+func removeStoredFile(c *gin.Context, dir, name string) {
+	if name == "" {
+		return
+	}
+	if err := storage.Delete(c, dir+"/"+name); err != nil {
+		slog.WarnContext(c, "removeStoredFile: Ошибка удаления файла", "file", name, "error", err)
+	}
+}
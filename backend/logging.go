@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+var cardNumberPattern = regexp.MustCompile(`\b\d{13,19}\b`)
+
+// Значения этих ключей никогда не попадают в лог.
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"authorization": true,
+	"card_number":   true,
+	"card":          true,
+	"secret":        true,
+	"content":       true,
+	"body":          true,
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+func setupLogger(level slog.Level) {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, cardNumberPattern.ReplaceAllString(a.Value.String(), "[CARD]"))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, cardNumberPattern.ReplaceAllString(err.Error(), "[CARD]"))
+		}
+	}
+	return a
+}
+
+// contextHandler добавляет request_id и trace_id из контекста к каждой записи.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" || len(id) > 64 {
+		id = uuid.New().String()
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+	c.Header(requestIDHeader, id)
+	start := time.Now()
+	c.Next()
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(c, level, "http request",
+		"method", c.Request.Method,
+		"route", c.FullPath(),
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration_ms", time.Since(start).Milliseconds(),
+		"client_ip", c.ClientIP(),
+	)
+}
+
+// reqDB возвращает сессию БД, привязанную к контексту запроса.
+func reqDB(c *gin.Context) *gorm.DB {
+	return db.WithContext(c.Request.Context())
+}
+
+var providerClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: otelhttp.NewTransport(loggingTransport{http.DefaultTransport}),
+}
+
+// loggingTransport передаёт request_id во внешние сервисы и логирует вызовы.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	attrs := []any{
+		"method", req.Method,
+		"host", req.URL.Host,
+		"path", req.URL.Path,
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "provider request failed", append(attrs, "error", err)...)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "provider request", append(attrs, "status", resp.StatusCode)...)
+	return resp, nil
+}
+
+type gormSlogLogger struct {
+	level         gormlogger.LogLevel
+	slowThreshold time.Duration
+}
+
+func newGormLogger() gormlogger.Interface {
+	return &gormSlogLogger{level: gormlogger.Warn, slowThreshold: 200 * time.Millisecond}
+}
+
+func (l *gormSlogLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	clone := *l
+	clone.level = level
+	return &clone
+}
+
+func (l *gormSlogLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		slog.InfoContext(ctx, msg, "args", args)
+	}
+}
+
+func (l *gormSlogLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		slog.WarnContext(ctx, msg, "args", args)
+	}
+}
+
+func (l *gormSlogLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		slog.ErrorContext(ctx, msg, "args", args)
+	}
+}
+
+// Параметры запроса не логируются: в них могут быть пароли и номера карт.
+func (l *gormSlogLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
+func (l *gormSlogLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		sql, rows := fc()
+		slog.ErrorContext(ctx, "db query failed", "sql", sql, "rows", rows, "duration_ms", elapsed.Milliseconds(), "error", err)
+	case elapsed > l.slowThreshold && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		slog.WarnContext(ctx, "slow db query", "sql", sql, "rows", rows, "duration_ms", elapsed.Milliseconds())
+	case slog.Default().Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		slog.DebugContext(ctx, "db query", "sql", sql, "rows", rows, "duration_ms", elapsed.Milliseconds())
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -10,14 +11,16 @@ import (
 	"database/sql/driver"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -25,8 +28,10 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/joho/godotenv"
 	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -55,6 +60,7 @@ func (sa StringArray) Value() (driver.Value, error) {
 
 var db *gorm.DB
 var clients = make(map[int]*websocket.Conn)
+var clientsMu sync.Mutex
 var r *gin.Engine
 
 var upgrader = websocket.Upgrader{
@@ -70,7 +76,9 @@ type User struct {
 	FullName      string          `json:"full_name"`
 	Description   string          `json:"description"`
 	AvatarURL     string          `json:"avatar_url"`
+	Avatars       ImageVariants   `json:"avatar_variants" gorm:"type:jsonb"`
 	Services      StringArray     `json:"services" gorm:"type:jsonb"`
+	ServiceIDs    IntArray        `json:"service_ids" gorm:"type:jsonb"`
 	Balance       decimal.Decimal `json:"balance" gorm:"type:decimal(10,2);default:0"`
 	EncryptedCard string          `json:"encrypted_card"`
 	PayoutAmount  decimal.Decimal `json:"payout_amount" gorm:"type:decimal(10,2);default:0"`
@@ -78,16 +86,27 @@ type User struct {
 }
 
 type Course struct {
-	ID          int             `json:"id" gorm:"primaryKey"`
-	TeacherID   int             `json:"teacher_id"`
-	Title       string          `json:"title" gorm:"not null"`
-	Services    StringArray     `json:"services" gorm:"type:jsonb"`
-	Description string          `json:"description"`
-	NetPrice    decimal.Decimal `json:"net_price" gorm:"type:decimal(10,2)"`
-	GrossPrice  decimal.Decimal `json:"gross_price" gorm:"type:decimal(10,2)"`
-	VideoURL    string          `json:"video_url"`
-	CreatedAt   time.Time       `json:"created_at" gorm:"autoCreateTime"`
-	Teacher     User            `json:"teacher" gorm:"foreignKey:TeacherID"`
+	ID            int             `json:"id" gorm:"primaryKey"`
+	TeacherID     int             `json:"teacher_id"`
+	Title         string          `json:"title" gorm:"not null"`
+	Services      StringArray     `json:"services" gorm:"type:jsonb"`
+	ServiceIDs    IntArray        `json:"service_ids" gorm:"type:jsonb"`
+	CategoryID    *int            `json:"category_id" gorm:"index"`
+	Description   string          `json:"description"`
+	NetPrice      decimal.Decimal `json:"net_price" gorm:"type:decimal(10,2)"`
+	GrossPrice    decimal.Decimal `json:"gross_price" gorm:"type:decimal(10,2)"`
+	VideoURL      string          `json:"video_url,omitempty"`
+	CoverURL      string          `json:"cover_url"`
+	CoverVariants ImageVariants   `json:"cover_variants" gorm:"type:jsonb"`
+	DurationWeeks int             `json:"duration_weeks" gorm:"default:0"` // 0 — длительность не указана
+	Format        string          `json:"format" gorm:"default:'self_paced'"`
+	Status        string          `json:"status" gorm:"default:'published';index"`
+	CreatedAt     time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	DeletedAt     gorm.DeletedAt  `json:"-" gorm:"index"`
+	Teacher       User            `json:"teacher" gorm:"foreignKey:TeacherID"`
+
+	// Ссылка, скрытая AfterFind до проверки доступа
+	videoURL string
 }
 
 type Enrollment struct {
@@ -96,6 +115,8 @@ type Enrollment struct {
 	UserID    int       `json:"user_id"`
 	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
 	Course    Course    `json:"course" gorm:"foreignKey:CourseID"`
+
+	Progress *courseProgress `json:"progress,omitempty" gorm:"-"`
 }
 
 type Review struct {
@@ -103,6 +124,7 @@ type Review struct {
 	AuthorID  int       `json:"author_id"`
 	CourseID  int       `json:"course_id"`
 	Content   string    `json:"content"`
+	Rating    int       `json:"rating" gorm:"default:0"` // 1–5, 0 — без оценки
 	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
 	Author    User      `json:"author" gorm:"foreignKey:AuthorID"`
 }
@@ -117,7 +139,9 @@ type Payment struct {
 	Status        string          `json:"status" gorm:"default:'pending'"`
 	YookassaID    string          `json:"yookassa_id"`
 	TransactionID string          `json:"transaction_id"`
+	TraceParent   string          `json:"-"`
 	CreatedAt     time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	Items         []PaymentItem   `json:"items,omitempty" gorm:"foreignKey:PaymentID"`
 }
 
 type Message struct {
@@ -150,73 +174,55 @@ type Dialog struct {
 }
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Ошибка загрузки .env файла: %v", err)
+	if len(os.Args) > 1 {
+		if err := runCLI(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	dsn := os.Getenv("DSN")
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	setupLogger(cfg.LogLevel)
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		log.Fatalf("Ошибка подключения к БД: %v", err)
+		slog.Error("Ошибка инициализации трейсинга", "error", err)
+		os.Exit(1)
 	}
-	log.Println("Database connected successfully")
-	if err := db.AutoMigrate(&User{}, &Course{}, &Enrollment{}, &Review{}, &Payment{}, &Message{}, &Notification{}, &Dialog{}); err != nil {
-		log.Fatalf("Ошибка миграции БД: %v", err)
+	if err := initDB(); err != nil {
+		slog.Error("Ошибка инициализации БД", "error", err)
+		os.Exit(1)
 	}
-	log.Println("Database migration completed")
-
-	// Проверка и создание тестового нутрициолога
-	var count int64
-	if err := db.Model(&User{}).Where("role = ?", "nutri").Count(&count).Error; err != nil {
-		log.Printf("Ошибка проверки тестового нутрициолога: %v", err)
+	if err := initStorage(); err != nil {
+		slog.Error("Ошибка инициализации хранилища", "error", err)
+		os.Exit(1)
 	}
-	if count == 0 {
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("test123456"), bcrypt.DefaultCost)
-		testNutri := User{
-			Username:    "testnutri",
-			Email:       "testnutri@example.com",
-			Password:    string(hashedPassword),
-			Role:        "nutri",
-			FullName:    "Тестовый Нутрициолог",
-			Description: "Тестовое описание услуг",
-			Services:    StringArray{"Диета", "Консультации"},
-		}
-		if err := db.Create(&testNutri).Error; err != nil {
-			log.Printf("Ошибка создания тестового нутрициолога: %v", err)
-		} else {
-			log.Println("Создан тестовый нутрициолог")
-		}
+	if cfg.LogLevel > slog.LevelDebug {
+		gin.SetMode(gin.ReleaseMode)
 	}
-
-	// Проверка и создание учетной записи администратора
-	var adminCount int64
-	if err := db.Model(&User{}).Where("username = ?", "adminis").Count(&adminCount).Error; err != nil {
-		log.Printf("Ошибка проверки администратора: %v", err)
-	}
-	if adminCount == 0 {
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("Cl33l2l4jswi98"), bcrypt.DefaultCost)
-		admin := User{
-			Username: "adminis",
-			Email:    "admin@example.com",
-			Password: string(hashedPassword),
-			Role:     "admin",
-			FullName: "Администратор",
-		}
-		if err := db.Create(&admin).Error; err != nil {
-			log.Printf("Ошибка создания администратора: %v", err)
-		} else {
-			log.Println("Создан администратор")
-		}
+	r = setupRouter()
+	startBackgroundJobs()
+	if err := runServer(shutdownTracing); err != nil {
+		slog.Error("Ошибка запуска сервера", "error", err)
+		os.Exit(1)
 	}
+}
 
-	r = gin.Default()
+func setupRouter() *gin.Engine {
+	r := gin.New()
+	r.ContextWithFallback = true
+	r.Use(otelgin.Middleware(serviceName), requestIDMiddleware, metricsMiddleware, gin.Recovery())
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:3000"},
+		AllowOrigins:     []string{cfg.FrontendURL},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Authorization", "Content-Type"},
+		ExposeHeaders:    []string{"Link"},
 		AllowCredentials: true,
 	}))
-	r.Static("/avatars", "./Uploads/avatars")
+	r.GET("/avatars/*file", serveAvatar)
+	r.GET("/covers/*file", serveCover)
 	api := r.Group("/api")
 	api.POST("/register", register)
 	api.POST("/login", login)
@@ -226,10 +232,64 @@ func main() {
 	api.POST("/profile/update-card", authMiddleware, updateCard)
 	api.POST("/profile/upload-avatar", authMiddleware, uploadAvatarHandler)
 	api.GET("/search", searchCourses)
+	api.GET("/search/nutris", searchNutris)
+	api.GET("/search/suggest", searchSuggest)
 	api.GET("/courses", authMiddleware, getCourses)
 	api.POST("/courses", authMiddleware, createCourse)
-	api.GET("/courses/:id", getCourse)
+	api.GET("/courses/:id", optionalAuthMiddleware, getCourse)
+	api.PUT("/courses/:id", authMiddleware, updateCourse)
+	api.DELETE("/courses/:id", authMiddleware, deleteCourse)
+	api.POST("/courses/:id/cover", authMiddleware, uploadCourseCover)
+	api.DELETE("/courses/:id/cover", authMiddleware, deleteCourseCover)
+	api.GET("/courses/:id/modules", optionalAuthMiddleware, getCourseModules)
+	api.GET("/courses/:id/progress", authMiddleware, getCourseProgress)
+	api.GET("/courses/:id/clients-progress", authMiddleware, getCourseClientsProgress)
+	api.POST("/courses/:id/modules", authMiddleware, createModule)
+	api.PUT("/courses/:id/modules/order", authMiddleware, reorderModules)
+	api.PUT("/modules/:id", authMiddleware, updateModule)
+	api.DELETE("/modules/:id", authMiddleware, deleteModule)
+	api.POST("/modules/:id/lessons", authMiddleware, createLesson)
+	api.PUT("/modules/:id/lessons/order", authMiddleware, reorderLessons)
+	api.GET("/lessons/:id", authMiddleware, getLesson)
+	api.PUT("/lessons/:id", authMiddleware, updateLesson)
+	api.DELETE("/lessons/:id", authMiddleware, deleteLesson)
+	api.PUT("/lessons/:id/progress", authMiddleware, saveLessonProgress)
+	api.GET("/lessons/:id/quiz", authMiddleware, getQuiz)
+	api.PUT("/lessons/:id/quiz", authMiddleware, updateQuiz)
+	api.GET("/lessons/:id/quiz/attempts", authMiddleware, getQuizAttempts)
+	api.POST("/lessons/:id/quiz/attempts", authMiddleware, submitQuizAttempt)
+	api.GET("/lessons/:id/submissions", authMiddleware, getLessonSubmissions)
+	api.POST("/lessons/:id/submissions", authMiddleware, submitAssignment)
+	api.GET("/submissions", authMiddleware, getSubmissions)
+	api.PUT("/submissions/:id/review", authMiddleware, reviewSubmission)
+	api.GET("/submissions/:id/photos/:n", authMiddleware, getSubmissionPhoto)
+	api.GET("/certificates", authMiddleware, getCertificates)
+	api.GET("/certificates/:code", verifyCertificate)
+	api.GET("/certificates/:code/pdf", authMiddleware, downloadCertificate)
+	api.POST("/lessons/:id/attachment", authMiddleware, uploadLessonAttachment)
+	api.GET("/lessons/:id/attachment", authMiddleware, downloadLessonAttachment)
+	api.POST("/lessons/:id/video", authMiddleware, uploadLessonVideo)
+	api.POST("/lessons/:id/video/upload-url", authMiddleware, createVideoUploadURL)
+	api.GET("/lessons/:id/video", authMiddleware, getLessonVideo)
+	api.GET("/videos/:id/*file", streamVideo)
+	api.GET("/files/*key", serveSignedFile)
+	api.PUT("/files/*key", receiveSignedFile)
+	api.GET("/bundles", optionalAuthMiddleware, getBundles)
+	api.POST("/bundles", authMiddleware, createBundle)
+	api.GET("/bundles/:id", optionalAuthMiddleware, getBundle)
+	api.PUT("/bundles/:id", authMiddleware, updateBundle)
+	api.DELETE("/bundles/:id", authMiddleware, deleteBundle)
+	api.GET("/cart", authMiddleware, getCart)
+	api.DELETE("/cart", authMiddleware, clearCart)
+	api.POST("/cart/items", authMiddleware, addCartItem)
+	api.DELETE("/cart/items/:id", authMiddleware, deleteCartItem)
+	api.POST("/cart/checkout", authMiddleware, checkoutCart)
 	api.POST("/payments/create", authMiddleware, createPayment)
+	api.GET("/gifts", authMiddleware, getGifts)
+	api.POST("/gifts", authMiddleware, createGift)
+	api.POST("/gifts/redeem", authMiddleware, redeemGift)
+	api.GET("/gifts/:code", getGift)
+	api.POST("/gifts/:id/resend", authMiddleware, resendGift)
 	api.GET("/payments/return", authMiddleware, returnPayment)
 	api.POST("/webhook/yookassa", webhookYookassa)
 	api.GET("/reviews/user/:id", getUserReviews)
@@ -238,81 +298,136 @@ func main() {
 	api.POST("/reviews", authMiddleware, createReview)
 	api.GET("/enrolled", authMiddleware, getEnrolled)
 	api.GET("/nutris", getNutris)
+	api.GET("/recommendations", authMiddleware, getRecommendations)
 	api.POST("/start-chat", authMiddleware, startChat)
 	api.GET("/chats", authMiddleware, getChats)
 	api.GET("/messages", authMiddleware, getMessages)
 	api.POST("/messages", authMiddleware, sendMessage)
 	api.PUT("/messages/read", authMiddleware, markRead)
+	api.GET("/categories", getCategories)
+	api.GET("/services", getServiceTags)
 	api.GET("/admin/nutris", authMiddleware, getAdminNutris)
 	api.POST("/admin/decrypt-card", authMiddleware, decryptCard)
 	api.POST("/admin/payout", authMiddleware, processPayout)
 	api.POST("/admin/update-payout-amount", authMiddleware, updatePayoutAmount)
+	api.GET("/admin/gifts", authMiddleware, getAdminGifts)
+	api.POST("/admin/categories", authMiddleware, createCategory)
+	api.PUT("/admin/categories/:id", authMiddleware, updateCategory)
+	api.DELETE("/admin/categories/:id", authMiddleware, deleteCategory)
+	api.POST("/admin/services", authMiddleware, createServiceTag)
+	api.PUT("/admin/services/:id", authMiddleware, updateServiceTag)
+	api.DELETE("/admin/services/:id", authMiddleware, deleteServiceTag)
+	api.POST("/admin/services/remap", authMiddleware, remapServicesHandler)
 	r.GET("/ws", handleWebSocket)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	if cfg.MetricsToken != "" {
+		r.GET("/metrics", metricsHandler())
+	}
+	api.GET("/openapi.json", serveOpenAPI)
+	api.GET("/docs", serveAPIDocs)
+	return r
+}
+
+func initDB() error {
+	var err error
+	db, err = gorm.Open(postgres.Open(cfg.DSN), &gorm.Config{Logger: newGormLogger()})
+	if err != nil {
+		return fmt.Errorf("Ошибка подключения к БД: %w", err)
+	}
+	slog.Info("Database connected successfully")
+	if err := registerDBMetrics(db); err != nil {
+		return fmt.Errorf("Ошибка регистрации метрик БД: %w", err)
+	}
+	if err := registerDBTracing(db); err != nil {
+		return fmt.Errorf("Ошибка регистрации трейсинга БД: %w", err)
 	}
-	log.Printf("Starting server on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatalf("Ошибка запуска сервера: %v", err)
+	if err := registerSuggestInvalidation(db); err != nil {
+		return fmt.Errorf("Ошибка регистрации обновления подсказок: %w", err)
 	}
+	if err := db.AutoMigrate(&User{}, &Course{}, &Enrollment{}, &Review{}, &Payment{}, &Message{}, &Notification{}, &Dialog{}, &SearchQuery{}, &SearchQuerySource{}, &Recommendation{}, &CourseModule{}, &Lesson{}, &LessonProgress{},
+		&QuizQuestion{}, &QuizAttempt{}, &AssignmentSubmission{}, &Certificate{}, &Video{},
+		&Category{}, &ServiceTag{}, &Bundle{}, &CartItem{}, &PaymentItem{}, &Gift{}); err != nil {
+		return fmt.Errorf("Ошибка миграции БД: %w", err)
+	}
+	if err := migrateSearch(db); err != nil {
+		return err
+	}
+	if err := migratePaymentItems(db); err != nil {
+		return err
+	}
+	slog.Info("Database migration completed")
+	return nil
 }
 
 func authMiddleware(c *gin.Context) {
 	tokenString := c.GetHeader("Authorization")
 	if tokenString == "" {
-		log.Println("authMiddleware: Токен не предоставлен")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Токен не предоставлен"})
-		c.Abort()
+		slog.WarnContext(c, "authMiddleware: Токен не предоставлен")
+		respondError(c, errTokenMissing)
+		return
+	}
+	userID, role, err := parseToken(tokenString)
+	if err != nil {
+		slog.WarnContext(c, "authMiddleware: Неверный токен", "error", err)
+		respondError(c, errTokenInvalid)
 		return
 	}
-	tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
+	c.Set("userID", userID)
+	c.Set("role", role)
+	c.Next()
+}
+
+// optionalAuthMiddleware для публичных маршрутов, ответ которых зависит от
+// пользователя. Без токена или с неверным токеном запрос идёт как анонимный.
+func optionalAuthMiddleware(c *gin.Context) {
+	if tokenString := c.GetHeader("Authorization"); tokenString != "" {
+		if userID, role, err := parseToken(tokenString); err == nil {
+			c.Set("userID", userID)
+			c.Set("role", role)
+		}
+	}
+	c.Next()
+}
+
+func parseToken(header string) (int, string, error) {
+	tokenString := strings.Replace(header, "Bearer ", "", 1)
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
+		return []byte(cfg.JWTSecret), nil
 	})
 	if err != nil || !token.Valid {
-		log.Printf("authMiddleware: Неверный токен: %v", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный токен"})
-		c.Abort()
-		return
+		return 0, "", fmt.Errorf("неверный токен: %w", err)
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		log.Println("authMiddleware: Неверные данные токена")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверные данные токена"})
-		c.Abort()
-		return
+		return 0, "", errors.New("неверные данные токена")
 	}
-	userID := int(claims["id"].(float64))
-	role := claims["role"].(string)
-	c.Set("userID", userID)
-	c.Set("role", role)
-	c.Next()
+	id, ok := claims["id"].(float64)
+	role, ok2 := claims["role"].(string)
+	if !ok || !ok2 {
+		return 0, "", errors.New("неверные данные токена")
+	}
+	return int(id), role, nil
 }
 
 func register(c *gin.Context) {
 	var input struct {
-		Username    string `json:"username"`
-		Email       string `json:"email"`
-		Password    string `json:"password"`
-		Role        string `json:"role"`
-		FullName    string `json:"full_name"`
-		Description string `json:"description"`
+		Username    string `json:"username" binding:"required,username"`
+		Email       string `json:"email" binding:"required,email,max=254"`
+		Password    string `json:"password" binding:"required,password"`
+		Role        string `json:"role" binding:"required,oneof=client nutri"`
+		FullName    string `json:"full_name" binding:"max=100"`
+		Description string `json:"description" binding:"max=2000"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("register: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
-		return
-	}
-	if input.Role != "client" && input.Role != "nutri" {
-		log.Println("register: Неверная роль")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная роль"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "register: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("register: Ошибка хеширования пароля: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка хеширования пароля"})
+		slog.ErrorContext(c, "register: Ошибка хеширования пароля", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	user := User{
@@ -323,9 +438,9 @@ func register(c *gin.Context) {
 		FullName:    input.FullName,
 		Description: input.Description,
 	}
-	if err := db.Create(&user).Error; err != nil {
-		log.Printf("register: Ошибка создания пользователя: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания пользователя"})
+	if err := reqDB(c).Create(&user).Error; err != nil {
+		slog.ErrorContext(c, "register: Ошибка создания пользователя", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
@@ -333,10 +448,10 @@ func register(c *gin.Context) {
 		"role": user.Role,
 		"exp":  time.Now().Add(time.Hour * 24).Unix(),
 	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
 	if err != nil {
-		log.Printf("register: Ошибка генерации токена: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации токена"})
+		slog.ErrorContext(c, "register: Ошибка генерации токена", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"token": tokenString, "role": user.Role, "id": user.ID})
@@ -344,23 +459,23 @@ func register(c *gin.Context) {
 
 func login(c *gin.Context) {
 	var input struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("login: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "login: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	var user User
-	if err := db.Where("username = ?", input.Username).First(&user).Error; err != nil {
-		log.Printf("login: Пользователь не найден: %v", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверные данные"})
+	if err := reqDB(c).Where("username = ?", input.Username).First(&user).Error; err != nil {
+		slog.WarnContext(c, "login: Пользователь не найден", "error", err)
+		respondError(c, errInvalidCredentials)
 		return
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
-		log.Println("login: Неверный пароль")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверные данные"})
+		slog.WarnContext(c, "login: Неверный пароль")
+		respondError(c, errInvalidCredentials)
 		return
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
@@ -368,10 +483,10 @@ func login(c *gin.Context) {
 		"role": user.Role,
 		"exp":  time.Now().Add(time.Hour * 24).Unix(),
 	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
 	if err != nil {
-		log.Printf("login: Ошибка генерации токена: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации токена"})
+		slog.ErrorContext(c, "login: Ошибка генерации токена", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"token": tokenString, "role": user.Role, "id": user.ID})
@@ -384,29 +499,34 @@ func getProfile(c *gin.Context) {
 	if idStr != "" {
 		userID, err = strconv.Atoi(idStr)
 		if err != nil {
-			log.Printf("getProfile: Неверный ID: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+			slog.WarnContext(c, "getProfile: Неверный ID", "error", err)
+			respondError(c, errInvalidID)
 			return
 		}
 	} else {
 		userID = c.GetInt("userID")
 	}
 	var user User
-	if err := db.First(&user, userID).Error; err != nil {
-		log.Printf("getProfile: Пользователь не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+	if err := reqDB(c).First(&user, userID).Error; err != nil {
+		slog.WarnContext(c, "getProfile: Пользователь не найден", "error", err)
+		respondError(c, errUserNotFound)
 		return
 	}
+	// Черновики и архив видны только в собственном профиле
+	coursesQuery := reqDB(c).Where("teacher_id = ?", userID)
+	if idStr != "" {
+		coursesQuery = coursesQuery.Scopes(publishedCourses)
+	}
 	var courses []Course
-	if err := db.Where("teacher_id = ?", userID).Find(&courses).Error; err != nil {
-		log.Printf("getProfile: Ошибка получения курсов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения курсов"})
+	if err := coursesQuery.Find(&courses).Error; err != nil {
+		slog.ErrorContext(c, "getProfile: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	var reviews []Review
-	if err := db.Preload("Author").Where("course_id IN (SELECT id FROM courses WHERE teacher_id = ?)", userID).Find(&reviews).Error; err != nil {
-		log.Printf("getProfile: Ошибка получения отзывов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения отзывов"})
+	if err := reqDB(c).Preload("Author").Where("course_id IN (SELECT id FROM courses WHERE teacher_id = ?)", userID).Find(&reviews).Error; err != nil {
+		slog.ErrorContext(c, "getProfile: Ошибка получения отзывов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"profile": user, "courses": courses, "reviews": reviews})
@@ -415,133 +535,125 @@ func getProfile(c *gin.Context) {
 func updateProfile(c *gin.Context) {
 	userID := c.GetInt("userID")
 	var input struct {
-		FullName    string `json:"full_name"`
-		Description string `json:"description"`
+		FullName    string       `json:"full_name" binding:"max=100"`
+		Description string       `json:"description" binding:"max=2000"`
+		Services    *StringArray `json:"services" binding:"omitempty,services"`
+		ServiceIDs  *IntArray    `json:"service_ids" binding:"omitempty,max=10,unique,dive,gt=0"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("updateProfile: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateProfile: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
-	if err := db.Model(&User{}).Where("id = ?", userID).Updates(User{FullName: input.FullName, Description: input.Description}).Error; err != nil {
-		log.Printf("updateProfile: Ошибка обновления профиля: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления профиля"})
+	if err := reqDB(c).Model(&User{}).Where("id = ?", userID).Updates(User{FullName: input.FullName, Description: input.Description}).Error; err != nil {
+		slog.ErrorContext(c, "updateProfile: Ошибка обновления профиля", "error", err)
+		respondError(c, errInternal)
 		return
 	}
+	services := make(map[string]any)
+	if !serviceUpdates(c, "updateProfile", input.Services, input.ServiceIDs, services) {
+		return
+	}
+	if len(services) > 0 {
+		if err := reqDB(c).Model(&User{}).Where("id = ?", userID).Updates(services).Error; err != nil {
+			slog.ErrorContext(c, "updateProfile: Ошибка обновления услуг", "error", err)
+			respondError(c, errInternal)
+			return
+		}
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Профиль обновлен"})
 }
 
 func updateCard(c *gin.Context) {
 	userID := c.GetInt("userID")
 	var input struct {
-		CardNumber string `json:"card_number"`
-	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("updateCard: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
-		return
+		CardNumber string `json:"card_number" binding:"required,card_number"`
 	}
-	if matched, _ := regexp.MatchString(`^\d{16}$`, input.CardNumber); !matched {
-		log.Println("updateCard: Неверный номер карты")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный номер карты"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateCard: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
-	key, err := hex.DecodeString(os.Getenv("AES_KEY"))
+	key, err := hex.DecodeString(cfg.AESKey)
 	if err != nil {
-		log.Printf("updateCard: Ошибка декодирования ключа AES: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка шифрования"})
+		slog.ErrorContext(c, "updateCard: Ошибка декодирования ключа AES", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Printf("updateCard: Ошибка создания шифра: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка шифрования"})
+		slog.ErrorContext(c, "updateCard: Ошибка создания шифра", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	plaintext := []byte(input.CardNumber)
 	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		log.Printf("updateCard: Ошибка генерации IV: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка шифрования"})
+		slog.ErrorContext(c, "updateCard: Ошибка генерации IV", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	mode := cipher.NewCBCEncrypter(block, iv)
 	mode.CryptBlocks(ciphertext[aes.BlockSize:], plaintext)
 	encrypted := hex.EncodeToString(ciphertext)
-	if err := db.Model(&User{}).Where("id = ?", userID).Update("encrypted_card", encrypted).Error; err != nil {
-		log.Printf("updateCard: Ошибка обновления карты: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления карты"})
+	if err := reqDB(c).Model(&User{}).Where("id = ?", userID).Update("encrypted_card", encrypted).Error; err != nil {
+		slog.ErrorContext(c, "updateCard: Ошибка обновления карты", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Карта обновлена"})
 }
 
+const avatarFilesDir = "avatars"
+
 func uploadAvatarHandler(c *gin.Context) {
 	userID := c.GetInt("userID")
 	file, err := c.FormFile("avatar")
 	if err != nil {
-		log.Printf("uploadAvatar: Ошибка получения файла: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка загрузки файла"})
-		return
-	}
-	if file.Size > 5*1024*1024 {
-		log.Println("uploadAvatar: Файл слишком большой")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Файл превышает 5MB"})
-		return
-	}
-	filename := uuid.New().String() + ".jpg"
-	path := "./Uploads/avatars/" + filename
-	if err := os.MkdirAll("./Uploads/avatars", os.ModePerm); err != nil {
-		log.Printf("uploadAvatar: Ошибка создания директории: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сервера"})
-		return
-	}
-	if err := c.SaveUploadedFile(file, path); err != nil {
-		log.Printf("uploadAvatar: Ошибка сохранения файла: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения файла"})
+		slog.WarnContext(c, "uploadAvatar: Ошибка получения файла", "error", err)
+		respondError(c, errFileMissing)
 		return
 	}
 	var user User
-	if err := db.First(&user, userID).Error; err != nil {
-		log.Printf("uploadAvatar: Пользователь не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+	if err := reqDB(c).First(&user, userID).Error; err != nil {
+		slog.WarnContext(c, "uploadAvatar: Пользователь не найден", "error", err)
+		respondError(c, errUserNotFound)
 		return
 	}
-	user.AvatarURL = "/avatars/" + filename
-	if err := db.Save(&user).Error; err != nil {
-		log.Printf("uploadAvatar: Ошибка сохранения аватара: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения аватара"})
+	url, variants, ok := saveImage(c, "uploadAvatar", file, avatarImage)
+	if !ok {
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Аватар загружен", "profile": user})
-}
-
-func searchCourses(c *gin.Context) {
-	query := c.Query("q")
-	var courses []Course
-	dbQuery := db.Preload("Teacher")
-	if query != "" {
-		jsonQuery := fmt.Sprintf(`["%s"]`, query)
-		dbQuery = dbQuery.Where("title ILIKE ? OR description ILIKE ? OR services @> ?", "%"+query+"%", "%"+query+"%", jsonQuery)
-	}
-	if err := dbQuery.Find(&courses).Error; err != nil {
-		log.Printf("searchCourses: Ошибка поиска курсов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка поиска"})
+	oldURL := user.AvatarURL
+	user.AvatarURL, user.Avatars = url, variants
+	if err := reqDB(c).Model(&user).Select("avatar_url", "avatars").Updates(&user).Error; err != nil {
+		removeImage(c, avatarImage, url)
+		slog.ErrorContext(c, "uploadAvatar: Ошибка сохранения аватара", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	log.Printf("Найдено %d курсов для запроса '%s'", len(courses), query)
-	c.JSON(http.StatusOK, courses)
+	removeImage(c, avatarImage, oldURL)
+	c.JSON(http.StatusOK, gin.H{"message": "Аватар загружен", "profile": user})
 }
 
 func getCourses(c *gin.Context) {
 	userID := c.GetInt("userID")
-	var courses []Course
-	if err := db.Where("teacher_id = ?", userID).Find(&courses).Error; err != nil {
-		log.Printf("getCourses: Ошибка получения курсов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения курсов"})
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getCourses: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	courses, err := fetchPage(c, reqDB(c).Where("teacher_id = ?", userID), page, newestFirst, func(course Course) pageKey { return timeKey(course.CreatedAt, course.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getCourses: Ошибка получения курсов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
+	for i := range courses {
+		courses[i].revealVideo()
+	}
 	c.JSON(http.StatusOK, courses)
 }
 
@@ -549,41 +661,53 @@ func createCourse(c *gin.Context) {
 	userID := c.GetInt("userID")
 	role := c.GetString("role")
 	if role != "nutri" {
-		log.Println("createCourse: Доступ запрещён")
-		c.JSON(http.StatusForbidden, gin.H{"error": "Доступ только для нутрициологов"})
+		slog.WarnContext(c, "createCourse: Доступ запрещён")
+		respondError(c, errNutriOnly)
 		return
 	}
 	var input struct {
-		Title       string      `json:"title"`
-		Services    StringArray `json:"services"`
-		Description string      `json:"description"`
-		NetPrice    float64     `json:"net_price"`
-		VideoURL    string      `json:"video_url"`
+		Title       string      `json:"title" binding:"required,notblank,max=200"`
+		Services    StringArray `json:"services" binding:"services"`
+		ServiceIDs  *IntArray   `json:"service_ids" binding:"omitempty,max=10,unique,dive,gt=0"`
+		CategoryID  *int        `json:"category_id" binding:"omitempty,gt=0"`
+		Description string      `json:"description" binding:"max=5000"`
+		NetPrice    float64     `json:"net_price" binding:"required,price"`
+		VideoURL    string      `json:"video_url" binding:"omitempty,weburl"`
+		Duration    int         `json:"duration_weeks" binding:"omitempty,min=1,max=104"`
+		Format      string      `json:"format" binding:"omitempty,oneof=self_paced group individual"`
+		Status      string      `json:"status" binding:"omitempty,oneof=draft published"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("createCourse: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createCourse: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
-	if input.NetPrice <= 0 {
-		log.Println("createCourse: Неверная цена")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Чистая цена должна быть больше 0"})
+	services := make(map[string]any)
+	if !serviceUpdates(c, "createCourse", &input.Services, input.ServiceIDs, services) {
+		return
+	}
+	if input.CategoryID != nil && !checkCategoryInput(c, "createCourse", "category_id", *input.CategoryID) {
 		return
 	}
 	netPrice := decimal.NewFromFloat(input.NetPrice)
-	grossPrice := netPrice.Mul(decimal.NewFromFloat(1.5))
+	grossPrice := netPrice.Mul(grossMultiplier)
 	course := Course{
-		TeacherID:   userID,
-		Title:       input.Title,
-		Services:    input.Services,
-		Description: input.Description,
-		NetPrice:    netPrice,
-		GrossPrice:  grossPrice,
-		VideoURL:    input.VideoURL,
-	}
-	if err := db.Create(&course).Error; err != nil {
-		log.Printf("createCourse: Ошибка создания курса: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания курса"})
+		TeacherID:     userID,
+		Title:         input.Title,
+		Services:      services["services"].(StringArray),
+		ServiceIDs:    services["service_ids"].(IntArray),
+		CategoryID:    input.CategoryID,
+		Description:   input.Description,
+		NetPrice:      netPrice,
+		GrossPrice:    grossPrice,
+		VideoURL:      input.VideoURL,
+		DurationWeeks: input.Duration,
+		Format:        input.Format,
+		Status:        input.Status,
+	}
+	if err := reqDB(c).Create(&course).Error; err != nil {
+		slog.ErrorContext(c, "createCourse: Ошибка создания курса", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, course)
@@ -593,89 +717,143 @@ func getCourse(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Printf("getCourse: Неверный ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		slog.WarnContext(c, "getCourse: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
 		return
 	}
 	var course Course
-	if err := db.Preload("Teacher").First(&course, id).Error; err != nil {
-		log.Printf("getCourse: Курс не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Курс не найден"})
+	if err := reqDB(c).Unscoped().Preload("Teacher").First(&course, id).Error; err != nil {
+		slog.WarnContext(c, "getCourse: Курс не найден", "error", err)
+		respondError(c, errCourseNotFound)
+		return
+	}
+	visible, err := canViewCourse(reqDB(c), course, c.GetInt("userID"), c.GetString("role"))
+	if err != nil {
+		slog.ErrorContext(c, "getCourse: Ошибка проверки доступа", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if !visible {
+		slog.WarnContext(c, "getCourse: Курс недоступен", "course_id", id, "status", course.Status)
+		respondError(c, errCourseNotFound)
+		return
+	}
+	access, err := courseLessonAccess(reqDB(c), course, c.GetInt("userID"), c.GetString("role"))
+	if err != nil {
+		slog.ErrorContext(c, "getCourse: Ошибка проверки записи", "error", err)
+		respondError(c, errInternal)
 		return
 	}
+	if access.manage || access.enrolledAt != nil {
+		course.revealVideo()
+	}
 	c.JSON(http.StatusOK, course)
 }
 
 func createPayment(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "payment.create")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
 	userID := c.GetInt("userID")
 	role := c.GetString("role")
 	if role != "client" {
-		log.Println("createPayment: Доступ запрещён")
-		c.JSON(http.StatusForbidden, gin.H{"error": "Доступ только для клиентов"})
+		slog.WarnContext(c, "createPayment: Доступ запрещён")
+		respondError(c, errClientOnly)
 		return
 	}
-	var input struct {
-		CourseID int `json:"course_id"`
-	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("createPayment: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	var input checkoutTarget
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createPayment: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
-	var user User
-	if err := db.First(&user, userID).Error; err != nil {
-		log.Printf("createPayment: Пользователь не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+	if !input.check(c, "createPayment") {
 		return
 	}
-	var course Course
-	if err := db.First(&course, input.CourseID).Error; err != nil {
-		log.Printf("createPayment: Курс не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Курс не найден"})
+	courseIDs, bundleIDs := input.ids()
+	items, description, ok := resolveCheckout(c, "createPayment", userID, courseIDs, bundleIDs)
+	if !ok {
 		return
 	}
-	var existingPayment Payment
-	if err := db.Where("user_id = ? AND course_id = ? AND status = ?", userID, input.CourseID, "paid").First(&existingPayment).Error; err == nil {
-		log.Printf("createPayment: Платеж за курс %d уже существует для пользователя %d", input.CourseID, userID)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Вы уже оплатили этот курс"})
+	startCheckout(c, span, "createPayment", items, description, nil)
+}
+
+// startCheckout создаёт платёж из позиций и передаёт его в ЮKassa с чеком,
+// в котором каждая позиция — отдельная строка. Непустой gift сохраняется
+// вместе с платежом и выпускается после оплаты.
+func startCheckout(c *gin.Context, span trace.Span, fn string, items []PaymentItem, description string, gift *Gift) {
+	// Проверяем до записи в базу, иначе каждая попытка оставляла бы
+	// неоплатимые платёж и подарок
+	if !cfg.paymentsConfigured() {
+		slog.ErrorContext(c, fn+": Отсутствуют SHOP_ID или SECRET_KEY")
+		respondError(c, errPaymentsNotConfigured)
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.GetInt("userID")
+	var user User
+	if err := reqDB(c).First(&user, userID).Error; err != nil {
+		slog.WarnContext(c, fn+": Пользователь не найден", "error", err)
+		respondError(c, errUserNotFound)
 		return
 	}
-	grossAmount := course.GrossPrice
-	commission := grossAmount.Sub(course.NetPrice)
-	netAmount := course.NetPrice
 	payment := Payment{
 		UserID:      userID,
-		CourseID:    input.CourseID,
-		GrossAmount: grossAmount,
-		Commission:  commission,
-		NetAmount:   netAmount,
 		Status:      "pending",
+		TraceParent: injectTraceParent(ctx),
 		CreatedAt:   time.Now(),
+		Items:       items,
+	}
+	// course_id заполняется только у платежей за один курс, как было до корзины
+	if len(items) == 1 {
+		payment.CourseID = items[0].CourseID
+	}
+	receiptItems := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		payment.GrossAmount = payment.GrossAmount.Add(item.GrossAmount)
+		payment.Commission = payment.Commission.Add(item.Commission)
+		payment.NetAmount = payment.NetAmount.Add(item.NetAmount)
+		receiptItems[i] = map[string]interface{}{
+			"description": receiptText(item.Title),
+			"quantity":    "1.00",
+			"amount": map[string]interface{}{
+				"value":    item.GrossAmount.StringFixed(2),
+				"currency": "RUB",
+			},
+			"vat_code": 1,
+		}
 	}
-	if err := db.Create(&payment).Error; err != nil {
-		log.Printf("createPayment: Ошибка создания платежа: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания платежа"})
+	// ЮKassa не принимает платёж на нулевую сумму. Новые цены всегда
+	// положительные, но курсы с ценой 0.00 могли остаться в базе.
+	if !payment.GrossAmount.IsPositive() {
+		slog.WarnContext(c, fn+": Нулевая сумма платежа", "gross_amount", payment.GrossAmount)
+		respondError(c, errCourseNotAvailable)
 		return
 	}
-	shopID := os.Getenv("SHOP_ID")
-	secretKey := os.Getenv("SECRET_KEY")
-	if shopID == "" || secretKey == "" {
-		log.Println("createPayment: Отсутствуют SHOP_ID или SECRET_KEY")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка конфигурации платежной системы"})
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&payment).Error; err != nil || gift == nil {
+			return err
+		}
+		gift.PaymentID = payment.ID
+		return tx.Create(gift).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, fn+": Ошибка создания платежа", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	apiURL := "https://api.yookassa.ru/v3/payments"
 	body := map[string]interface{}{
 		"amount": map[string]interface{}{
-			"value":    grossAmount.StringFixed(2),
+			"value":    payment.GrossAmount.StringFixed(2),
 			"currency": "RUB",
 		},
 		"confirmation": map[string]interface{}{
 			"type":       "redirect",
-			"return_url": "http://localhost:3000/return?payment_id=" + strconv.Itoa(payment.ID),
+			"return_url": cfg.FrontendURL + "/return?payment_id=" + strconv.Itoa(payment.ID),
 		},
 		"capture":     true,
-		"description": "Оплата услуги " + course.Title,
+		"description": receiptText(description),
 		"metadata": map[string]interface{}{
 			"payment_id": payment.ID,
 		},
@@ -683,166 +861,149 @@ func createPayment(c *gin.Context) {
 			"customer": map[string]interface{}{
 				"email": user.Email,
 			},
-			"items": []map[string]interface{}{
-				{
-					"description": course.Title,
-					"quantity":    "1.00",
-					"amount": map[string]interface{}{
-						"value":    grossAmount.StringFixed(2),
-						"currency": "RUB",
-					},
-					"vat_code": 1,
-				},
-			},
+			"items": receiptItems,
 		},
 	}
 	bodyJSON, err := json.Marshal(body)
 	if err != nil {
-		log.Printf("createPayment: Ошибка сериализации тела запроса: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания платежа"})
+		slog.ErrorContext(c, fn+": Ошибка сериализации тела запроса", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(bodyJSON))
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", apiURL, bytes.NewBuffer(bodyJSON))
 	if err != nil {
-		log.Printf("createPayment: Ошибка создания запроса к ЮKassa: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания платежа"})
+		slog.ErrorContext(c, fn+": Ошибка создания запроса к ЮKassa", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Idempotence-Key", uuid.New().String())
-	req.SetBasicAuth(shopID, secretKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	req.SetBasicAuth(cfg.ShopID, cfg.SecretKey)
+	resp, err := providerClient.Do(req)
 	if err != nil {
-		log.Printf("createPayment: Ошибка отправки запроса к ЮKassa: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка связи с платежной системой"})
+		slog.ErrorContext(c, fn+": Ошибка отправки запроса к ЮKassa", "error", err)
+		paymentsCreated.WithLabelValues("provider_unavailable").Inc()
+		respondError(c, errPaymentProviderDown)
 		return
 	}
 	defer resp.Body.Close()
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("createPayment: Ошибка чтения ответа ЮKassa: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки ответа платежной системы"})
+		slog.ErrorContext(c, fn+": Ошибка чтения ответа ЮKassa", "error", err)
+		respondError(c, errPaymentProviderError)
 		return
 	}
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("createPayment: Ошибка ЮKassa: status %d, body: %s", resp.StatusCode, string(bodyBytes))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания платежа в ЮKassa: " + string(bodyBytes)})
+		slog.ErrorContext(c, fn+": Ошибка ЮKassa", "status", resp.StatusCode, "response", string(bodyBytes))
+		paymentsCreated.WithLabelValues("provider_error").Inc()
+		respondError(c, errPaymentProviderError)
 		return
 	}
 	var yookassaResp map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &yookassaResp); err != nil {
-		log.Printf("createPayment: Ошибка парсинга ответа ЮKassa: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки ответа платежной системы"})
+		slog.ErrorContext(c, fn+": Ошибка парсинга ответа ЮKassa", "error", err)
+		respondError(c, errPaymentProviderError)
 		return
 	}
+	paymentsCreated.WithLabelValues("created").Inc()
+	span.SetAttributes(attribute.Int("payment.id", payment.ID))
 	payment.YookassaID = yookassaResp["id"].(string)
-	if err := db.Save(&payment).Error; err != nil {
-		log.Printf("createPayment: Ошибка сохранения YookassaID: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения данных платежа"})
+	if err := reqDB(c).Model(&payment).Update("yookassa_id", payment.YookassaID).Error; err != nil {
+		slog.ErrorContext(c, fn+": Ошибка сохранения YookassaID", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	confirmation, ok := yookassaResp["confirmation"].(map[string]interface{})
 	if !ok {
-		log.Println("createPayment: Неверный формат confirmation в ответе ЮKassa")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки ответа платежной системы"})
+		slog.ErrorContext(c, fn+": Неверный формат confirmation в ответе ЮKassa")
+		respondError(c, errPaymentProviderError)
 		return
 	}
 	confirmationURL, ok := confirmation["confirmation_url"].(string)
 	if !ok {
-		log.Println("createPayment: Отсутствует confirmation_url в ответе ЮKassa")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки ответа платежной системы"})
+		slog.ErrorContext(c, fn+": Отсутствует confirmation_url в ответе ЮKassa")
+		respondError(c, errPaymentProviderError)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"confirmation_url": confirmationURL, "payment_id": payment.ID})
+	response := gin.H{"confirmation_url": confirmationURL, "payment_id": payment.ID}
+	if gift != nil {
+		response["gift_id"] = gift.ID
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func returnPayment(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "payment.return")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
 	paymentIDStr := c.Query("payment_id")
 	paymentID, err := strconv.Atoi(paymentIDStr)
 	if err != nil {
-		log.Printf("returnPayment: Неверный ID платежа: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID платежа"})
+		slog.WarnContext(c, "returnPayment: Неверный ID платежа", "error", err)
+		respondError(c, errInvalidID)
 		return
 	}
 	var payment Payment
-	if err := db.First(&payment, paymentID).Error; err != nil {
-		log.Printf("returnPayment: Платеж не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Платеж не найден"})
+	if err := reqDB(c).First(&payment, paymentID).Error; err != nil {
+		slog.WarnContext(c, "returnPayment: Платеж не найден", "error", err)
+		respondError(c, errPaymentNotFound)
 		return
 	}
+	span.SetAttributes(attribute.Int("payment.id", payment.ID))
+	linkTraceParent(span, payment.TraceParent)
 	if payment.YookassaID == "" {
-		log.Println("returnPayment: Платеж не инициализирован")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Платеж не инициализирован"})
+		slog.WarnContext(c, "returnPayment: Платеж не инициализирован")
+		respondError(c, errPaymentNotInitialized)
 		return
 	}
-	shopID := os.Getenv("SHOP_ID")
-	secretKey := os.Getenv("SECRET_KEY")
 	apiURL := "https://api.yookassa.ru/v3/payments/" + payment.YookassaID
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(c.Request.Context(), "GET", apiURL, nil)
 	if err != nil {
-		log.Printf("returnPayment: Ошибка создания запроса: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки платежа"})
+		slog.ErrorContext(c, "returnPayment: Ошибка создания запроса", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	req.SetBasicAuth(shopID, secretKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	req.SetBasicAuth(cfg.ShopID, cfg.SecretKey)
+	resp, err := providerClient.Do(req)
 	if err != nil {
-		log.Printf("returnPayment: Ошибка запроса к ЮKassa: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки платежа"})
+		slog.ErrorContext(c, "returnPayment: Ошибка запроса к ЮKassa", "error", err)
+		respondError(c, errPaymentProviderDown)
 		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		bodyErr, _ := io.ReadAll(resp.Body)
-		log.Printf("returnPayment: Ошибка ЮKassa: status %d, body: %s", resp.StatusCode, string(bodyErr))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки платежа в ЮKassa"})
+		slog.ErrorContext(c, "returnPayment: Ошибка ЮKassa", "status", resp.StatusCode, "response", string(bodyErr))
+		respondError(c, errPaymentProviderError)
 		return
 	}
 	var yookassaResp map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&yookassaResp); err != nil {
-		log.Printf("returnPayment: Ошибка парсинга ответа: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки платежа"})
+		slog.ErrorContext(c, "returnPayment: Ошибка парсинга ответа", "error", err)
+		respondError(c, errPaymentProviderError)
 		return
 	}
 	status := yookassaResp["status"].(string)
-	if status == "succeeded" && payment.Status != "paid" {
-		payment.Status = "paid"
-		payment.TransactionID = yookassaResp["id"].(string)
-		if err := db.Save(&payment).Error; err != nil {
-			log.Printf("returnPayment: Ошибка обновления платежа: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления платежа"})
-			return
-		}
-		var course Course
-		if err := db.First(&course, payment.CourseID).Error; err != nil {
-			log.Printf("returnPayment: Курс не найден: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Курс не найден"})
-			return
-		}
-		if err := db.Model(&User{}).Where("id = ?", course.TeacherID).Update("balance", gorm.Expr("balance + ?", payment.NetAmount)).Error; err != nil {
-			log.Printf("returnPayment: Ошибка начисления баланса: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка начисления баланса"})
+	if status == "succeeded" {
+		var settled bool
+		payment, settled, err = settlePayment(c, reqDB(c), payment.ID, yookassaResp["id"].(string))
+		if err != nil {
+			slog.ErrorContext(c, "returnPayment: Ошибка зачисления оплаты", "error", err)
+			respondError(c, errInternal)
 			return
 		}
-		enrollment := Enrollment{
-			CourseID: payment.CourseID,
-			UserID:   payment.UserID,
-		}
-		if err := db.Create(&enrollment).Error; err != nil {
-			log.Printf("returnPayment: Ошибка создания записи: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания записи"})
-			return
+		if settled {
+			paymentsSettled.WithLabelValues("paid", "return").Inc()
 		}
 	} else if status == "pending" {
 		c.JSON(http.StatusOK, gin.H{"status": "pending", "message": "Оплата в обработке"})
 		return
 	} else if status == "canceled" || status == "failed" {
 		payment.Status = "failed"
-		if err := db.Save(&payment).Error; err != nil {
-			log.Printf("returnPayment: Ошибка обновления платежа: %v", err)
+		if err := reqDB(c).Save(&payment).Error; err != nil {
+			slog.ErrorContext(c, "returnPayment: Ошибка обновления платежа", "error", err)
 		}
+		paymentsSettled.WithLabelValues("failed", "return").Inc()
 		c.JSON(http.StatusOK, gin.H{"status": "failed", "message": "Оплата не удалась"})
 		return
 	}
@@ -850,30 +1011,36 @@ func returnPayment(c *gin.Context) {
 }
 
 func webhookYookassa(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "payment.webhook")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		log.Printf("webhookYookassa: Ошибка чтения webhook: %v", err)
+		slog.WarnContext(c, "webhookYookassa: Ошибка чтения webhook", "error", err)
 		c.Status(http.StatusBadRequest)
 		return
 	}
 	signatureHeader := c.GetHeader("Content-Signature")
 	if signatureHeader == "" {
-		log.Println("webhookYookassa: Signature отсутствует")
+		slog.WarnContext(c, "webhookYookassa: Signature отсутствует")
+		webhookVerificationFailures.WithLabelValues("missing_signature").Inc()
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	secretKey := []byte(os.Getenv("SECRET_KEY"))
+	secretKey := []byte(cfg.SecretKey)
 	h := hmac.New(sha256.New, secretKey)
 	h.Write(body)
 	expectedSignature := "sha256=" + hex.EncodeToString(h.Sum(nil))
 	if signatureHeader != expectedSignature {
-		log.Printf("webhookYookassa: Неверная signature: expected %s, got %s", expectedSignature, signatureHeader)
+		slog.WarnContext(c, "webhookYookassa: Неверная signature")
+		webhookVerificationFailures.WithLabelValues("invalid_signature").Inc()
 		c.Status(http.StatusBadRequest)
 		return
 	}
 	var payload map[string]interface{}
 	if err := json.Unmarshal(body, &payload); err != nil {
-		log.Printf("webhookYookassa: Ошибка парсинга webhook: %v", err)
+		slog.WarnContext(c, "webhookYookassa: Ошибка парсинга webhook", "error", err)
+		webhookVerificationFailures.WithLabelValues("invalid_payload").Inc()
 		c.Status(http.StatusBadRequest)
 		return
 	}
@@ -882,55 +1049,18 @@ func webhookYookassa(c *gin.Context) {
 		object := payload["object"].(map[string]interface{})
 		yookassaID := object["id"].(string)
 		var payment Payment
-		if err := db.Where("yookassa_id = ?", yookassaID).First(&payment).Error; err != nil {
-			log.Printf("webhookYookassa: Платеж не найден: %v", err)
-			c.Status(http.StatusOK)
-			return
-		}
-		if payment.Status == "paid" {
-			c.Status(http.StatusOK)
-			return
-		}
-		payment.Status = "paid"
-		payment.TransactionID = yookassaID
-		if err := db.Save(&payment).Error; err != nil {
-			log.Printf("webhookYookassa: Ошибка обновления платежа: %v", err)
+		if err := reqDB(c).Where("yookassa_id = ?", yookassaID).First(&payment).Error; err != nil {
+			slog.ErrorContext(c, "webhookYookassa: Платеж не найден", "error", err)
 			c.Status(http.StatusOK)
 			return
 		}
-		var course Course
-		if err := db.First(&course, payment.CourseID).Error; err != nil {
-			log.Printf("webhookYookassa: Курс не найден: %v", err)
-			c.Status(http.StatusOK)
-			return
-		}
-		if err := db.Model(&User{}).Where("id = ?", course.TeacherID).Update("balance", gorm.Expr("balance + ?", payment.NetAmount)).Error; err != nil {
-			log.Printf("webhookYookassa: Ошибка начисления баланса: %v", err)
-			c.Status(http.StatusOK)
-			return
-		}
-		enrollment := Enrollment{
-			CourseID: payment.CourseID,
-			UserID:   payment.UserID,
+		span.SetAttributes(attribute.Int("payment.id", payment.ID))
+		linkTraceParent(span, payment.TraceParent)
+		if _, settled, err := settlePayment(c, reqDB(c), payment.ID, yookassaID); err != nil {
+			slog.ErrorContext(c, "webhookYookassa: Ошибка зачисления оплаты", "error", err)
+		} else if settled {
+			paymentsSettled.WithLabelValues("paid", "webhook").Inc()
 		}
-		if err := db.Create(&enrollment).Error; err != nil {
-			log.Printf("webhookYookassa: Ошибка создания записи: %v", err)
-			c.Status(http.StatusOK)
-			return
-		}
-		notification := Notification{
-			UserID:  course.TeacherID,
-			Type:    "payment",
-			Content: "Получена оплата за услугу " + course.Title + ": " + payment.NetAmount.StringFixed(2) + " руб.",
-		}
-		if err := db.Create(&notification).Error; err != nil {
-			log.Printf("webhookYookassa: Ошибка создания уведомления: %v", err)
-		}
-		notifJSON, _ := json.Marshal(map[string]interface{}{
-			"type": "notification",
-			"data": notification,
-		})
-		sendToUser(course.TeacherID, notifJSON)
 	}
 	c.Status(http.StatusOK)
 }
@@ -939,14 +1069,21 @@ func getUserReviews(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Printf("getUserReviews: Неверный ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		slog.WarnContext(c, "getUserReviews: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
 		return
 	}
-	var reviews []Review
-	if err := db.Preload("Author").Where("course_id IN (SELECT id FROM courses WHERE teacher_id = ?)", id).Find(&reviews).Error; err != nil {
-		log.Printf("getUserReviews: Ошибка получения отзывов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения отзывов"})
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getUserReviews: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	reviews, err := fetchPage(c, reqDB(c).Preload("Author").Where("course_id IN (SELECT id FROM courses WHERE teacher_id = ?)", id),
+		page, newestFirst, func(review Review) pageKey { return timeKey(review.CreatedAt, review.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getUserReviews: Ошибка получения отзывов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, reviews)
@@ -956,14 +1093,20 @@ func getCourseReviews(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Printf("getCourseReviews: Неверный ID: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		slog.WarnContext(c, "getCourseReviews: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
 		return
 	}
-	var reviews []Review
-	if err := db.Preload("Author").Where("course_id = ?", id).Find(&reviews).Error; err != nil {
-		log.Printf("getCourseReviews: Ошибка получения отзывов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения отзывов"})
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getCourseReviews: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	reviews, err := fetchPage(c, reqDB(c).Preload("Author").Where("course_id = ?", id), page, newestFirst, func(review Review) pageKey { return timeKey(review.CreatedAt, review.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getCourseReviews: Ошибка получения отзывов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, reviews)
@@ -971,9 +1114,9 @@ func getCourseReviews(c *gin.Context) {
 
 func getRandomReviews(c *gin.Context) {
 	var reviews []Review
-	if err := db.Preload("Author").Order("RANDOM()").Limit(6).Find(&reviews).Error; err != nil {
-		log.Printf("getRandomReviews: Ошибка получения отзывов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения отзывов"})
+	if err := reqDB(c).Preload("Author").Order("RANDOM()").Limit(6).Find(&reviews).Error; err != nil {
+		slog.ErrorContext(c, "getRandomReviews: Ошибка получения отзывов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, reviews)
@@ -982,28 +1125,30 @@ func getRandomReviews(c *gin.Context) {
 func createReview(c *gin.Context) {
 	userID := c.GetInt("userID")
 	var input struct {
-		CourseID int    `json:"course_id"`
-		Content  string `json:"content"`
+		CourseID int    `json:"course_id" binding:"required,gt=0"`
+		Content  string `json:"content" binding:"required,notblank,max=2000"`
+		Rating   int    `json:"rating" binding:"omitempty,min=1,max=5"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("createReview: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createReview: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	var enrollment Enrollment
-	if err := db.Where("user_id = ? AND course_id = ?", userID, input.CourseID).First(&enrollment).Error; err != nil {
-		log.Printf("createReview: Отзыв запрещён: %v", err)
-		c.JSON(http.StatusForbidden, gin.H{"error": "Отзыв возможен только после оплаты"})
+	if err := reqDB(c).Where("user_id = ? AND course_id = ?", userID, input.CourseID).First(&enrollment).Error; err != nil {
+		slog.WarnContext(c, "createReview: Отзыв запрещён", "error", err)
+		respondError(c, errReviewRequiresEnrollment)
 		return
 	}
 	review := Review{
 		AuthorID: userID,
 		CourseID: input.CourseID,
 		Content:  input.Content,
+		Rating:   input.Rating,
 	}
-	if err := db.Create(&review).Error; err != nil {
-		log.Printf("createReview: Ошибка создания отзыва: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания отзыва"})
+	if err := reqDB(c).Create(&review).Error; err != nil {
+		slog.ErrorContext(c, "createReview: Ошибка создания отзыва", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, review)
@@ -1011,107 +1156,148 @@ func createReview(c *gin.Context) {
 
 func getEnrolled(c *gin.Context) {
 	userID := c.GetInt("userID")
-	var enrollments []Enrollment
-	if err := db.Preload("Course.Teacher").Where("user_id = ?", userID).Find(&enrollments).Error; err != nil {
-		log.Printf("getEnrolled: Ошибка получения записей: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения записей"})
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getEnrolled: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	enrollments, err := fetchPage(c, reqDB(c).Preload("Course", withDeletedCourse).Preload("Course.Teacher").Where("user_id = ?", userID), page, newestFirst,
+		func(e Enrollment) pageKey { return timeKey(e.CreatedAt, e.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getEnrolled: Ошибка получения записей", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	courseIDs := make([]int, len(enrollments))
+	for i, e := range enrollments {
+		courseIDs[i] = e.CourseID
+	}
+	progress, err := loadCourseProgress(reqDB(c), userID, courseIDs)
+	if err != nil {
+		slog.ErrorContext(c, "getEnrolled: Ошибка получения прогресса", "error", err)
+		respondError(c, errInternal)
 		return
 	}
+	for i := range enrollments {
+		enrollments[i].Progress = progress[enrollments[i].CourseID]
+		enrollments[i].Course.revealVideo()
+	}
 	c.JSON(http.StatusOK, enrollments)
 }
 
 func getNutris(c *gin.Context) {
-	limitStr := c.Query("limit")
 	random := c.Query("random") == "true"
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getNutris: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	dbQuery := reqDB(c).Where("role = ?", "nutri")
+	if serviceID := c.Query("service_id"); serviceID != "" {
+		id, err := strconv.Atoi(serviceID)
+		if err != nil || id <= 0 {
+			slog.WarnContext(c, "getNutris: Неверный ID услуги", "service_id", serviceID)
+			respondError(c, errValidation.WithFields(FieldError{Field: "service_id", Code: "gt", Param: "0"}))
+			return
+		}
+		dbQuery = dbQuery.Where("service_ids @> ?::jsonb", fmt.Sprintf("[%d]", id))
+	}
 	var nutris []User
-	dbQuery := db.Where("role = ?", "nutri")
+	var err error
 	if random {
-		dbQuery = dbQuery.Order("RANDOM()")
-	}
-	if limitStr != "" {
-		limit, _ := strconv.Atoi(limitStr)
-		dbQuery = dbQuery.Limit(limit)
+		// У случайной выборки нет устойчивого порядка, курсор не применяется
+		err = dbQuery.Order("RANDOM()").Limit(page.Limit).Find(&nutris).Error
+	} else {
+		nutris, err = fetchPage(c, dbQuery, page, newestFirst, func(user User) pageKey { return timeKey(user.CreatedAt, user.ID) })
 	}
-	if err := dbQuery.Find(&nutris).Error; err != nil {
-		log.Printf("getNutris: Ошибка получения нутрициологов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения нутрициологов"})
+	if err != nil {
+		slog.ErrorContext(c, "getNutris: Ошибка получения нутрициологов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	log.Printf("Возвращено %d нутрициологов", len(nutris))
+	slog.DebugContext(c, "getNutris: Возвращены нутрициологи", "count", len(nutris))
 	c.JSON(http.StatusOK, nutris)
 }
 
 func getAdminNutris(c *gin.Context) {
 	role := c.GetString("role")
 	if role != "admin" {
-		log.Println("getAdminNutris: Доступ запрещён")
-		c.JSON(http.StatusForbidden, gin.H{"error": "Доступ только для администраторов"})
+		slog.WarnContext(c, "getAdminNutris: Доступ запрещён")
+		respondError(c, errAdminOnly)
 		return
 	}
-	var nutris []User
-	if err := db.Where("role = ?", "nutri").Find(&nutris).Error; err != nil {
-		log.Printf("getAdminNutris: Ошибка получения нутрициологов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения нутрициологов"})
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getAdminNutris: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	nutris, err := fetchPage(c, reqDB(c).Where("role = ?", "nutri"), page, newestFirst, func(user User) pageKey { return timeKey(user.CreatedAt, user.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getAdminNutris: Ошибка получения нутрициологов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	log.Printf("Возвращено %d нутрициологов для администратора", len(nutris))
+	slog.DebugContext(c, "getAdminNutris: Возвращены нутрициологи", "count", len(nutris))
 	c.JSON(http.StatusOK, nutris)
 }
 
 func decryptCard(c *gin.Context) {
 	role := c.GetString("role")
 	if role != "admin" {
-		log.Println("decryptCard: Доступ запрещён")
-		c.JSON(http.StatusForbidden, gin.H{"error": "Доступ только для администраторов"})
+		slog.WarnContext(c, "decryptCard: Доступ запрещён")
+		respondError(c, errAdminOnly)
 		return
 	}
 	var input struct {
-		UserID int `json:"user_id"`
+		UserID int `json:"user_id" binding:"required,gt=0"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("decryptCard: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "decryptCard: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	var user User
-	if err := db.First(&user, input.UserID).Error; err != nil {
-		log.Printf("decryptCard: Пользователь не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+	if err := reqDB(c).First(&user, input.UserID).Error; err != nil {
+		slog.WarnContext(c, "decryptCard: Пользователь не найден", "error", err)
+		respondError(c, errUserNotFound)
 		return
 	}
 	if user.EncryptedCard == "" {
-		log.Println("decryptCard: Карта не указана")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Карта не указана"})
+		slog.WarnContext(c, "decryptCard: Карта не указана")
+		respondError(c, errCardNotSet)
 		return
 	}
-	key, err := hex.DecodeString(os.Getenv("AES_KEY"))
+	key, err := hex.DecodeString(cfg.AESKey)
 	if err != nil {
-		log.Printf("decryptCard: Ошибка декодирования ключа AES: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка расшифровки"})
+		slog.ErrorContext(c, "decryptCard: Ошибка декодирования ключа AES", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	ciphertext, err := hex.DecodeString(user.EncryptedCard)
 	if err != nil {
-		log.Printf("decryptCard: Ошибка декодирования карты: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка расшифровки"})
+		slog.ErrorContext(c, "decryptCard: Ошибка декодирования карты", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Printf("decryptCard: Ошибка создания шифра: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка расшифровки"})
+		slog.ErrorContext(c, "decryptCard: Ошибка создания шифра", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	if len(ciphertext) < aes.BlockSize {
-		log.Println("decryptCard: Неверный размер ciphertext")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка расшифровки"})
+		slog.ErrorContext(c, "decryptCard: Неверный размер ciphertext")
+		respondError(c, errInternal)
 		return
 	}
 	iv := ciphertext[:aes.BlockSize]
 	ciphertext = ciphertext[aes.BlockSize:]
 	if len(ciphertext)%aes.BlockSize != 0 {
-		log.Println("decryptCard: Неверный размер ciphertext")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка расшифровки"})
+		slog.ErrorContext(c, "decryptCard: Неверный размер ciphertext")
+		respondError(c, errInternal)
 		return
 	}
 	mode := cipher.NewCBCDecrypter(block, iv)
@@ -1124,104 +1310,104 @@ func decryptCard(c *gin.Context) {
 func processPayout(c *gin.Context) {
 	role := c.GetString("role")
 	if role != "admin" {
-		log.Println("processPayout: Доступ запрещён")
-		c.JSON(http.StatusForbidden, gin.H{"error": "Доступ только для администраторов"})
+		slog.WarnContext(c, "processPayout: Доступ запрещён")
+		respondError(c, errAdminOnly)
 		return
 	}
 	var input struct {
-		UserID int             `json:"user_id"`
+		UserID int             `json:"user_id" binding:"required,gt=0"`
 		Amount decimal.Decimal `json:"amount"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("processPayout: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "processPayout: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	var user User
-	if err := db.First(&user, input.UserID).Error; err != nil {
-		log.Printf("processPayout: Пользователь не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+	if err := reqDB(c).First(&user, input.UserID).Error; err != nil {
+		slog.WarnContext(c, "processPayout: Пользователь не найден", "error", err)
+		respondError(c, errUserNotFound)
 		return
 	}
 	if input.Amount.LessThanOrEqual(decimal.Zero) {
-		log.Println("processPayout: Сумма должна быть больше 0")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Сумма должна быть больше 0"})
+		slog.WarnContext(c, "processPayout: Сумма должна быть больше 0")
+		respondError(c, errAmountNotPositive)
 		return
 	}
 	if input.Amount.GreaterThan(user.Balance) {
-		log.Println("processPayout: Недостаточно средств на балансе")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Недостаточно средств на балансе"})
+		slog.WarnContext(c, "processPayout: Недостаточно средств на балансе")
+		respondError(c, errInsufficientBalance)
 		return
 	}
-	if err := db.Model(&user).Update("balance", gorm.Expr("balance - ?", input.Amount)).Error; err != nil {
-		log.Printf("processPayout: Ошибка списания баланса: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка списания баланса"})
+	if err := reqDB(c).Model(&user).Update("balance", gorm.Expr("balance - ?", input.Amount)).Error; err != nil {
+		slog.ErrorContext(c, "processPayout: Ошибка списания баланса", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	if err := db.Model(&user).Update("payout_amount", gorm.Expr("payout_amount + ?", input.Amount)).Error; err != nil {
-		log.Printf("processPayout: Ошибка обновления выплаченной суммы: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления выплаченной суммы"})
+	if err := reqDB(c).Model(&user).Update("payout_amount", gorm.Expr("payout_amount + ?", input.Amount)).Error; err != nil {
+		slog.ErrorContext(c, "processPayout: Ошибка обновления выплаченной суммы", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	log.Printf("Инициирована выплата %s руб. для пользователя %d", input.Amount.StringFixed(2), input.UserID)
+	slog.InfoContext(c, "processPayout: Инициирована выплата", "amount", input.Amount.StringFixed(2), "user_id", input.UserID)
 	c.JSON(http.StatusOK, gin.H{"message": "Выплата инициирована"})
 }
 
 func updatePayoutAmount(c *gin.Context) {
 	role := c.GetString("role")
 	if role != "admin" {
-		log.Println("updatePayoutAmount: Доступ запрещён")
-		c.JSON(http.StatusForbidden, gin.H{"error": "Доступ только для администраторов"})
+		slog.WarnContext(c, "updatePayoutAmount: Доступ запрещён")
+		respondError(c, errAdminOnly)
 		return
 	}
 	var input struct {
-		UserID       int             `json:"user_id"`
+		UserID       int             `json:"user_id" binding:"required,gt=0"`
 		PayoutAmount decimal.Decimal `json:"payout_amount"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("updatePayoutAmount: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updatePayoutAmount: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	var user User
-	if err := db.First(&user, input.UserID).Error; err != nil {
-		log.Printf("updatePayoutAmount: Пользователь не найден: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+	if err := reqDB(c).First(&user, input.UserID).Error; err != nil {
+		slog.WarnContext(c, "updatePayoutAmount: Пользователь не найден", "error", err)
+		respondError(c, errUserNotFound)
 		return
 	}
 	if input.PayoutAmount.LessThan(decimal.Zero) {
-		log.Println("updatePayoutAmount: Выплаченная сумма не может быть отрицательной")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Выплаченная сумма не может быть отрицательной"})
+		slog.WarnContext(c, "updatePayoutAmount: Выплаченная сумма не может быть отрицательной")
+		respondError(c, errNegativePayout)
 		return
 	}
-	if err := db.Model(&user).Update("payout_amount", input.PayoutAmount).Error; err != nil {
-		log.Printf("updatePayoutAmount: Ошибка обновления выплаченной суммы: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления выплаченной суммы"})
+	if err := reqDB(c).Model(&user).Update("payout_amount", input.PayoutAmount).Error; err != nil {
+		slog.ErrorContext(c, "updatePayoutAmount: Ошибка обновления выплаченной суммы", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	log.Printf("Обновлена выплаченная сумма %s руб. для пользователя %d", input.PayoutAmount.StringFixed(2), input.UserID)
+	slog.InfoContext(c, "updatePayoutAmount: Обновлена выплаченная сумма", "payout_amount", input.PayoutAmount.StringFixed(2), "user_id", input.UserID)
 	c.JSON(http.StatusOK, gin.H{"message": "Выплаченная сумма обновлена"})
 }
 
 func startChat(c *gin.Context) {
 	userID := c.GetInt("userID")
 	var input struct {
-		ReceiverID int `json:"receiver_id"`
+		ReceiverID int `json:"receiver_id" binding:"required,gt=0"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("startChat: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "startChat: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	if userID == input.ReceiverID {
-		log.Println("startChat: Нельзя начать чат с самим собой")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Нельзя начать чат с самим собой"})
+		slog.WarnContext(c, "startChat: Нельзя начать чат с самим собой")
+		respondError(c, errChatWithSelf)
 		return
 	}
 	var count int64
-	if err := db.Model(&Dialog{}).Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)", userID, input.ReceiverID, input.ReceiverID, userID).Count(&count).Error; err != nil {
-		log.Printf("startChat: Ошибка проверки диалога: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка начала чата"})
+	if err := reqDB(c).Model(&Dialog{}).Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)", userID, input.ReceiverID, input.ReceiverID, userID).Count(&count).Error; err != nil {
+		slog.ErrorContext(c, "startChat: Ошибка проверки диалога", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	if count == 0 {
@@ -1229,54 +1415,53 @@ func startChat(c *gin.Context) {
 			SenderID:   userID,
 			ReceiverID: input.ReceiverID,
 		}
-		if err := db.Create(&dialog).Error; err != nil {
-			log.Printf("startChat: Ошибка создания диалога: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка начала чата"})
+		if err := reqDB(c).Create(&dialog).Error; err != nil {
+			slog.ErrorContext(c, "startChat: Ошибка создания диалога", "error", err)
+			respondError(c, errInternal)
 			return
 		}
-		log.Printf("Создан диалог %d -> %d", userID, input.ReceiverID)
-	}
-	chatStartedJSON, err := json.Marshal(map[string]interface{}{
-		"type": "chat:started",
-		"data": map[string]int{"receiver_id": input.ReceiverID},
-	})
-	if err != nil {
-		log.Printf("startChat: Ошибка marshal chat:started: %v", err)
-	} else {
-		sendToUser(userID, chatStartedJSON)
+		slog.InfoContext(c, "startChat: Создан диалог", "sender_id", userID, "receiver_id", input.ReceiverID)
 	}
+	sendEvent(c, userID, "chat:started", map[string]int{"receiver_id": input.ReceiverID})
 	c.JSON(http.StatusOK, gin.H{"receiver_id": input.ReceiverID})
 }
 
 func getChats(c *gin.Context) {
 	userID := c.GetInt("userID")
-	var dialogs []struct {
-		UserID      int    `json:"user_id"`
-		FullName    string `json:"full_name"`
-		AvatarURL   string `json:"avatar_url"`
-		LastMessage string `json:"last_message"`
-		UnreadCount int    `json:"unread_count"`
-	}
-	err := db.Raw(`
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getChats: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	type chatSummary struct {
+		UserID       int       `json:"user_id"`
+		FullName     string    `json:"full_name"`
+		AvatarURL    string    `json:"avatar_url"`
+		LastMessage  string    `json:"last_message"`
+		UnreadCount  int       `json:"unread_count"`
+		LastActivity time.Time `json:"last_activity"`
+	}
+	summaries := reqDB(c).Raw(`
 		SELECT u.id as user_id, u.full_name, u.avatar_url, 
 		       (SELECT content FROM messages WHERE (sender_id = u.id AND receiver_id = ? OR sender_id = ? AND receiver_id = u.id) ORDER BY created_at DESC LIMIT 1) as last_message,
-		       (SELECT COUNT(*) FROM messages WHERE sender_id = u.id AND receiver_id = ? AND read_at IS NULL) as unread_count
+		       (SELECT COUNT(*) FROM messages WHERE sender_id = u.id AND receiver_id = ? AND read_at IS NULL) as unread_count,
+		       COALESCE(
+				(SELECT MAX(m.created_at) FROM messages m WHERE (m.sender_id = u.id AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = u.id)),
+				(SELECT d.created_at FROM dialogs d WHERE (d.sender_id = u.id AND d.receiver_id = ?) OR (d.sender_id = ? AND d.receiver_id = u.id) LIMIT 1)
+		       ) as last_activity
 		FROM users u
 		WHERE EXISTS (SELECT 1 FROM dialogs WHERE (sender_id = u.id AND receiver_id = ?) OR (sender_id = ? AND receiver_id = u.id))
 		AND u.id != ?
-		ORDER BY (
-			SELECT COALESCE(
-				(SELECT MAX(m.created_at) FROM messages m WHERE (m.sender_id = u.id AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = u.id)),
-				(SELECT d.created_at FROM dialogs d WHERE (d.sender_id = u.id AND d.receiver_id = ?) OR (d.sender_id = ? AND d.receiver_id = u.id) LIMIT 1)
-			)
-		) DESC
-	`, userID, userID, userID, userID, userID, userID, userID, userID, userID, userID).Scan(&dialogs).Error
+	`, userID, userID, userID, userID, userID, userID, userID, userID, userID, userID)
+	dialogs, err := fetchPage(c, reqDB(c).Table("(?) AS chats", summaries), page, keyset{Col: "last_activity", IDCol: "user_id"},
+		func(d chatSummary) pageKey { return timeKey(d.LastActivity, d.UserID) })
 	if err != nil {
-		log.Printf("getChats: Ошибка получения чатов: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		slog.ErrorContext(c, "getChats: Ошибка получения чатов", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	log.Printf("Загружено %d диалогов для пользователя %d", len(dialogs), userID)
+	slog.DebugContext(c, "getChats: Загружены диалоги", "user_id", userID, "count", len(dialogs))
 	c.JSON(http.StatusOK, dialogs)
 }
 
@@ -1285,30 +1470,39 @@ func getMessages(c *gin.Context) {
 	receiverIDStr := c.Query("receiver_id")
 	receiverID, err := strconv.Atoi(receiverIDStr)
 	if err != nil {
-		log.Printf("getMessages: Неверный ID получателя: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID получателя"})
+		slog.WarnContext(c, "getMessages: Неверный ID получателя", "error", err)
+		respondError(c, errInvalidID)
+		return
+	}
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "getMessages: Неверные параметры страницы")
+		respondError(c, apiErr)
 		return
 	}
-	var messages []Message
-	if err := db.Preload("Sender").Preload("Receiver").
-		Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)", userID, receiverID, receiverID, userID).
-		Order("created_at ASC").Find(&messages).Error; err != nil {
-		log.Printf("getMessages: Ошибка получения сообщений: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения сообщений"})
+	// Первая страница — самые новые сообщения, next ведёт к более старым
+	messages, err := fetchPage(c, reqDB(c).Preload("Sender").Preload("Receiver").
+		Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)", userID, receiverID, receiverID, userID),
+		page, newestFirst, func(m Message) pageKey { return timeKey(m.CreatedAt, m.ID) })
+	if err != nil {
+		slog.ErrorContext(c, "getMessages: Ошибка получения сообщений", "error", err)
+		respondError(c, errInternal)
 		return
 	}
+	// Внутри страницы сообщения идут в хронологическом порядке
+	slices.Reverse(messages)
 	c.JSON(http.StatusOK, messages)
 }
 
 func sendMessage(c *gin.Context) {
 	userID := c.GetInt("userID")
 	var input struct {
-		ReceiverID int    `json:"receiver_id"`
-		Content    string `json:"content"`
+		ReceiverID int    `json:"receiver_id" binding:"required,gt=0"`
+		Content    string `json:"content" binding:"required,notblank,max=4000"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("sendMessage: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "sendMessage: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
 	message := Message{
@@ -1316,57 +1510,36 @@ func sendMessage(c *gin.Context) {
 		ReceiverID: input.ReceiverID,
 		Content:    input.Content,
 	}
-	if err := db.Create(&message).Error; err != nil {
-		log.Printf("sendMessage: Ошибка отправки сообщения: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
-		return
-	}
-	if err := db.First(&message).Error; err != nil {
-		log.Printf("sendMessage: Ошибка загрузки сообщения: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки сообщения"})
+	if err := reqDB(c).Create(&message).Error; err != nil {
+		slog.ErrorContext(c, "sendMessage: Ошибка отправки сообщения", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	msgJSON, err := json.Marshal(map[string]interface{}{
-		"type": "message",
-		"data": message,
-	})
-	if err != nil {
-		log.Printf("sendMessage: Ошибка marshal сообщения: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки сообщения"})
+	if err := reqDB(c).First(&message).Error; err != nil {
+		slog.ErrorContext(c, "sendMessage: Ошибка загрузки сообщения", "error", err)
+		respondError(c, errInternal)
 		return
 	}
-	if conn, ok := clients[userID]; ok {
-		if err := conn.WriteMessage(websocket.TextMessage, msgJSON); err != nil {
-			log.Printf("sendMessage: Ошибка отправки WebSocket сообщения пользователю %d: %v", userID, err)
-			conn.Close()
-			delete(clients, userID)
-		}
-	}
-	if conn, ok := clients[input.ReceiverID]; ok {
-		if err := conn.WriteMessage(websocket.TextMessage, msgJSON); err != nil {
-			log.Printf("sendMessage: Ошибка отправки WebSocket сообщения пользователю %d: %v", input.ReceiverID, err)
-			conn.Close()
-			delete(clients, input.ReceiverID)
-		}
-	}
-	log.Printf("Отправлено сообщение от %d к %d: %s", userID, input.ReceiverID, input.Content)
+	sendEvent(c, userID, "message", message)
+	sendEvent(c, input.ReceiverID, "message", message)
+	slog.InfoContext(c, "sendMessage: Отправлено сообщение", "message_id", message.ID, "sender_id", userID, "receiver_id", input.ReceiverID, "length", len(input.Content))
 	c.JSON(http.StatusOK, message)
 }
 
 func markRead(c *gin.Context) {
 	userID := c.GetInt("userID")
 	var input struct {
-		ReceiverID int `json:"receiver_id"`
+		ReceiverID int `json:"receiver_id" binding:"required,gt=0"`
 	}
-	if err := c.BindJSON(&input); err != nil {
-		log.Printf("markRead: Неверные данные: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "markRead: Неверные данные", "error", err)
+		respondError(c, bindError(err))
 		return
 	}
-	if err := db.Model(&Message{}).Where("sender_id = ? AND receiver_id = ? AND read_at IS NULL", input.ReceiverID, userID).
+	if err := reqDB(c).Model(&Message{}).Where("sender_id = ? AND receiver_id = ? AND read_at IS NULL", input.ReceiverID, userID).
 		Update("read_at", time.Now()).Error; err != nil {
-		log.Printf("markRead: Ошибка отметки прочитанных: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отметки прочитанных"})
+		slog.ErrorContext(c, "markRead: Ошибка отметки прочитанных", "error", err)
+		respondError(c, errInternal)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Сообщения отмечены прочитанными"})
@@ -1375,61 +1548,83 @@ func markRead(c *gin.Context) {
 func handleWebSocket(c *gin.Context) {
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Printf("handleWebSocket: Ошибка апгрейда WebSocket: %v", err)
+		slog.ErrorContext(c, "handleWebSocket: Ошибка апгрейда WebSocket", "error", err)
 		return
 	}
 	tokenString := c.Request.URL.Query().Get("token")
 	if tokenString == "" {
-		log.Println("handleWebSocket: Токен не предоставлен")
+		slog.WarnContext(c, "handleWebSocket: Токен не предоставлен")
 		conn.WriteMessage(websocket.TextMessage, []byte("Токен не предоставлен"))
 		conn.Close()
 		return
 	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
+		return []byte(cfg.JWTSecret), nil
 	})
 	if err != nil || !token.Valid {
-		log.Printf("handleWebSocket: Неверный токен: %v", err)
+		slog.ErrorContext(c, "handleWebSocket: Неверный токен", "error", err)
 		conn.WriteMessage(websocket.TextMessage, []byte("Неверный токен"))
 		conn.Close()
 		return
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		log.Println("handleWebSocket: Неверные данные токена")
+		slog.WarnContext(c, "handleWebSocket: Неверные данные токена")
 		conn.WriteMessage(websocket.TextMessage, []byte("Неверные данные токена"))
 		conn.Close()
 		return
 	}
 	userID := int(claims["id"].(float64))
-	log.Printf("WebSocket подключен для пользователя %d", userID)
+	slog.InfoContext(c, "handleWebSocket: WebSocket подключен", "user_id", userID)
+	clientsMu.Lock()
 	if oldConn, exists := clients[userID]; exists {
 		oldConn.Close()
-		delete(clients, userID)
 	}
 	clients[userID] = conn
+	clientsMu.Unlock()
 	defer func() {
-		log.Printf("WebSocket отключен для пользователя %d", userID)
+		slog.InfoContext(c, "handleWebSocket: WebSocket отключен", "user_id", userID)
 		conn.Close()
-		delete(clients, userID)
+		clientsMu.Lock()
+		if clients[userID] == conn {
+			delete(clients, userID)
+		}
+		clientsMu.Unlock()
 	}()
 	for {
 		_, _, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("handleWebSocket: Ошибка чтения WebSocket для пользователя %d: %v", userID, err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.WarnContext(c, "handleWebSocket: Ошибка чтения WebSocket", "user_id", userID, "error", err)
+			}
 			break
 		}
 	}
 }
 
-func sendToUser(userID int, message []byte) {
+func sendEvent(ctx context.Context, userID int, eventType string, data interface{}) {
+	msg, err := json.Marshal(map[string]interface{}{
+		"type":       eventType,
+		"data":       data,
+		"request_id": requestIDFrom(ctx),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "sendEvent: Ошибка marshal события", "type", eventType, "error", err)
+		return
+	}
+	sendToUser(ctx, userID, msg)
+}
+
+func sendToUser(ctx context.Context, userID int, message []byte) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
 	if conn, ok := clients[userID]; ok {
 		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("sendToUser: Ошибка отправки WebSocket сообщения пользователю %d: %v", userID, err)
+			slog.WarnContext(ctx, "sendToUser: Ошибка отправки WebSocket сообщения", "user_id", userID, "error", err)
 			conn.Close()
 			delete(clients, userID)
 		}
 	} else {
-		log.Printf("sendToUser: Клиент %d не подключен", userID)
+		slog.DebugContext(ctx, "sendToUser: Клиент не подключен", "user_id", userID)
 	}
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ginParam = regexp.MustCompile(`[:*]([A-Za-z_]+)`)
+
+// Каждый зарегистрированный маршрут должен быть описан в openapi.json.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg = Config{FrontendURL: "http://localhost:3000", MetricsToken: "test-metrics-token"}
+	router := setupRouter()
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	for _, route := range router.Routes() {
+		// Статика аватаров не является частью API
+		if strings.HasPrefix(route.Path, "/avatars/") {
+			continue
+		}
+		path := ginParam.ReplaceAllString(route.Path, "{$1}")
+		methods, ok := spec.Paths[path]
+		if !ok {
+			t.Errorf("%s %s: путь отсутствует в openapi.json", route.Method, path)
+			continue
+		}
+		if _, ok := methods[strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s: метод отсутствует в openapi.json", route.Method, path)
+		}
+	}
+}
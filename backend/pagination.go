@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// pageKey — позиция записи в сортировке: время или число (в зависимости
+// от keyset) и ID для однозначности.
+type pageKey struct {
+	Time time.Time `json:"t,omitzero"`
+	Num  float64   `json:"n,omitempty"`
+	ID   int       `json:"id"`
+}
+
+// pageCursor — непрозрачный курсор. Prev означает страницу перед Key,
+// иначе страницу после Key.
+type pageCursor struct {
+	Key  pageKey `json:"k"`
+	Prev bool    `json:"p,omitempty"`
+}
+
+type page struct {
+	Limit  int
+	Cursor *pageCursor
+}
+
+// keyset описывает колонки сортировки. По умолчанию записи идут по убыванию
+// (Col, IDCol), Numeric означает, что в курсоре хранится Num, а не Time.
+type keyset struct {
+	Col     string
+	IDCol   string
+	Asc     bool
+	Numeric bool
+}
+
+func timeKey(t time.Time, id int) pageKey { return pageKey{Time: t, ID: id} }
+
+func numKey(n float64, id int) pageKey { return pageKey{Num: n, ID: id} }
+
+var newestFirst = keyset{Col: "created_at", IDCol: "id"}
+
+func (ks keyset) order(asc bool) string {
+	dir := "DESC"
+	if asc {
+		dir = "ASC"
+	}
+	return fmt.Sprintf("%s %s, %s %s", ks.Col, dir, ks.IDCol, dir)
+}
+
+func (ks keyset) value(k pageKey) any {
+	if ks.Numeric {
+		return k.Num
+	}
+	return k.Time
+}
+
+func encodeCursor(cur pageCursor) string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur pageCursor
+	if err := json.Unmarshal(raw, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
+
+// parsePage читает limit и cursor из query. Слишком большой limit
+// ограничивается maxPageLimit.
+func parsePage(c *gin.Context) (page, *APIError) {
+	var query struct {
+		Limit  int    `form:"limit" binding:"omitempty,min=1"`
+		Cursor string `form:"cursor"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return page{}, bindError(err)
+	}
+	p := page{Limit: min(query.Limit, maxPageLimit)}
+	if p.Limit == 0 {
+		p.Limit = defaultPageLimit
+	}
+	if query.Cursor != "" {
+		cur, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return page{}, errInvalidCursor
+		}
+		p.Cursor = cur
+	}
+	return p, nil
+}
+
+// fetchPage выбирает одну страницу по ключу сортировки и выставляет заголовок
+// Link со ссылками next и prev. Результат всегда в порядке keyset.
+func fetchPage[T any](c *gin.Context, q *gorm.DB, p page, ks keyset, key func(T) pageKey) ([]T, error) {
+	backward := p.Cursor != nil && p.Cursor.Prev
+	// Страница назад выбирается в обратном порядке и затем разворачивается
+	asc := ks.Asc != backward
+	if p.Cursor != nil {
+		cmp := "<"
+		if asc {
+			cmp = ">"
+		}
+		q = q.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", ks.Col, ks.IDCol, cmp), ks.value(p.Cursor.Key), p.Cursor.Key.ID)
+	}
+	order := ks.order(asc)
+	var items []T
+	if err := q.Order(order).Limit(p.Limit + 1).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	hasMore := len(items) > p.Limit
+	if hasMore {
+		items = items[:p.Limit]
+	}
+	if backward {
+		slices.Reverse(items)
+	}
+	if len(items) == 0 {
+		return items, nil
+	}
+	var links []string
+	if hasMore || backward {
+		links = append(links, pageLink(c, p.Limit, pageCursor{Key: key(items[len(items)-1])}, "next"))
+	}
+	if p.Cursor != nil && (!backward || hasMore) {
+		links = append(links, pageLink(c, p.Limit, pageCursor{Key: key(items[0]), Prev: true}, "prev"))
+	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+	return items, nil
+}
+
+func pageLink(c *gin.Context, limit int, cur pageCursor, rel string) string {
+	u := *c.Request.URL
+	values := u.Query()
+	values.Set("limit", strconv.Itoa(limit))
+	values.Set("cursor", encodeCursor(cur))
+	u.RawQuery = values.Encode()
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.RequestURI(), rel)
+}
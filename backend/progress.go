@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LessonProgress — прохождение урока клиентом. Запись создаётся при первом
+// открытии урока и обновляется по мере просмотра.
+type LessonProgress struct {
+	ID            int        `json:"-" gorm:"primaryKey"`
+	UserID        int        `json:"-" gorm:"uniqueIndex:idx_lesson_progress_user_lesson;not null"`
+	LessonID      int        `json:"lesson_id" gorm:"uniqueIndex:idx_lesson_progress_user_lesson;not null"`
+	CourseID      int        `json:"-" gorm:"index;not null"`
+	VideoPosition int        `json:"video_position"` // секунды
+	StartedAt     time.Time  `json:"started_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// courseProgress — сводка прохождения курса одним клиентом.
+type courseProgress struct {
+	TotalLessons     int        `json:"total_lessons"`
+	CompletedLessons int        `json:"completed_lessons"`
+	Percent          int        `json:"percent"`
+	LastLessonID     *int       `json:"last_lesson_id,omitempty"`
+	LastActivityAt   *time.Time `json:"last_activity_at,omitempty"`
+}
+
+func progressPercent(completed, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return min(100, completed*100/total)
+}
+
+// loadCourseProgress считает прогресс пользователя по нескольким курсам
+// сразу. Уроки, удалённые после прохождения, не учитываются.
+func loadCourseProgress(tx *gorm.DB, userID int, courseIDs []int) (map[int]*courseProgress, error) {
+	out := make(map[int]*courseProgress, len(courseIDs))
+	if len(courseIDs) == 0 {
+		return out, nil
+	}
+	for _, id := range courseIDs {
+		out[id] = &courseProgress{}
+	}
+	var totals []struct {
+		CourseID int
+		Lessons  int
+	}
+	if err := tx.Model(&Lesson{}).Select("course_id, COUNT(*) AS lessons").Where("course_id IN ?", courseIDs).
+		Group("course_id").Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range totals {
+		out[t.CourseID].TotalLessons = t.Lessons
+	}
+	var done []struct {
+		CourseID       int
+		Completed      int
+		LastLessonID   int
+		LastActivityAt time.Time
+	}
+	err := tx.Raw(`
+		SELECT DISTINCT ON (p.course_id) p.course_id,
+		       COUNT(*) FILTER (WHERE p.completed_at IS NOT NULL) OVER (PARTITION BY p.course_id) AS completed,
+		       p.lesson_id AS last_lesson_id, p.updated_at AS last_activity_at
+		FROM lesson_progresses p JOIN lessons l ON l.id = p.lesson_id
+		WHERE p.user_id = ? AND p.course_id IN ?
+		ORDER BY p.course_id, p.updated_at DESC
+	`, userID, courseIDs).Scan(&done).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range done {
+		p := out[d.CourseID]
+		p.CompletedLessons = d.Completed
+		p.LastLessonID = &d.LastLessonID
+		p.LastActivityAt = &d.LastActivityAt
+	}
+	for _, p := range out {
+		p.Percent = progressPercent(p.CompletedLessons, p.TotalLessons)
+	}
+	return out, nil
+}
+
+// upsertLessonProgress создаёт или обновляет прогресс урока. Отметку
+// о завершении повторный просмотр не снимает.
+func upsertLessonProgress(tx *gorm.DB, userID int, lesson Lesson, videoPosition *int, completed bool) (LessonProgress, error) {
+	now := time.Now()
+	progress := LessonProgress{
+		UserID:    userID,
+		LessonID:  lesson.ID,
+		CourseID:  lesson.CourseID,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	updates := map[string]any{"updated_at": now}
+	if videoPosition != nil {
+		progress.VideoPosition = *videoPosition
+		updates["video_position"] = *videoPosition
+	}
+	if completed {
+		progress.CompletedAt = &now
+		updates["completed_at"] = gorm.Expr("COALESCE(lesson_progresses.completed_at, ?)", now)
+	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "lesson_id"}},
+		DoUpdates: clause.Assignments(updates),
+	}).Create(&progress).Error
+	if err != nil {
+		return progress, err
+	}
+	err = tx.Where("user_id = ? AND lesson_id = ?", userID, lesson.ID).First(&progress).Error
+	return progress, err
+}
+
+// saveLessonProgress отмечает урок начатым, сохраняет позицию видео и
+// при необходимости завершает урок. Тест и задание завершаются только по
+// результату проверки, completed для них игнорируется.
+func saveLessonProgress(c *gin.Context) {
+	if c.GetString("role") != "client" {
+		slog.WarnContext(c, "saveLessonProgress: Доступ запрещён")
+		respondError(c, errClientOnly)
+		return
+	}
+	lesson, _, ok := loadLesson(c, "saveLessonProgress")
+	if !ok {
+		return
+	}
+	var input struct {
+		VideoPosition *int `json:"video_position" binding:"omitempty,min=0"`
+		Completed     bool `json:"completed"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "saveLessonProgress: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	completed := input.Completed && lesson.Kind != lessonKindQuiz && lesson.Kind != lessonKindAssignment
+	progress, err := upsertLessonProgress(reqDB(c), c.GetInt("userID"), lesson, input.VideoPosition, completed)
+	if err != nil {
+		slog.ErrorContext(c, "saveLessonProgress: Ошибка сохранения прогресса", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.DebugContext(c, "saveLessonProgress: Прогресс сохранён", "lesson_id", lesson.ID, "completed", progress.CompletedAt != nil)
+	if completed {
+		issueCertificateIfComplete(c, progress.UserID, lesson.CourseID)
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+// resumePoint — урок, с которого клиенту стоит продолжить.
+type resumePoint struct {
+	LessonID      int    `json:"lesson_id"`
+	ModuleID      int    `json:"module_id"`
+	Title         string `json:"title"`
+	VideoPosition int    `json:"video_position"`
+}
+
+// nextLesson выбирает урок для продолжения: незавершённый последний
+// открытый урок, иначе первый незавершённый открытый урок после него,
+// иначе первый незавершённый открытый урок курса.
+func nextLesson(lessons []Lesson, byLesson map[int]LessonProgress, last *int, access lessonAccess) *resumePoint {
+	start := 0
+	if last != nil {
+		for i, l := range lessons {
+			if l.ID != *last {
+				continue
+			}
+			if p := byLesson[l.ID]; p.CompletedAt == nil {
+				return &resumePoint{LessonID: l.ID, ModuleID: l.ModuleID, Title: l.Title, VideoPosition: p.VideoPosition}
+			}
+			start = i + 1
+			break
+		}
+	}
+	for i := range lessons {
+		l := lessons[(start+i)%len(lessons)]
+		p, seen := byLesson[l.ID]
+		if (!seen || p.CompletedAt == nil) && access.released(l) {
+			return &resumePoint{LessonID: l.ID, ModuleID: l.ModuleID, Title: l.Title, VideoPosition: p.VideoPosition}
+		}
+	}
+	return nil
+}
+
+func getCourseProgress(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, "getCourseProgress: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return
+	}
+	userID := c.GetInt("userID")
+	var course Course
+	if err := reqDB(c).Unscoped().First(&course, id).Error; err != nil {
+		slog.WarnContext(c, "getCourseProgress: Курс не найден", "error", err)
+		respondError(c, errCourseNotFound)
+		return
+	}
+	access, err := courseLessonAccess(reqDB(c), course, userID, c.GetString("role"))
+	if err != nil {
+		slog.ErrorContext(c, "getCourseProgress: Ошибка проверки записи", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	// Прогресс ведётся только у записанных клиентов
+	if access.enrolledAt == nil {
+		slog.WarnContext(c, "getCourseProgress: Нет записи на курс", "course_id", course.ID)
+		respondError(c, errLessonRequiresEnrollment)
+		return
+	}
+	var modules []CourseModule
+	if err := reqDB(c).Preload("Lessons").Where("course_id = ?", course.ID).Find(&modules).Error; err != nil {
+		slog.ErrorContext(c, "getCourseProgress: Ошибка получения модулей", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	sortModules(modules)
+	var lessons []Lesson
+	for _, m := range modules {
+		lessons = append(lessons, m.Lessons...)
+	}
+	var records []LessonProgress
+	if err := reqDB(c).Where("user_id = ? AND course_id = ?", userID, course.ID).Find(&records).Error; err != nil {
+		slog.ErrorContext(c, "getCourseProgress: Ошибка получения прогресса", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	byLesson := make(map[int]LessonProgress, len(records))
+	for _, p := range records {
+		byLesson[p.LessonID] = p
+	}
+	summary := courseProgress{TotalLessons: len(lessons)}
+	items := make([]LessonProgress, 0, len(records))
+	for _, l := range lessons {
+		p, ok := byLesson[l.ID]
+		if !ok {
+			continue
+		}
+		items = append(items, p)
+		if p.CompletedAt != nil {
+			summary.CompletedLessons++
+		}
+		if summary.LastActivityAt == nil || p.UpdatedAt.After(*summary.LastActivityAt) {
+			summary.LastLessonID, summary.LastActivityAt = &p.LessonID, &p.UpdatedAt
+		}
+	}
+	summary.Percent = progressPercent(summary.CompletedLessons, summary.TotalLessons)
+	c.JSON(http.StatusOK, gin.H{
+		"course_id": course.ID,
+		"progress":  summary,
+		"continue":  nextLesson(lessons, byLesson, summary.LastLessonID, access),
+		"lessons":   items,
+	})
+}
+
+// clientProgress — строка отчёта нутрициолога о прохождении курса.
+type clientProgress struct {
+	UserID           int        `json:"user_id"`
+	FullName         string     `json:"full_name"`
+	AvatarURL        string     `json:"avatar_url"`
+	EnrolledAt       time.Time  `json:"enrolled_at"`
+	CompletedLessons int        `json:"completed_lessons"`
+	TotalLessons     int        `json:"total_lessons" gorm:"-"`
+	Percent          int        `json:"percent" gorm:"-"`
+	LastActivityAt   *time.Time `json:"last_activity_at"`
+}
+
+// getCourseClientsProgress показывает автору курса продвижение каждого
+// записанного клиента.
+func getCourseClientsProgress(c *gin.Context) {
+	course, ok := loadManagedCourse(c, "getCourseClientsProgress")
+	if !ok {
+		return
+	}
+	var total int64
+	if err := reqDB(c).Model(&Lesson{}).Where("course_id = ?", course.ID).Count(&total).Error; err != nil {
+		slog.ErrorContext(c, "getCourseClientsProgress: Ошибка подсчёта уроков", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	var rows []clientProgress
+	err := reqDB(c).Raw(`
+		SELECT u.id AS user_id, u.full_name, u.avatar_url, e.enrolled_at,
+		       COALESCE(p.completed, 0) AS completed_lessons, p.last_activity_at
+		FROM (SELECT user_id, MIN(created_at) AS enrolled_at FROM enrollments WHERE course_id = @course GROUP BY user_id) e
+		JOIN users u ON u.id = e.user_id
+		LEFT JOIN (
+			SELECT p.user_id, COUNT(*) FILTER (WHERE p.completed_at IS NOT NULL) AS completed, MAX(p.updated_at) AS last_activity_at
+			FROM lesson_progresses p JOIN lessons l ON l.id = p.lesson_id
+			WHERE p.course_id = @course
+			GROUP BY p.user_id
+		) p ON p.user_id = e.user_id
+		ORDER BY e.enrolled_at DESC
+	`, sql.Named("course", course.ID)).Scan(&rows).Error
+	if err != nil {
+		slog.ErrorContext(c, "getCourseClientsProgress: Ошибка получения прогресса", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if rows == nil {
+		rows = []clientProgress{}
+	}
+	for i := range rows {
+		rows[i].TotalLessons = int(total)
+		rows[i].Percent = progressPercent(rows[i].CompletedLessons, int(total))
+	}
+	c.JSON(http.StatusOK, rows)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const defaultPassScore = 70
+
+type IntArray []int
+
+func (ia *IntArray) Scan(value interface{}) error {
+	if value == nil {
+		*ia = []int{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to scan IntArray: expected []byte, got %T", value)
+	}
+	return json.Unmarshal(bytes, ia)
+}
+
+func (ia IntArray) Value() (driver.Value, error) {
+	if len(ia) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(ia)
+}
+
+// QuizQuestion — вопрос теста. Correct хранит индексы верных вариантов.
+type QuizQuestion struct {
+	ID       int         `json:"id" gorm:"primaryKey"`
+	LessonID int         `json:"-" gorm:"index;not null"`
+	Position int         `json:"position"`
+	Text     string      `json:"text"`
+	Multiple bool        `json:"multiple"`
+	Options  StringArray `json:"options" gorm:"type:jsonb"`
+	Correct  IntArray    `json:"correct,omitempty" gorm:"type:jsonb"`
+}
+
+type quizAnswer struct {
+	QuestionID int   `json:"question_id"`
+	Options    []int `json:"options"`
+	Correct    bool  `json:"correct"`
+}
+
+type quizAnswers []quizAnswer
+
+func (qa *quizAnswers) Scan(value interface{}) error {
+	if value == nil {
+		*qa = quizAnswers{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to scan quizAnswers: expected []byte, got %T", value)
+	}
+	return json.Unmarshal(bytes, qa)
+}
+
+func (qa quizAnswers) Value() (driver.Value, error) {
+	if len(qa) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(qa)
+}
+
+// QuizAttempt — попытка прохождения теста с результатами по вопросам.
+type QuizAttempt struct {
+	ID        int         `json:"id" gorm:"primaryKey"`
+	UserID    int         `json:"-" gorm:"index;not null"`
+	LessonID  int         `json:"lesson_id" gorm:"index;not null"`
+	CourseID  int         `json:"-" gorm:"index;not null"`
+	Answers   quizAnswers `json:"answers" gorm:"type:jsonb"`
+	Score     int         `json:"score"`
+	Passed    bool        `json:"passed"`
+	CreatedAt time.Time   `json:"created_at" gorm:"autoCreateTime"`
+}
+
+func passScore(l Lesson) int {
+	if l.PassScore == 0 {
+		return defaultPassScore
+	}
+	return l.PassScore
+}
+
+// gradeQuiz засчитывает вопрос, только если выбраны ровно верные варианты.
+func gradeQuiz(questions []QuizQuestion, selected map[int][]int) (quizAnswers, int) {
+	answers := make(quizAnswers, len(questions))
+	correct := 0
+	for i, q := range questions {
+		chosen := slices.Clone(selected[q.ID])
+		slices.Sort(chosen)
+		chosen = slices.Compact(chosen)
+		want := slices.Clone(q.Correct)
+		slices.Sort(want)
+		answers[i] = quizAnswer{QuestionID: q.ID, Options: chosen, Correct: slices.Equal(chosen, []int(want))}
+		if answers[i].Correct {
+			correct++
+		}
+	}
+	if len(questions) == 0 {
+		return answers, 0
+	}
+	return answers, correct * 100 / len(questions)
+}
+
+func loadQuizQuestions(tx *gorm.DB, lessonID int) ([]QuizQuestion, error) {
+	var questions []QuizQuestion
+	err := tx.Where("lesson_id = ?", lessonID).Order("position, id").Find(&questions).Error
+	return questions, err
+}
+
+// getQuiz возвращает вопросы теста. Верные ответы видит только автор курса.
+func getQuiz(c *gin.Context) {
+	lesson, access, ok := loadLesson(c, "getQuiz")
+	if !ok {
+		return
+	}
+	if lesson.Kind != lessonKindQuiz {
+		respondError(c, errNotAQuiz)
+		return
+	}
+	questions, err := loadQuizQuestions(reqDB(c), lesson.ID)
+	if err != nil {
+		slog.ErrorContext(c, "getQuiz: Ошибка получения вопросов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if !access.manage {
+		for i := range questions {
+			questions[i].Correct = nil
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"lesson_id": lesson.ID, "pass_score": passScore(lesson), "questions": questions})
+}
+
+// updateQuiz заменяет вопросы теста целиком.
+func updateQuiz(c *gin.Context) {
+	lesson, ok := loadManagedLesson(c, "updateQuiz")
+	if !ok {
+		return
+	}
+	if lesson.Kind != lessonKindQuiz {
+		respondError(c, errNotAQuiz)
+		return
+	}
+	var input struct {
+		PassScore int `json:"pass_score" binding:"omitempty,min=1,max=100"`
+		Questions []struct {
+			Text     string      `json:"text" binding:"required,notblank,max=1000"`
+			Multiple bool        `json:"multiple"`
+			Options  StringArray `json:"options" binding:"required,min=2,max=10,dive,notblank,max=500"`
+			Correct  []int       `json:"correct" binding:"required,min=1,dive,min=0,max=9"`
+		} `json:"questions" binding:"required,min=1,max=50,dive"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateQuiz: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	questions := make([]QuizQuestion, len(input.Questions))
+	var fields []FieldError
+	for i, q := range input.Questions {
+		field := fmt.Sprintf("questions[%d].correct", i)
+		for _, idx := range q.Correct {
+			if idx >= len(q.Options) {
+				fields = append(fields, FieldError{Field: field, Code: "lte", Param: fmt.Sprint(len(q.Options) - 1)})
+				break
+			}
+		}
+		if !q.Multiple && len(q.Correct) > 1 {
+			fields = append(fields, FieldError{Field: field, Code: "len", Param: "1"})
+		}
+		questions[i] = QuizQuestion{LessonID: lesson.ID, Position: i, Text: q.Text, Multiple: q.Multiple, Options: q.Options, Correct: q.Correct}
+	}
+	if len(fields) > 0 {
+		slog.WarnContext(c, "updateQuiz: Неверные ответы", "fields", len(fields))
+		respondError(c, errValidation.WithFields(fields...))
+		return
+	}
+	lesson.PassScore = input.PassScore
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("lesson_id = ?", lesson.ID).Delete(&QuizQuestion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Lesson{}).Where("id = ?", lesson.ID).Update("pass_score", lesson.PassScore).Error; err != nil {
+			return err
+		}
+		return tx.Create(&questions).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, "updateQuiz: Ошибка сохранения теста", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "updateQuiz: Тест сохранён", "lesson_id", lesson.ID, "questions", len(questions))
+	c.JSON(http.StatusOK, gin.H{"lesson_id": lesson.ID, "pass_score": passScore(lesson), "questions": questions})
+}
+
+// submitQuizAttempt проверяет ответы. Успешная попытка завершает урок.
+func submitQuizAttempt(c *gin.Context) {
+	if c.GetString("role") != "client" {
+		slog.WarnContext(c, "submitQuizAttempt: Доступ запрещён")
+		respondError(c, errClientOnly)
+		return
+	}
+	lesson, _, ok := loadLesson(c, "submitQuizAttempt")
+	if !ok {
+		return
+	}
+	if lesson.Kind != lessonKindQuiz {
+		respondError(c, errNotAQuiz)
+		return
+	}
+	var input struct {
+		Answers []struct {
+			QuestionID int   `json:"question_id" binding:"required"`
+			Options    []int `json:"options"`
+		} `json:"answers" binding:"required,max=50,dive"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "submitQuizAttempt: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	questions, err := loadQuizQuestions(reqDB(c), lesson.ID)
+	if err != nil {
+		slog.ErrorContext(c, "submitQuizAttempt: Ошибка получения вопросов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if len(questions) == 0 {
+		slog.WarnContext(c, "submitQuizAttempt: В тесте нет вопросов", "lesson_id", lesson.ID)
+		respondError(c, errQuizEmpty)
+		return
+	}
+	selected := make(map[int][]int, len(input.Answers))
+	for _, a := range input.Answers {
+		selected[a.QuestionID] = a.Options
+	}
+	answers, score := gradeQuiz(questions, selected)
+	userID := c.GetInt("userID")
+	attempt := QuizAttempt{
+		UserID:   userID,
+		LessonID: lesson.ID,
+		CourseID: lesson.CourseID,
+		Answers:  answers,
+		Score:    score,
+		Passed:   score >= passScore(lesson),
+	}
+	err = reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+		_, err := upsertLessonProgress(tx, userID, lesson, nil, attempt.Passed)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(c, "submitQuizAttempt: Ошибка сохранения попытки", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "submitQuizAttempt: Тест проверен", "lesson_id", lesson.ID, "score", score, "passed", attempt.Passed)
+	if attempt.Passed {
+		issueCertificateIfComplete(c, userID, lesson.CourseID)
+	}
+	c.JSON(http.StatusOK, attempt)
+}
+
+func getQuizAttempts(c *gin.Context) {
+	lesson, _, ok := loadLesson(c, "getQuizAttempts")
+	if !ok {
+		return
+	}
+	var attempts []QuizAttempt
+	err := reqDB(c).Where("user_id = ? AND lesson_id = ?", c.GetInt("userID"), lesson.ID).
+		Order("created_at DESC").Find(&attempts).Error
+	if err != nil {
+		slog.ErrorContext(c, "getQuizAttempts: Ошибка получения попыток", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, attempts)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	recommendationsInterval = time.Hour
+	recommendationsPerUser  = 20
+	defaultRecommendLimit   = 10
+
+	// Веса сигналов рекомендаций
+	coEnrollmentWeight = 3.0
+	servicesWeight     = 2.0
+	chatWeight         = 1.5
+)
+
+// Recommendation — предрасчитанная рекомендация курса пользователю.
+// Таблица полностью пересчитывается фоновой задачей.
+type Recommendation struct {
+	ID         int         `json:"-" gorm:"primaryKey"`
+	UserID     int         `json:"-" gorm:"index"`
+	CourseID   int         `json:"course_id"`
+	Score      float64     `json:"score"`
+	Reasons    StringArray `json:"reasons" gorm:"type:jsonb"`
+	ComputedAt time.Time   `json:"computed_at"`
+	Course     Course      `json:"course" gorm:"foreignKey:CourseID"`
+}
+
+type recommendInput struct {
+	enrolled       map[int]map[int]bool // пользователь -> курсы
+	courseUsers    map[int][]int        // курс -> пользователи
+	courseServices map[int][]string
+	courseTeacher  map[int]int
+	available      map[int]bool // опубликованные и не удалённые курсы
+	teacherCourses map[int][]int
+	chats          map[int]map[int]int // пользователь -> нутрициолог -> сообщений
+}
+
+func loadRecommendInput(ctx context.Context) (*recommendInput, error) {
+	tx := db.WithContext(ctx)
+	in := &recommendInput{
+		enrolled:       make(map[int]map[int]bool),
+		courseUsers:    make(map[int][]int),
+		courseServices: make(map[int][]string),
+		courseTeacher:  make(map[int]int),
+		available:      make(map[int]bool),
+		teacherCourses: make(map[int][]int),
+		chats:          make(map[int]map[int]int),
+	}
+	// Удалённые и архивные курсы нужны для профиля интересов, но не рекомендуются
+	var courses []Course
+	if err := tx.Unscoped().Select("id", "teacher_id", "services", "status", "deleted_at").Find(&courses).Error; err != nil {
+		return nil, err
+	}
+	for _, c := range courses {
+		in.courseServices[c.ID] = c.Services
+		in.courseTeacher[c.ID] = c.TeacherID
+		in.teacherCourses[c.TeacherID] = append(in.teacherCourses[c.TeacherID], c.ID)
+		in.available[c.ID] = c.Status == courseStatusPublished && !c.DeletedAt.Valid
+	}
+	var enrollments []Enrollment
+	if err := tx.Select("user_id", "course_id").Find(&enrollments).Error; err != nil {
+		return nil, err
+	}
+	for _, e := range enrollments {
+		if in.enrolled[e.UserID] == nil {
+			in.enrolled[e.UserID] = make(map[int]bool)
+		}
+		if !in.enrolled[e.UserID][e.CourseID] {
+			in.enrolled[e.UserID][e.CourseID] = true
+			in.courseUsers[e.CourseID] = append(in.courseUsers[e.CourseID], e.UserID)
+		}
+	}
+	// Переписка с нутрициологом в любую сторону
+	var chats []struct {
+		UserID   int
+		NutriID  int
+		Messages int
+	}
+	err := tx.Raw(`
+		SELECT CASE WHEN s.role = 'nutri' THEN m.receiver_id ELSE m.sender_id END AS user_id,
+		       CASE WHEN s.role = 'nutri' THEN m.sender_id ELSE m.receiver_id END AS nutri_id,
+		       COUNT(*) AS messages
+		FROM messages m
+		JOIN users s ON s.id = m.sender_id
+		JOIN users r ON r.id = m.receiver_id
+		WHERE (s.role = 'nutri') <> (r.role = 'nutri')
+		GROUP BY 1, 2
+	`).Scan(&chats).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chats {
+		if in.chats[ch.UserID] == nil {
+			in.chats[ch.UserID] = make(map[int]int)
+		}
+		in.chats[ch.UserID][ch.NutriID] += ch.Messages
+	}
+	return in, nil
+}
+
+type courseScore struct {
+	score   float64
+	reasons map[string]bool
+}
+
+// recommendFor считает рекомендации одного пользователя:
+//   - совместные записи: косинусная близость курсов по общим ученикам;
+//   - услуги: доля услуг курса, встречающихся в курсах пользователя;
+//   - переписка: курсы нутрициологов, с которыми пользователь общался.
+func (in *recommendInput) recommendFor(userID int) map[int]*courseScore {
+	enrolled := in.enrolled[userID]
+	scores := make(map[int]*courseScore)
+	add := func(courseID int, score float64, reason string) {
+		if enrolled[courseID] || score <= 0 || !in.available[courseID] || in.courseTeacher[courseID] == userID {
+			return
+		}
+		s := scores[courseID]
+		if s == nil {
+			s = &courseScore{reasons: make(map[string]bool)}
+			scores[courseID] = s
+		}
+		s.score += score
+		s.reasons[reason] = true
+	}
+
+	profile := make(map[string]int)
+	for courseID := range enrolled {
+		for _, service := range in.courseServices[courseID] {
+			profile[normalizeQuery(service)]++
+		}
+		cooccur := make(map[int]int)
+		for _, other := range in.courseUsers[courseID] {
+			if other == userID {
+				continue
+			}
+			for d := range in.enrolled[other] {
+				cooccur[d]++
+			}
+		}
+		for d, n := range cooccur {
+			norm := math.Sqrt(float64(len(in.courseUsers[courseID]) * len(in.courseUsers[d])))
+			add(d, coEnrollmentWeight*float64(n)/norm, "co_enrollment")
+		}
+	}
+	if len(profile) > 0 {
+		for courseID, services := range in.courseServices {
+			if len(services) == 0 {
+				continue
+			}
+			shared := 0
+			for _, service := range services {
+				if profile[normalizeQuery(service)] > 0 {
+					shared++
+				}
+			}
+			add(courseID, servicesWeight*float64(shared)/float64(len(services)), "services")
+		}
+	}
+	for nutriID, messages := range in.chats[userID] {
+		for _, courseID := range in.teacherCourses[nutriID] {
+			add(courseID, chatWeight*(1+math.Log(float64(messages))), "chat")
+		}
+	}
+	return scores
+}
+
+// computeRecommendations пересчитывает рекомендации всех пользователей,
+// у которых есть записи на курсы или переписка с нутрициологами.
+func computeRecommendations(ctx context.Context) error {
+	start := time.Now()
+	in, err := loadRecommendInput(ctx)
+	if err != nil {
+		return err
+	}
+	users := make(map[int]bool)
+	for userID := range in.enrolled {
+		users[userID] = true
+	}
+	for userID := range in.chats {
+		users[userID] = true
+	}
+	var recs []Recommendation
+	for userID := range users {
+		scores := in.recommendFor(userID)
+		ids := make([]int, 0, len(scores))
+		for courseID := range scores {
+			ids = append(ids, courseID)
+		}
+		slices.SortFunc(ids, func(a, b int) int {
+			if c := cmp.Compare(scores[b].score, scores[a].score); c != 0 {
+				return c
+			}
+			return cmp.Compare(a, b)
+		})
+		for _, courseID := range ids[:min(len(ids), recommendationsPerUser)] {
+			reasons := make(StringArray, 0, len(scores[courseID].reasons))
+			for reason := range scores[courseID].reasons {
+				reasons = append(reasons, reason)
+			}
+			slices.Sort(reasons)
+			recs = append(recs, Recommendation{
+				UserID:     userID,
+				CourseID:   courseID,
+				Score:      math.Round(scores[courseID].score*1000) / 1000,
+				Reasons:    reasons,
+				ComputedAt: start,
+			})
+		}
+	}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&Recommendation{}).Error; err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return nil
+		}
+		return tx.Omit(clause.Associations).CreateInBatches(recs, 500).Error
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("computeRecommendations: Рекомендации пересчитаны", "users", len(users), "recommendations", len(recs),
+		"duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// popularCourses — запасной вариант для пользователей без истории.
+func popularCourses(tx *gorm.DB, userID, limit int) ([]Recommendation, error) {
+	var rows []struct {
+		ID          int
+		Enrollments int
+	}
+	err := tx.Raw(`
+		SELECT c.id, COUNT(e.id) AS enrollments
+		FROM courses c LEFT JOIN enrollments e ON e.course_id = c.id
+		WHERE c.deleted_at IS NULL AND c.status = 'published'
+		  AND c.teacher_id <> ? AND c.id NOT IN (SELECT course_id FROM enrollments WHERE user_id = ?)
+		GROUP BY c.id ORDER BY enrollments DESC, c.id DESC LIMIT ?
+	`, userID, userID, limit).Scan(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	ids := make([]int, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	var courses []Course
+	if err := tx.Preload("Teacher", publicUserFields).Where("id IN ?", ids).Find(&courses).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[int]Course, len(courses))
+	for _, course := range courses {
+		byID[course.ID] = course
+	}
+	recs := make([]Recommendation, 0, len(rows))
+	for _, row := range rows {
+		recs = append(recs, Recommendation{
+			UserID:   userID,
+			CourseID: row.ID,
+			Score:    float64(row.Enrollments),
+			Reasons:  StringArray{"popular"},
+			Course:   byID[row.ID],
+		})
+	}
+	return recs, nil
+}
+
+func getRecommendations(c *gin.Context) {
+	userID := c.GetInt("userID")
+	var input struct {
+		Limit int `form:"limit" binding:"omitempty,min=1,max=20"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		slog.WarnContext(c, "getRecommendations: Неверные параметры", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	if input.Limit == 0 {
+		input.Limit = defaultRecommendLimit
+	}
+	var recs []Recommendation
+	// Записи, сделанные после пересчёта, и снятые с публикации курсы отсеиваем сразу
+	err := reqDB(c).Preload("Course.Teacher", publicUserFields).
+		Where("user_id = ? AND course_id NOT IN (SELECT course_id FROM enrollments WHERE user_id = ?)", userID, userID).
+		Where("course_id IN (?)", reqDB(c).Model(&Course{}).Scopes(publishedCourses).Select("id")).
+		Order("score DESC, course_id").Limit(input.Limit).Find(&recs).Error
+	if err != nil {
+		slog.ErrorContext(c, "getRecommendations: Ошибка получения рекомендаций", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if len(recs) == 0 {
+		if recs, err = popularCourses(reqDB(c), userID, input.Limit); err != nil {
+			slog.ErrorContext(c, "getRecommendations: Ошибка получения популярных курсов", "error", err)
+			respondError(c, errInternal)
+			return
+		}
+		if recs == nil {
+			recs = []Recommendation{}
+		}
+	}
+	slog.DebugContext(c, "getRecommendations: Возвращены рекомендации", "user_id", userID, "count", len(recs))
+	c.JSON(http.StatusOK, recs)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage хранит файлы в S3-совместимом хранилище (AWS S3, MinIO).
+// Временные ссылки подписываются самим хранилищем и ведут напрямую в него.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage(ctx context.Context) (s3Storage, error) {
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil {
+		return s3Storage{}, err
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: endpoint.Scheme == "https",
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return s3Storage{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, cfg.S3Bucket)
+	if err != nil {
+		return s3Storage{}, err
+	}
+	// Для локального MinIO бакет создаём сами
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.S3Bucket, minio.MakeBucketOptions{Region: cfg.S3Region}); err != nil {
+			return s3Storage{}, fmt.Errorf("Ошибка создания бакета %s: %w", cfg.S3Bucket, err)
+		}
+	}
+	return s3Storage{client: client, bucket: cfg.S3Bucket}, nil
+}
+
+// s3Error приводит отсутствие объекта к fs.ErrNotExist.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case minio.NoSuchKey, "NotFound":
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+func (s s3Storage) Put(ctx context.Context, key string, r io.Reader) error {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return err
+	}
+	// Известный размер позволяет загрузить файл без буферизации частей
+	size := int64(-1)
+	if seeker, ok := r.(io.Seeker); ok {
+		if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+			if start, err := seeker.Seek(0, io.SeekStart); err == nil {
+				size = end - start
+			}
+		}
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	})
+	return err
+}
+
+func (s s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject не обращается к хранилищу до первого чтения
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+func (s s3Storage) Size(ctx context.Context, key string) (int64, error) {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, s3Error(err)
+	}
+	return info.Size, nil
+}
+
+func (s s3Storage) Delete(ctx context.Context, key string) error {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s s3Storage) DeletePrefix(ctx context.Context, prefix string) error {
+	prefix, err := cleanStorageKey(prefix)
+	if err != nil {
+		return err
+	}
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix + "/", Recursive: true})
+	for e := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if e.Err != nil {
+			return e.Err
+		}
+	}
+	return nil
+}
+
+func (s s3Storage) PresignGet(ctx context.Context, key, name string, ttl time.Duration) (string, error) {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	if name != "" {
+		params.Set("response-content-disposition", attachmentDisposition(name))
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, ttl, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s s3Storage) PresignPut(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.client.PresignedPutObject(ctx, s.bucket, key, ttl)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
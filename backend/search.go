@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Маркеры подсветки заменяются на <mark> уже после экранирования HTML,
+// чтобы пользовательский текст не попадал в ответ как разметка.
+const (
+	highlightStart  = "\x02"
+	highlightStop   = "\x03"
+	headlineOptions = "StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", MaxFragments=2, MaxWords=25, MinWords=8"
+)
+
+var byRank = keyset{Col: "rank", IDCol: "id", Numeric: true}
+
+// migrateSearch добавляет tsvector-колонки и индексы, которых нет в моделях.
+// Колонки генерируемые, поэтому обновляются самой БД при изменении записи.
+func migrateSearch(db *gorm.DB) error {
+	stmts := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`ALTER TABLE courses ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('russian', coalesce(title, '')), 'A') ||
+			setweight(jsonb_to_tsvector('russian', coalesce(services, '[]'::jsonb), '["string"]'), 'B') ||
+			setweight(to_tsvector('russian', coalesce(description, '')), 'C')
+		) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_courses_search_vector ON courses USING GIN (search_vector)`,
+		`CREATE INDEX IF NOT EXISTS idx_courses_title_trgm ON courses USING GIN (title gin_trgm_ops)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('russian', coalesce(full_name, '')), 'A') ||
+			setweight(jsonb_to_tsvector('russian', coalesce(services, '[]'::jsonb), '["string"]'), 'B') ||
+			setweight(to_tsvector('russian', coalesce(description, '')), 'C')
+		) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_users_search_vector ON users USING GIN (search_vector)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_full_name_trgm ON users USING GIN (full_name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_courses_service_ids ON courses USING GIN (service_ids)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_service_ids ON users USING GIN (service_ids)`,
+	}
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("Ошибка миграции поиска: %w", err)
+		}
+	}
+	return nil
+}
+
+type searchHit struct {
+	ID      int
+	Rank    float64
+	Snippet string
+}
+
+type courseHit struct {
+	Course
+	Rating          float64 `json:"rating"`
+	EnrollmentCount int     `json:"enrollment_count"`
+	Rank            float64 `json:"rank,omitempty"`
+	Snippet         string  `json:"snippet,omitempty"`
+}
+
+// nutriCard — публичная карточка нутрициолога в выдаче поиска. User целиком
+// отдавать нельзя: в нём хеш пароля, баланс и данные карты.
+type nutriCard struct {
+	ID          int           `json:"id"`
+	Username    string        `json:"username"`
+	FullName    string        `json:"full_name"`
+	Description string        `json:"description"`
+	AvatarURL   string        `json:"avatar_url"`
+	Avatars     ImageVariants `json:"avatar_variants"`
+	Services    StringArray   `json:"services"`
+	ServiceIDs  IntArray      `json:"service_ids"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+type nutriHit struct {
+	nutriCard
+	Rank    float64 `json:"rank,omitempty"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// fullTextQuery ищет по tsvector и, для опечаток, по триграммам названия.
+// Ранг складывается из ts_rank_cd и похожести названия на запрос.
+func fullTextQuery(tx *gorm.DB, table, titleCol, where, q string) *gorm.DB {
+	return tx.Raw(fmt.Sprintf(`
+		SELECT t.id,
+		       (ts_rank_cd(t.search_vector, query) + word_similarity(@q, t.%[2]s))::float8 AS rank,
+		       ts_headline('russian', coalesce(nullif(t.description, ''), t.%[2]s), query, @opts) AS snippet
+		FROM %[1]s t, websearch_to_tsquery('russian', @q) query
+		WHERE (t.search_vector @@ query OR @q <%% t.%[2]s) %[3]s
+	`, table, titleCol, where), sql.Named("q", q), sql.Named("opts", headlineOptions))
+}
+
+func fetchHits(c *gin.Context, inner *gorm.DB, p page) ([]searchHit, error) {
+	return fetchPage(c, reqDB(c).Table("(?) AS hits", inner), p, byRank,
+		func(h searchHit) pageKey { return numKey(h.Rank, h.ID) })
+}
+
+func hitIDs(hits []searchHit) []int {
+	ids := make([]int, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+func renderSnippet(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightStart, "<mark>")
+	return strings.ReplaceAll(s, highlightStop, "</mark>")
+}
+
+// courseFilter — фильтры и сортировка поиска курсов.
+type courseFilter struct {
+	Query       string   `form:"q"`
+	MinPrice    float64  `form:"min_price" binding:"omitempty,gte=0"`
+	MaxPrice    float64  `form:"max_price" binding:"omitempty,gte=0"`
+	Services    []string `form:"service" binding:"max=10"`
+	ServiceIDs  []int    `form:"service_id" binding:"max=10,dive,gt=0"`
+	CategoryID  int      `form:"category_id" binding:"omitempty,gt=0"`
+	NutriID     int      `form:"nutri_id" binding:"omitempty,gt=0"`
+	MinRating   float64  `form:"min_rating" binding:"omitempty,min=1,max=5"`
+	MinDuration int      `form:"min_duration" binding:"omitempty,min=1"`
+	MaxDuration int      `form:"max_duration" binding:"omitempty,min=1"`
+	Format      string   `form:"format" binding:"omitempty,oneof=self_paced group individual"`
+	Sort        string   `form:"sort" binding:"omitempty,oneof=relevance price_asc price_desc newest rating popular"`
+	Facets      bool     `form:"facets"`
+}
+
+// courseCond — условие фильтра. Фасет измерения dim считается по всем
+// условиям, кроме собственного, чтобы показывать альтернативы выбранному.
+type courseCond struct {
+	dim  string
+	sql  string
+	args []any
+}
+
+func (f courseFilter) conds() []courseCond {
+	var conds []courseCond
+	if f.MinPrice > 0 {
+		conds = append(conds, courseCond{"price", "cs.price >= ?", []any{f.MinPrice}})
+	}
+	if f.MaxPrice > 0 {
+		conds = append(conds, courseCond{"price", "cs.price <= ?", []any{f.MaxPrice}})
+	}
+	if len(f.Services) > 0 {
+		services, _ := json.Marshal(f.Services)
+		conds = append(conds, courseCond{"services", "cs.services @> ?::jsonb", []any{string(services)}})
+	}
+	if len(f.ServiceIDs) > 0 {
+		ids, _ := json.Marshal(f.ServiceIDs)
+		conds = append(conds, courseCond{"service_ids", "cs.service_ids @> ?::jsonb", []any{string(ids)}})
+	}
+	// Раздел включает курсы всех вложенных разделов
+	if f.CategoryID > 0 {
+		conds = append(conds, courseCond{"category", "cs.category_id IN (" + categorySubtree + ")", []any{f.CategoryID}})
+	}
+	if f.NutriID > 0 {
+		conds = append(conds, courseCond{"nutri", "cs.teacher_id = ?", []any{f.NutriID}})
+	}
+	if f.MinRating > 0 {
+		conds = append(conds, courseCond{"rating", "cs.rating >= ?", []any{f.MinRating}})
+	}
+	if f.MinDuration > 0 {
+		conds = append(conds, courseCond{"duration", "cs.duration_weeks >= ?", []any{f.MinDuration}})
+	}
+	if f.MaxDuration > 0 {
+		conds = append(conds, courseCond{"duration", "cs.duration_weeks BETWEEN 1 AND ?", []any{f.MaxDuration}})
+	}
+	if f.Format != "" {
+		conds = append(conds, courseCond{"format", "cs.format = ?", []any{f.Format}})
+	}
+	return conds
+}
+
+var courseSorts = map[string]keyset{
+	"relevance":  byRank,
+	"newest":     {Col: "created_at", IDCol: "id"},
+	"price_asc":  {Col: "price", IDCol: "id", Asc: true, Numeric: true},
+	"price_desc": {Col: "price", IDCol: "id", Numeric: true},
+	"rating":     {Col: "rating", IDCol: "id", Numeric: true},
+	"popular":    {Col: "enrollment_count", IDCol: "id", Numeric: true},
+}
+
+// courseRow — курс с посчитанными полями для фильтров, сортировки и фасетов.
+type courseRow struct {
+	ID              int
+	CreatedAt       time.Time
+	Price           float64
+	Rating          float64
+	EnrollmentCount int
+	Rank            float64
+	Snippet         string
+}
+
+func (r courseRow) key(sort string) pageKey {
+	switch sort {
+	case "relevance":
+		return numKey(r.Rank, r.ID)
+	case "price_asc", "price_desc":
+		return numKey(r.Price, r.ID)
+	case "rating":
+		return numKey(r.Rating, r.ID)
+	case "popular":
+		return numKey(float64(r.EnrollmentCount), r.ID)
+	}
+	return timeKey(r.CreatedAt, r.ID)
+}
+
+// courseStatsQuery — курсы с ценой, рейтингом, числом записей и, если есть
+// запрос, релевантностью. Используется как подзапрос cs.
+func courseStatsQuery(tx *gorm.DB, q string) *gorm.DB {
+	rank, snippet, match, from := "0::float8", "''", "TRUE", ""
+	if q != "" {
+		rank = "(ts_rank_cd(c.search_vector, query) + word_similarity(@q, c.title))::float8"
+		snippet = "ts_headline('russian', coalesce(nullif(c.description, ''), c.title), query, @opts)"
+		match = "(c.search_vector @@ query OR @q <% c.title)"
+		from = "CROSS JOIN websearch_to_tsquery('russian', @q) query"
+	}
+	return tx.Raw(`
+		SELECT c.id, c.created_at, c.teacher_id, c.services, c.service_ids, c.category_id, c.format, c.duration_weeks,
+		       c.gross_price::float8 AS price,
+		       COALESCE(r.rating, 0)::float8 AS rating,
+		       COALESCE(e.enrollment_count, 0) AS enrollment_count,
+		       `+rank+` AS rank,
+		       `+snippet+` AS snippet
+		FROM courses c `+from+`
+		LEFT JOIN (SELECT course_id, AVG(rating) AS rating FROM reviews WHERE rating > 0 GROUP BY course_id) r ON r.course_id = c.id
+		LEFT JOIN (SELECT course_id, COUNT(*) AS enrollment_count FROM enrollments GROUP BY course_id) e ON e.course_id = c.id
+		WHERE c.deleted_at IS NULL AND c.status = 'published' AND `+match, sql.Named("q", q), sql.Named("opts", headlineOptions))
+}
+
+func filteredCourses(c *gin.Context, f courseFilter, except string) *gorm.DB {
+	q := reqDB(c).Table("(?) AS cs", courseStatsQuery(reqDB(c), f.Query))
+	for _, cond := range f.conds() {
+		if cond.dim != except {
+			q = q.Where(cond.sql, cond.args...)
+		}
+	}
+	return q
+}
+
+func searchCourses(c *gin.Context) {
+	var filter courseFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		slog.WarnContext(c, "searchCourses: Неверные параметры поиска", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	filter.Query = strings.TrimSpace(filter.Query)
+	if filter.Sort == "" || (filter.Sort == "relevance" && filter.Query == "") {
+		filter.Sort = "newest"
+		if filter.Query != "" {
+			filter.Sort = "relevance"
+		}
+	}
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "searchCourses: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	rows, err := fetchPage(c, filteredCourses(c, filter, ""), page, courseSorts[filter.Sort],
+		func(r courseRow) pageKey { return r.key(filter.Sort) })
+	if err != nil {
+		slog.ErrorContext(c, "searchCourses: Ошибка поиска курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	ids := make([]int, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	var courses []Course
+	if err := reqDB(c).Preload("Teacher", publicUserFields).Where("id IN ?", ids).Find(&courses).Error; err != nil {
+		slog.ErrorContext(c, "searchCourses: Ошибка загрузки курсов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	byID := make(map[int]Course, len(courses))
+	for _, course := range courses {
+		byID[course.ID] = course
+	}
+	results := make([]courseHit, 0, len(rows))
+	for _, row := range rows {
+		if course, ok := byID[row.ID]; ok {
+			results = append(results, courseHit{
+				Course:          course,
+				Rating:          row.Rating,
+				EnrollmentCount: row.EnrollmentCount,
+				Rank:            row.Rank,
+				Snippet:         renderSnippet(row.Snippet),
+			})
+		}
+	}
+	slog.DebugContext(c, "searchCourses: Найдены курсы", "query", filter.Query, "sort", filter.Sort, "count", len(results))
+	// Считаем только первую страницу результативных запросов
+	if filter.Query != "" && page.Cursor == nil && len(results) > 0 {
+		trackSearchQuery(c, filter.Query)
+	}
+	if !filter.Facets {
+		c.JSON(http.StatusOK, results)
+		return
+	}
+	facets, err := courseFacets(c, filter)
+	if err != nil {
+		slog.ErrorContext(c, "searchCourses: Ошибка подсчёта фасетов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": results, "facets": facets})
+}
+
+func searchNutris(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	page, apiErr := parsePage(c)
+	if apiErr != nil {
+		slog.WarnContext(c, "searchNutris: Неверные параметры страницы")
+		respondError(c, apiErr)
+		return
+	}
+	if query == "" {
+		slog.WarnContext(c, "searchNutris: Пустой запрос")
+		respondError(c, errValidation.WithFields(FieldError{Field: "q", Code: "required"}))
+		return
+	}
+	hits, err := fetchHits(c, fullTextQuery(reqDB(c), "users", "full_name", "AND t.role = 'nutri'", query), page)
+	if err != nil {
+		slog.ErrorContext(c, "searchNutris: Ошибка поиска нутрициологов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	var nutris []nutriCard
+	if err := reqDB(c).Model(&User{}).Where("id IN ?", hitIDs(hits)).Find(&nutris).Error; err != nil {
+		slog.ErrorContext(c, "searchNutris: Ошибка загрузки нутрициологов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	byID := make(map[int]nutriCard, len(nutris))
+	for _, nutri := range nutris {
+		byID[nutri.ID] = nutri
+	}
+	results := make([]nutriHit, 0, len(hits))
+	for _, h := range hits {
+		if nutri, ok := byID[h.ID]; ok {
+			results = append(results, nutriHit{nutriCard: nutri, Rank: h.Rank, Snippet: renderSnippet(h.Snippet)})
+		}
+	}
+	slog.DebugContext(c, "searchNutris: Найдены нутрициологи", "query", query, "count", len(results))
+	c.JSON(http.StatusOK, results)
+}
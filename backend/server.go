@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const shutdownTimeout = 15 * time.Second
+
+var (
+	shuttingDown atomic.Bool
+	jobsCtx      context.Context
+	stopJobs     context.CancelFunc
+	jobsWG       sync.WaitGroup
+)
+
+func init() {
+	jobsCtx, stopJobs = context.WithCancel(context.Background())
+}
+
+// startJob запускает фоновую задачу с заданным интервалом. Задача
+// останавливается при завершении сервера, текущий запуск дорабатывает до конца.
+func startJob(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	jobsWG.Add(1)
+	go func() {
+		defer jobsWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := fn(jobsCtx); err != nil && !errors.Is(err, context.Canceled) {
+				slog.Error("Ошибка фоновой задачи", "job", name, "error", err)
+			}
+			select {
+			case <-jobsCtx.Done():
+				slog.Info("Фоновая задача остановлена", "job", name)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// startBackgroundJobs запускает фоновые задачи HTTP-сервера. CLI-команды
+// их не запускают.
+func startBackgroundJobs() {
+	startJob("suggest-index", suggestCheckInterval, refreshSuggestIndex)
+	startJob("recommendations", recommendationsInterval, computeRecommendations)
+	if !cfg.mailConfigured() {
+		slog.Warn("SMTP не настроен, коды подарков не отправляются по почте")
+	}
+	startJob("gifts", giftCheckInterval, processGifts)
+	if _, err := exec.LookPath(cfg.FFmpegPath); err != nil {
+		slog.Warn("ffmpeg не найден, обработка видео отключена", "path", cfg.FFmpegPath, "error", err)
+	} else {
+		startJob("video-transcode", videoCheckInterval, processVideos)
+	}
+}
+
+func runServer(shutdownTracing func(context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// WebSocket-соединения захвачены у http.Server, Shutdown их не ждёт
+	srv.RegisterOnShutdown(closeClients)
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("Starting server", "port", cfg.Port, "env", cfg.Env)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("Получен сигнал завершения, останавливаем сервер")
+	shuttingDown.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	stopJobs()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("runServer: Ошибка завершения HTTP-сервера", "error", err)
+	}
+	jobsDone := make(chan struct{})
+	go func() {
+		jobsWG.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		slog.Warn("runServer: Фоновые задачи не завершились вовремя")
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("runServer: Ошибка отправки оставшихся трейсов", "error", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	slog.Info("Сервер остановлен")
+	return nil
+}
+
+func closeClients() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+	deadline := time.Now().Add(time.Second)
+	for userID, conn := range clients {
+		if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+			slog.Warn("closeClients: Ошибка отправки close frame", "user_id", userID, "error", err)
+		}
+		conn.Close()
+		delete(clients, userID)
+	}
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func readyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+	if shuttingDown.Load() {
+		checks["server"] = "shutting down"
+		ready = false
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+	// Текст ошибки драйвера содержит хост, пользователя и имя базы, поэтому
+	// наружу отдаётся только статус
+	if sqlDB, err := db.DB(); err != nil {
+		slog.ErrorContext(c, "readyz: Ошибка получения соединения с базой", "error", err)
+		checks["database"] = "unavailable"
+		ready = false
+	} else if err := sqlDB.PingContext(ctx); err != nil {
+		slog.ErrorContext(c, "readyz: База данных недоступна", "error", err)
+		checks["database"] = "unavailable"
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+	if cfg.paymentsConfigured() {
+		checks["payments"] = "ok"
+	} else {
+		// Без платежей в development и staging сервер работает, в production
+		// конфигурация их не допускает, так что проверка здесь информационная
+		// везде, кроме production.
+		checks["payments"] = "not configured"
+		ready = ready && cfg.Env != "production"
+	}
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ссылки на закрытые файлы короткие: обработчик выдаёт их после проверки
+// доступа и сразу перенаправляет клиента.
+const storageDownloadTTL = 5 * time.Minute
+
+// fileStorage хранит файлы по ключам вида "videos/12/hls/master.m3u8".
+// Отсутствующий файл возвращается как ошибка fs.ErrNotExist.
+type fileStorage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Size(ctx context.Context, key string) (int64, error)
+	Delete(ctx context.Context, key string) error
+	// DeletePrefix удаляет все файлы с ключами внутри prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+	// PresignGet возвращает временную ссылку на скачивание. Непустой name
+	// задаёт имя файла для сохранения.
+	PresignGet(ctx context.Context, key, name string, ttl time.Duration) (string, error)
+	// PresignPut возвращает временную ссылку для загрузки файла методом PUT.
+	PresignPut(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+var storage fileStorage = localStorage{root: "./uploads"}
+
+var errInvalidStorageKey = errors.New("недопустимый ключ хранилища")
+
+func initStorage() error {
+	switch cfg.StorageBackend {
+	case "s3":
+		s, err := newS3Storage(context.Background())
+		if err != nil {
+			return fmt.Errorf("Ошибка подключения к S3: %w", err)
+		}
+		storage = s
+	default:
+		storage = localStorage{root: cfg.StorageDir}
+	}
+	slog.Info("Хранилище файлов подключено", "backend", cfg.StorageBackend)
+	return nil
+}
+
+// cleanStorageKey не пускает ключи за пределы хранилища.
+func cleanStorageKey(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("%w: %q", errInvalidStorageKey, key)
+	}
+	return clean, nil
+}
+
+// signURL подписывает параметры временной ссылки секретом JWT.
+func signURL(parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.JWTSecret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func attachmentDisposition(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// localStorage хранит файлы на диске сервера. Временные ссылки ведут на
+// /api/files и проверяются по подписи.
+type localStorage struct {
+	root string
+}
+
+func (s localStorage) path(key string) (string, error) {
+	clean, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+// Put пишет во временный файл и переименовывает его, чтобы читатели не
+// видели файл частично записанным.
+func (s localStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (s localStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s localStorage) Size(ctx context.Context, key string) (int64, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s localStorage) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s localStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	p, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (s localStorage) PresignGet(ctx context.Context, key, name string, ttl time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, name, ttl)
+}
+
+func (s localStorage) PresignPut(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return s.presign(http.MethodPut, key, "", ttl)
+}
+
+func (s localStorage) presign(method, key, name string, ttl time.Duration) (string, error) {
+	clean, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{"expires": {expires}, "sig": {signURL("file", method, clean, name, expires)}}
+	if name != "" {
+		q.Set("name", name)
+	}
+	return "/api/files/" + clean + "?" + q.Encode(), nil
+}
+
+// checkFileSignature проверяет ссылку, выданную localStorage.presign.
+func checkFileSignature(c *gin.Context, fn string) (string, bool) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	want := signURL("file", c.Request.Method, key, c.Query("name"), c.Query("expires"))
+	if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(c.Query("sig")), []byte(want)) {
+		slog.WarnContext(c, fn+": Неверная или устаревшая подпись", "key", key)
+		respondError(c, errFileLinkInvalid)
+		return "", false
+	}
+	return key, true
+}
+
+// serveSignedFile отдаёт файл локального хранилища по временной ссылке.
+func serveSignedFile(c *gin.Context) {
+	key, ok := checkFileSignature(c, "serveSignedFile")
+	if !ok {
+		return
+	}
+	serveStoredFile(c, "serveSignedFile", key, c.Query("name"), "private, max-age=300")
+}
+
+// serveAvatar отдаёт аватары из хранилища. Имена файлов случайные и не
+// меняются, поэтому ответ можно кэшировать.
+func serveAvatar(c *gin.Context) {
+	serveStoredFile(c, "serveAvatar", avatarFilesDir+c.Param("file"), "", "public, max-age=86400")
+}
+
+// serveStoredFile отдаёт файл из хранилища через API. Непустой name задаёт
+// имя файла для сохранения.
+func serveStoredFile(c *gin.Context, fn, key, name, cacheControl string) {
+	file, err := storage.Open(c, key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errInvalidStorageKey) {
+			slog.WarnContext(c, fn+": Файл не найден", "key", key)
+			respondError(c, errFileNotFound)
+		} else {
+			slog.ErrorContext(c, fn+": Ошибка чтения файла", "error", err)
+			respondError(c, errInternal)
+		}
+		return
+	}
+	defer file.Close()
+	if name != "" {
+		c.Header("Content-Disposition", attachmentDisposition(name))
+	}
+	c.Header("Cache-Control", cacheControl)
+	c.Header("X-Content-Type-Options", "nosniff")
+	if rs, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, path.Base(key), time.Time{}, rs)
+		return
+	}
+	c.DataFromReader(http.StatusOK, -1, mime.TypeByExtension(path.Ext(key)), file, nil)
+}
+
+// receiveSignedFile принимает загрузку по ссылке из PresignPut.
+func receiveSignedFile(c *gin.Context) {
+	key, ok := checkFileSignature(c, "receiveSignedFile")
+	if !ok {
+		return
+	}
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxVideoUpload)
+	if err := storage.Put(c, key, body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			slog.WarnContext(c, "receiveSignedFile: Файл слишком большой", "key", key)
+			respondError(c, errVideoTooLarge)
+			return
+		}
+		slog.ErrorContext(c, "receiveSignedFile: Ошибка сохранения файла", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "receiveSignedFile: Файл загружен", "key", key)
+	c.Status(http.StatusOK)
+}
+
+// redirectToStoredFile перенаправляет на временную ссылку хранилища.
+// Доступ к файлу проверяет вызывающий обработчик.
+func redirectToStoredFile(c *gin.Context, fn, key, name string) {
+	link, err := storage.PresignGet(c, key, name, storageDownloadTTL)
+	if err != nil {
+		slog.ErrorContext(c, fn+": Ошибка получения ссылки на файл", "key", key, "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, link)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	suggestCheckInterval = 5 * time.Second
+	suggestMaxAge        = 10 * time.Minute
+	defaultSuggestLimit  = 8
+	maxSuggestLimit      = 20
+	maxTrackedQueryLen   = 100
+	popularQuerySeeds    = 200
+	// Запрос попадает в подсказки, только когда его искали столько разных
+	// пользователей или адресов: иначе любой может за пару запросов
+	// показать свой текст всем
+	minPopularQuerySearchers = 5
+)
+
+// SearchQuery — счётчик поисковых запросов, популярные запросы попадают
+// в подсказки. Searchers — число разных пользователей и адресов, искавших
+// запрос.
+type SearchQuery struct {
+	ID             int       `json:"id" gorm:"primaryKey"`
+	Query          string    `json:"query" gorm:"uniqueIndex;not null"`
+	Count          int       `json:"count" gorm:"default:0"`
+	Searchers      int       `json:"searchers" gorm:"default:0"`
+	LastSearchedAt time.Time `json:"last_searched_at"`
+}
+
+// SearchQuerySource — кто искал запрос: HMAC ID пользователя или IP-адреса
+// анонимного клиента. Нужен только для подсчёта Searchers.
+type SearchQuerySource struct {
+	Query  string `gorm:"primaryKey"`
+	Source string `gorm:"primaryKey"`
+}
+
+type suggestion struct {
+	Text string `json:"text"`
+	Kind string `json:"kind"`
+	ID   int    `json:"id,omitempty"`
+
+	weight float64
+	norm   string
+	tokens []string
+}
+
+type suggestToken struct {
+	token string
+	entry int
+}
+
+// suggestIndex неизменяем после построения, при обновлении заменяется целиком.
+type suggestIndex struct {
+	entries []suggestion
+	tokens  []suggestToken
+	builtAt time.Time
+}
+
+var (
+	suggestIdx   atomic.Pointer[suggestIndex]
+	suggestDirty atomic.Bool
+)
+
+func init() {
+	suggestDirty.Store(true)
+}
+
+func normalizeQuery(s string) string {
+	s = strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func newSuggestIndex(entries []suggestion) *suggestIndex {
+	idx := &suggestIndex{builtAt: time.Now()}
+	known := make(map[string]bool)
+	for i := range entries {
+		entries[i].norm = normalizeQuery(entries[i].Text)
+		if entries[i].Kind != "query" {
+			known[entries[i].norm] = true
+		}
+	}
+	for _, e := range entries {
+		// Популярный запрос, совпадающий с курсом или услугой, не нужен
+		if e.Kind == "query" && known[e.norm] {
+			continue
+		}
+		e.tokens = strings.Fields(e.norm)
+		for _, t := range e.tokens {
+			idx.tokens = append(idx.tokens, suggestToken{t, len(idx.entries)})
+		}
+		idx.entries = append(idx.entries, e)
+	}
+	slices.SortFunc(idx.tokens, func(a, b suggestToken) int { return strings.Compare(a.token, b.token) })
+	return idx
+}
+
+// lookup ищет записи, в которых каждое слово запроса является префиксом
+// какого-нибудь слова записи.
+func (idx *suggestIndex) lookup(q string, limit int) []suggestion {
+	words := strings.Fields(normalizeQuery(q))
+	if len(words) == 0 {
+		return idx.popular(limit)
+	}
+	longest := slices.MaxFunc(words, func(a, b string) int { return cmp.Compare(len(a), len(b)) })
+	start := sort.Search(len(idx.tokens), func(i int) bool { return idx.tokens[i].token >= longest })
+	seen := make(map[int]bool)
+	var found []suggestion
+	for i := start; i < len(idx.tokens) && strings.HasPrefix(idx.tokens[i].token, longest); i++ {
+		entry := idx.tokens[i].entry
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		if e := idx.entries[entry]; matchesAll(e.tokens, words) {
+			found = append(found, e)
+		}
+	}
+	phrase := strings.Join(words, " ")
+	score := func(e suggestion) float64 {
+		if strings.HasPrefix(e.norm, phrase) {
+			return e.weight * 2
+		}
+		return e.weight
+	}
+	slices.SortFunc(found, func(a, b suggestion) int {
+		if c := cmp.Compare(score(b), score(a)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Text, b.Text)
+	})
+	return dedupeSuggestions(found, limit)
+}
+
+func (idx *suggestIndex) popular(limit int) []suggestion {
+	var queries []suggestion
+	for _, e := range idx.entries {
+		if e.Kind == "query" {
+			queries = append(queries, e)
+		}
+	}
+	slices.SortFunc(queries, func(a, b suggestion) int { return cmp.Compare(b.weight, a.weight) })
+	return dedupeSuggestions(queries, limit)
+}
+
+func matchesAll(tokens, words []string) bool {
+	for _, w := range words {
+		if !slices.ContainsFunc(tokens, func(t string) bool { return strings.HasPrefix(t, w) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// dedupeSuggestions убирает повторы текста, например одинаковые названия
+// курсов разных нутрициологов.
+func dedupeSuggestions(found []suggestion, limit int) []suggestion {
+	out := make([]suggestion, 0, limit)
+	texts := make(map[string]bool)
+	for _, e := range found {
+		if texts[e.norm] {
+			continue
+		}
+		texts[e.norm] = true
+		out = append(out, e)
+		if len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+func buildSuggestIndex(ctx context.Context) (*suggestIndex, error) {
+	tx := db.WithContext(ctx)
+	var entries []suggestion
+	var courses []struct {
+		ID          int
+		Title       string
+		Enrollments int
+	}
+	err := tx.Raw(`SELECT c.id, c.title, (SELECT COUNT(*) FROM enrollments e WHERE e.course_id = c.id) AS enrollments
+		FROM courses c WHERE c.deleted_at IS NULL AND c.status = 'published'`).
+		Scan(&courses).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range courses {
+		entries = append(entries, suggestion{Text: c.Title, Kind: "course", ID: c.ID, weight: float64(1 + c.Enrollments)})
+	}
+	var services []struct {
+		Service string
+		Courses int
+	}
+	err = tx.Raw(`SELECT s.value AS service, COUNT(*) AS courses FROM courses c
+		CROSS JOIN LATERAL jsonb_array_elements_text(CASE WHEN jsonb_typeof(c.services) = 'array' THEN c.services ELSE '[]'::jsonb END) AS s(value)
+		WHERE c.deleted_at IS NULL AND c.status = 'published'
+		GROUP BY s.value`).Scan(&services).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		entries = append(entries, suggestion{Text: s.Service, Kind: "service", weight: float64(s.Courses)})
+	}
+	var nutris []struct {
+		ID       int
+		FullName string
+		Courses  int
+	}
+	err = tx.Raw(`SELECT u.id, u.full_name, (SELECT COUNT(*) FROM courses c WHERE c.teacher_id = u.id AND c.deleted_at IS NULL AND c.status = 'published') AS courses
+		FROM users u WHERE u.role = 'nutri' AND u.full_name <> ''`).Scan(&nutris).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nutris {
+		entries = append(entries, suggestion{Text: n.FullName, Kind: "nutri", ID: n.ID, weight: float64(1 + n.Courses)})
+	}
+	var queries []SearchQuery
+	if err := tx.Where("searchers >= ?", minPopularQuerySearchers).Order("searchers DESC").Limit(popularQuerySeeds).Find(&queries).Error; err != nil {
+		return nil, err
+	}
+	for _, q := range queries {
+		entries = append(entries, suggestion{Text: q.Query, Kind: "query", weight: float64(q.Searchers)})
+	}
+	return newSuggestIndex(entries), nil
+}
+
+// refreshSuggestIndex перестраивает индекс после изменений курсов и
+// пользователей, а также периодически, чтобы подхватить популярные запросы.
+func refreshSuggestIndex(ctx context.Context) error {
+	current := suggestIdx.Load()
+	if !suggestDirty.Swap(false) && current != nil && time.Since(current.builtAt) < suggestMaxAge {
+		return nil
+	}
+	idx, err := buildSuggestIndex(ctx)
+	if err != nil {
+		suggestDirty.Store(true)
+		return err
+	}
+	suggestIdx.Store(idx)
+	slog.Debug("refreshSuggestIndex: Индекс подсказок обновлён", "entries", len(idx.entries))
+	return nil
+}
+
+// registerSuggestInvalidation помечает индекс устаревшим при изменении
+// курсов и пользователей через модели.
+func registerSuggestInvalidation(db *gorm.DB) error {
+	invalidate := func(tx *gorm.DB) {
+		if tx.Error != nil || tx.Statement.RowsAffected == 0 {
+			return
+		}
+		switch tx.Statement.Table {
+		case "courses", "users", "enrollments":
+			suggestDirty.Store(true)
+		}
+	}
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().After("gorm:create").Register("suggest:after_create", invalidate),
+		cb.Update().After("gorm:update").Register("suggest:after_update", invalidate),
+		cb.Delete().After("gorm:delete").Register("suggest:after_delete", invalidate),
+	)
+}
+
+// trackSearchQuery увеличивает счётчик запроса, а счётчик искавших — только
+// для нового пользователя или адреса. Ошибка не мешает поиску.
+func trackSearchQuery(c *gin.Context, q string) {
+	q = normalizeQuery(q)
+	if q == "" || len([]rune(q)) > maxTrackedQueryLen {
+		return
+	}
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&SearchQuerySource{Query: q, Source: searchSource(c)})
+		if res.Error != nil {
+			return res.Error
+		}
+		searchers := 0
+		if res.RowsAffected > 0 {
+			searchers = 1
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "query"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"count":            gorm.Expr("search_queries.count + 1"),
+				"searchers":        gorm.Expr("search_queries.searchers + ?", searchers),
+				"last_searched_at": time.Now(),
+			}),
+		}).Create(&SearchQuery{Query: q, Count: 1, Searchers: searchers, LastSearchedAt: time.Now()}).Error
+	})
+	if err != nil {
+		slog.WarnContext(c, "trackSearchQuery: Ошибка сохранения запроса", "error", err)
+	}
+}
+
+// searchSource — HMAC пользователя или, для анонимного поиска, IP-адреса.
+// Сами адреса не хранятся, а ключ не даёт восстановить их перебором.
+func searchSource(c *gin.Context) string {
+	source := "ip:" + c.ClientIP()
+	if userID := c.GetInt("userID"); userID != 0 {
+		source = "user:" + strconv.Itoa(userID)
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.JWTSecret))
+	mac.Write([]byte(source))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func searchSuggest(c *gin.Context) {
+	var input struct {
+		Query string `form:"q" binding:"max=100"`
+		Limit int    `form:"limit" binding:"omitempty,min=1"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		slog.WarnContext(c, "searchSuggest: Неверные параметры", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	limit := min(input.Limit, maxSuggestLimit)
+	if limit == 0 {
+		limit = defaultSuggestLimit
+	}
+	idx := suggestIdx.Load()
+	if idx == nil {
+		// Индекс ещё не построен после старта сервера
+		c.JSON(http.StatusOK, []suggestion{})
+		return
+	}
+	c.JSON(http.StatusOK, idx.lookup(input.Query, limit))
+}
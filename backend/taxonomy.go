@@ -0,0 +1,709 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Category — раздел каталога. Разделы образуют дерево через ParentID.
+type Category struct {
+	ID        int            `json:"id" gorm:"primaryKey"`
+	ParentID  *int           `json:"parent_id" gorm:"index"`
+	Slug      string         `json:"slug" gorm:"uniqueIndex;not null"`
+	Names     LocalizedNames `json:"names" gorm:"type:jsonb"`
+	Position  int            `json:"position" gorm:"default:0"`
+	CreatedAt time.Time      `json:"created_at" gorm:"autoCreateTime"`
+
+	Name     string     `json:"name" gorm:"-"`
+	Children []Category `json:"children,omitempty" gorm:"-"`
+}
+
+// ServiceTag — услуга из справочника. Aliases — варианты свободного ввода,
+// которые при сопоставлении считаются этой услугой.
+type ServiceTag struct {
+	ID         int            `json:"id" gorm:"primaryKey"`
+	CategoryID *int           `json:"category_id" gorm:"index"`
+	Slug       string         `json:"slug" gorm:"uniqueIndex;not null"`
+	Names      LocalizedNames `json:"names" gorm:"type:jsonb"`
+	Aliases    StringArray    `json:"aliases" gorm:"type:jsonb"`
+	CreatedAt  time.Time      `json:"created_at" gorm:"autoCreateTime"`
+
+	Name string `json:"name" gorm:"-"`
+}
+
+// LocalizedNames — название по кодам языков, "ru" обязателен.
+type LocalizedNames map[string]string
+
+func (ln *LocalizedNames) Scan(value interface{}) error {
+	if value == nil {
+		*ln = LocalizedNames{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to scan LocalizedNames: expected []byte, got %T", value)
+	}
+	return json.Unmarshal(bytes, ln)
+}
+
+func (ln LocalizedNames) Value() (driver.Value, error) {
+	if len(ln) == 0 {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(ln)
+}
+
+func (ln LocalizedNames) in(lang string) string {
+	if name := ln[lang]; name != "" {
+		return name
+	}
+	return ln["ru"]
+}
+
+// categorySubtree — подзапрос с ID раздела и всех вложенных в него.
+const categorySubtree = `WITH RECURSIVE sub AS (
+	SELECT id FROM categories WHERE id = ?
+	UNION ALL SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id
+) SELECT id FROM sub`
+
+func adminOnly(c *gin.Context, fn string) bool {
+	if c.GetString("role") != "admin" {
+		slog.WarnContext(c, fn+": Доступ запрещён")
+		respondError(c, errAdminOnly)
+		return false
+	}
+	return true
+}
+
+// normalizeServiceName приводит свободный ввод к виду для сравнения:
+// "  Спортивное  Питание" и "спортивное питание" совпадают.
+func normalizeServiceName(s string) string {
+	s = strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// serviceIndex сопоставляет свободный ввод с услугами справочника по slug,
+// названиям на всех языках и синонимам.
+type serviceIndex struct {
+	byID  map[int]ServiceTag
+	byKey map[string]int
+}
+
+func loadServiceIndex(tx *gorm.DB) (serviceIndex, error) {
+	var tags []ServiceTag
+	if err := tx.Order("id").Find(&tags).Error; err != nil {
+		return serviceIndex{}, err
+	}
+	idx := serviceIndex{byID: make(map[int]ServiceTag, len(tags)), byKey: make(map[string]int)}
+	for _, tag := range tags {
+		idx.byID[tag.ID] = tag
+		keys := append([]string{tag.Slug}, tag.Aliases...)
+		for _, name := range tag.Names {
+			keys = append(keys, name)
+		}
+		for _, key := range keys {
+			if key = normalizeServiceName(key); key != "" {
+				if _, taken := idx.byKey[key]; !taken {
+					idx.byKey[key] = tag.ID
+				}
+			}
+		}
+	}
+	return idx, nil
+}
+
+// resolve возвращает названия и ID услуг. Найденные в справочнике значения
+// заменяются русским названием услуги, остальные сохраняются как введены,
+// чтобы их можно было сопоставить позже.
+func (idx serviceIndex) resolve(names []string) (StringArray, IntArray, []string) {
+	out := StringArray{}
+	ids := IntArray{}
+	var unmapped []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		key := normalizeServiceName(name)
+		if id, ok := idx.byKey[key]; ok {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+				out = append(out, idx.byID[id].Names["ru"])
+			}
+			continue
+		}
+		if key != "" && !seen[key] {
+			seen[key] = true
+			out = append(out, name)
+			unmapped = append(unmapped, name)
+		}
+	}
+	return out, ids, unmapped
+}
+
+// names возвращает русские названия услуг. Второй результат — первый ID,
+// которого нет в справочнике.
+func (idx serviceIndex) names(ids IntArray) (StringArray, int) {
+	out := make(StringArray, 0, len(ids))
+	for _, id := range ids {
+		tag, ok := idx.byID[id]
+		if !ok {
+			return nil, id
+		}
+		out = append(out, tag.Names["ru"])
+	}
+	return out, 0
+}
+
+// serviceUpdates готовит поля услуг курса или профиля. Если переданы
+// service_ids, названия берутся из справочника; иначе свободный ввод
+// сопоставляется со справочником.
+func serviceUpdates(c *gin.Context, fn string, names *StringArray, ids *IntArray, updates map[string]any) bool {
+	if names == nil && ids == nil {
+		return true
+	}
+	idx, err := loadServiceIndex(reqDB(c))
+	if err != nil {
+		slog.ErrorContext(c, fn+": Ошибка загрузки справочника услуг", "error", err)
+		respondError(c, errInternal)
+		return false
+	}
+	if ids != nil {
+		services, unknown := idx.names(*ids)
+		if unknown != 0 {
+			slog.WarnContext(c, fn+": Неизвестная услуга", "service_id", unknown)
+			respondError(c, errValidation.WithFields(FieldError{Field: "service_ids", Code: "unknown_id", Param: strconv.Itoa(unknown)}))
+			return false
+		}
+		updates["services"] = services
+		updates["service_ids"] = *ids
+		return true
+	}
+	services, serviceIDs, _ := idx.resolve(*names)
+	updates["services"] = services
+	updates["service_ids"] = serviceIDs
+	return true
+}
+
+// checkCategoryInput проверяет, что раздел из тела запроса существует.
+func checkCategoryInput(c *gin.Context, fn, field string, id int) bool {
+	var count int64
+	if err := reqDB(c).Model(&Category{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		slog.ErrorContext(c, fn+": Ошибка проверки раздела", "error", err)
+		respondError(c, errInternal)
+		return false
+	}
+	if count == 0 {
+		slog.WarnContext(c, fn+": Раздел не найден", "category_id", id)
+		respondError(c, errValidation.WithFields(FieldError{Field: field, Code: "unknown_id", Param: strconv.Itoa(id)}))
+		return false
+	}
+	return true
+}
+
+func getCategories(c *gin.Context) {
+	var categories []Category
+	if err := reqDB(c).Order("position, id").Find(&categories).Error; err != nil {
+		slog.ErrorContext(c, "getCategories: Ошибка получения разделов", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	lang := requestLanguage(c)
+	children := make(map[int][]Category)
+	for i := range categories {
+		categories[i].Name = categories[i].Names.in(lang)
+		parent := 0
+		if categories[i].ParentID != nil {
+			parent = *categories[i].ParentID
+		}
+		children[parent] = append(children[parent], categories[i])
+	}
+	var build func(parent int) []Category
+	build = func(parent int) []Category {
+		nodes := children[parent]
+		for i := range nodes {
+			nodes[i].Children = build(nodes[i].ID)
+		}
+		return nodes
+	}
+	tree := build(0)
+	if tree == nil {
+		tree = []Category{}
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+func getServiceTags(c *gin.Context) {
+	var input struct {
+		CategoryID int `form:"category_id" binding:"omitempty,gt=0"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		slog.WarnContext(c, "getServiceTags: Неверные параметры", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	q := reqDB(c).Order("id")
+	if input.CategoryID > 0 {
+		q = q.Where("category_id IN ("+categorySubtree+")", input.CategoryID)
+	}
+	var tags []ServiceTag
+	if err := q.Find(&tags).Error; err != nil {
+		slog.ErrorContext(c, "getServiceTags: Ошибка получения услуг", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	lang := requestLanguage(c)
+	for i := range tags {
+		tags[i].Name = tags[i].Names.in(lang)
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	c.JSON(http.StatusOK, tags)
+}
+
+type categoryInput struct {
+	ParentID *int           `json:"parent_id" binding:"omitempty,gt=0"`
+	Slug     string         `json:"slug" binding:"required,slug"`
+	Names    LocalizedNames `json:"names" binding:"required,localized"`
+	Position int            `json:"position" binding:"min=0"`
+}
+
+func createCategory(c *gin.Context) {
+	if !adminOnly(c, "createCategory") {
+		return
+	}
+	var input categoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createCategory: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	category := Category{ParentID: input.ParentID, Slug: input.Slug, Names: input.Names, Position: input.Position}
+	if !checkCategory(c, "createCategory", category) {
+		return
+	}
+	if err := reqDB(c).Create(&category).Error; err != nil {
+		slog.ErrorContext(c, "createCategory: Ошибка создания раздела", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	category.Name = category.Names.in(requestLanguage(c))
+	slog.InfoContext(c, "createCategory: Раздел создан", "category_id", category.ID, "slug", category.Slug)
+	c.JSON(http.StatusOK, category)
+}
+
+func updateCategory(c *gin.Context) {
+	if !adminOnly(c, "updateCategory") {
+		return
+	}
+	category, ok := loadCategory(c, "updateCategory")
+	if !ok {
+		return
+	}
+	var input categoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateCategory: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	category.ParentID, category.Slug, category.Names, category.Position = input.ParentID, input.Slug, input.Names, input.Position
+	if !checkCategory(c, "updateCategory", category) {
+		return
+	}
+	if err := reqDB(c).Select("parent_id", "slug", "names", "position").Save(&category).Error; err != nil {
+		slog.ErrorContext(c, "updateCategory: Ошибка обновления раздела", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	category.Name = category.Names.in(requestLanguage(c))
+	slog.InfoContext(c, "updateCategory: Раздел обновлён", "category_id", category.ID)
+	c.JSON(http.StatusOK, category)
+}
+
+// deleteCategory удаляет пустой раздел. Курсы раздела остаются без раздела.
+func deleteCategory(c *gin.Context) {
+	if !adminOnly(c, "deleteCategory") {
+		return
+	}
+	category, ok := loadCategory(c, "deleteCategory")
+	if !ok {
+		return
+	}
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		var children, tags int64
+		if err := tx.Model(&Category{}).Where("parent_id = ?", category.ID).Count(&children).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&ServiceTag{}).Where("category_id = ?", category.ID).Count(&tags).Error; err != nil {
+			return err
+		}
+		if children > 0 || tags > 0 {
+			return errCategoryNotEmpty
+		}
+		if err := tx.Model(&Course{}).Unscoped().Where("category_id = ?", category.ID).Update("category_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&category).Error
+	})
+	if err != nil {
+		if errors.Is(err, errCategoryNotEmpty) {
+			slog.WarnContext(c, "deleteCategory: Раздел не пуст", "category_id", category.ID)
+			respondError(c, errCategoryNotEmpty)
+			return
+		}
+		slog.ErrorContext(c, "deleteCategory: Ошибка удаления раздела", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "deleteCategory: Раздел удалён", "category_id", category.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Раздел удалён"})
+}
+
+func loadCategory(c *gin.Context, fn string) (Category, bool) {
+	var category Category
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return category, false
+	}
+	if err := reqDB(c).First(&category, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(c, fn+": Раздел не найден", "category_id", id)
+			respondError(c, errCategoryNotFound)
+		} else {
+			slog.ErrorContext(c, fn+": Ошибка получения раздела", "error", err)
+			respondError(c, errInternal)
+		}
+		return category, false
+	}
+	return category, true
+}
+
+// checkCategory проверяет уникальность slug и родителя: он должен
+// существовать и не лежать внутри самого раздела.
+func checkCategory(c *gin.Context, fn string, category Category) bool {
+	if !checkSlugFree(c, fn, &Category{}, category.ID, category.Slug) {
+		return false
+	}
+	if category.ParentID == nil {
+		return true
+	}
+	if !checkCategoryInput(c, fn, "parent_id", *category.ParentID) {
+		return false
+	}
+	if category.ID == 0 {
+		return true
+	}
+	var inside int64
+	if err := reqDB(c).Raw("SELECT COUNT(*) FROM ("+categorySubtree+") s WHERE s.id = ?", category.ID, *category.ParentID).Scan(&inside).Error; err != nil {
+		slog.ErrorContext(c, fn+": Ошибка проверки раздела", "error", err)
+		respondError(c, errInternal)
+		return false
+	}
+	if inside > 0 {
+		slog.WarnContext(c, fn+": Раздел не может быть вложен в себя", "category_id", category.ID, "parent_id", *category.ParentID)
+		respondError(c, errCategoryCycle)
+		return false
+	}
+	return true
+}
+
+func checkSlugFree(c *gin.Context, fn string, model any, id int, slug string) bool {
+	var count int64
+	if err := reqDB(c).Model(model).Where("slug = ? AND id <> ?", slug, id).Count(&count).Error; err != nil {
+		slog.ErrorContext(c, fn+": Ошибка проверки slug", "error", err)
+		respondError(c, errInternal)
+		return false
+	}
+	if count > 0 {
+		slog.WarnContext(c, fn+": Slug занят", "slug", slug)
+		respondError(c, errSlugTaken)
+		return false
+	}
+	return true
+}
+
+type serviceTagInput struct {
+	CategoryID *int           `json:"category_id" binding:"omitempty,gt=0"`
+	Slug       string         `json:"slug" binding:"required,slug"`
+	Names      LocalizedNames `json:"names" binding:"required,localized"`
+	Aliases    StringArray    `json:"aliases" binding:"max=50,dive,notblank,max=50"`
+}
+
+func createServiceTag(c *gin.Context) {
+	if !adminOnly(c, "createServiceTag") {
+		return
+	}
+	var input serviceTagInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "createServiceTag: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	tag := ServiceTag{CategoryID: input.CategoryID, Slug: input.Slug, Names: input.Names, Aliases: input.Aliases}
+	if !checkServiceTag(c, "createServiceTag", tag) {
+		return
+	}
+	if err := reqDB(c).Create(&tag).Error; err != nil {
+		slog.ErrorContext(c, "createServiceTag: Ошибка создания услуги", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	tag.Name = tag.Names.in(requestLanguage(c))
+	slog.InfoContext(c, "createServiceTag: Услуга создана", "service_id", tag.ID, "slug", tag.Slug)
+	c.JSON(http.StatusOK, tag)
+}
+
+// updateServiceTag меняет услугу и обновляет её название в курсах и
+// профилях, где она выбрана.
+func updateServiceTag(c *gin.Context) {
+	if !adminOnly(c, "updateServiceTag") {
+		return
+	}
+	tag, ok := loadServiceTag(c, "updateServiceTag")
+	if !ok {
+		return
+	}
+	var input serviceTagInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "updateServiceTag: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return
+	}
+	oldName := tag.Names["ru"]
+	tag.CategoryID, tag.Slug, tag.Names, tag.Aliases = input.CategoryID, input.Slug, input.Names, input.Aliases
+	if !checkServiceTag(c, "updateServiceTag", tag) {
+		return
+	}
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("category_id", "slug", "names", "aliases").Save(&tag).Error; err != nil {
+			return err
+		}
+		return renameService(tx, tag.ID, oldName, tag.Names["ru"])
+	})
+	if err != nil {
+		slog.ErrorContext(c, "updateServiceTag: Ошибка обновления услуги", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	suggestDirty.Store(true)
+	tag.Name = tag.Names.in(requestLanguage(c))
+	slog.InfoContext(c, "updateServiceTag: Услуга обновлена", "service_id", tag.ID)
+	c.JSON(http.StatusOK, tag)
+}
+
+// deleteServiceTag удаляет услугу из справочника. В курсах и профилях
+// остаётся её название, но уже как свободный ввод.
+func deleteServiceTag(c *gin.Context) {
+	if !adminOnly(c, "deleteServiceTag") {
+		return
+	}
+	tag, ok := loadServiceTag(c, "deleteServiceTag")
+	if !ok {
+		return
+	}
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&Course{}, &User{}} {
+			err := tx.Model(model).Unscoped().Where("service_ids @> ?::jsonb", fmt.Sprintf("[%d]", tag.ID)).
+				Update("service_ids", gorm.Expr("(SELECT COALESCE(jsonb_agg(e), '[]'::jsonb) FROM jsonb_array_elements(service_ids) e WHERE e <> to_jsonb(?::int))", tag.ID)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&tag).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, "deleteServiceTag: Ошибка удаления услуги", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	slog.InfoContext(c, "deleteServiceTag: Услуга удалена", "service_id", tag.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Услуга удалена"})
+}
+
+func loadServiceTag(c *gin.Context, fn string) (ServiceTag, bool) {
+	var tag ServiceTag
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, fn+": Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return tag, false
+	}
+	if err := reqDB(c).First(&tag, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(c, fn+": Услуга не найдена", "service_id", id)
+			respondError(c, errServiceNotFound)
+		} else {
+			slog.ErrorContext(c, fn+": Ошибка получения услуги", "error", err)
+			respondError(c, errInternal)
+		}
+		return tag, false
+	}
+	return tag, true
+}
+
+func checkServiceTag(c *gin.Context, fn string, tag ServiceTag) bool {
+	if !checkSlugFree(c, fn, &ServiceTag{}, tag.ID, tag.Slug) {
+		return false
+	}
+	return tag.CategoryID == nil || checkCategoryInput(c, fn, "category_id", *tag.CategoryID)
+}
+
+// renameService заменяет прежнее название услуги новым в курсах и
+// профилях, где она выбрана.
+func renameService(tx *gorm.DB, id int, from, to string) error {
+	if from == to {
+		return nil
+	}
+	rename := func(services StringArray) StringArray {
+		out := make(StringArray, len(services))
+		for i, s := range services {
+			if s == from {
+				s = to
+			}
+			out[i] = s
+		}
+		return out
+	}
+	contains := fmt.Sprintf("[%d]", id)
+	var courses []Course
+	if err := tx.Unscoped().Select("id", "services").Where("service_ids @> ?::jsonb", contains).Find(&courses).Error; err != nil {
+		return err
+	}
+	for _, course := range courses {
+		if err := tx.Model(&Course{}).Unscoped().Where("id = ?", course.ID).Update("services", rename(course.Services)).Error; err != nil {
+			return err
+		}
+	}
+	var users []User
+	if err := tx.Select("id", "services").Where("service_ids @> ?::jsonb", contains).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("services", rename(user.Services)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type unmappedService struct {
+	Value   string `json:"value"`
+	Courses int    `json:"courses"`
+	Users   int    `json:"users"`
+}
+
+type remapResult struct {
+	Courses  int               `json:"courses"`
+	Users    int               `json:"users"`
+	Unmapped []unmappedService `json:"unmapped"`
+}
+
+// remapServices сопоставляет свободный ввод услуг всех курсов и профилей со
+// справочником. Уже выбранные услуги сохраняются. Возвращает число
+// изменённых записей и значения, которых в справочнике нет.
+func remapServices(tx *gorm.DB, apply bool) (remapResult, error) {
+	result := remapResult{Unmapped: []unmappedService{}}
+	idx, err := loadServiceIndex(tx)
+	if err != nil {
+		return result, err
+	}
+	unmapped := make(map[string]*unmappedService)
+	remap := func(services StringArray, ids IntArray, count func(*unmappedService)) (StringArray, IntArray, bool) {
+		known, _ := idx.names(ids)
+		names, mapped, rest := idx.resolve(append(known, services...))
+		for _, value := range rest {
+			key := normalizeServiceName(value)
+			if unmapped[key] == nil {
+				unmapped[key] = &unmappedService{Value: value}
+			}
+			count(unmapped[key])
+		}
+		changed := !slices.Equal(names, services) || !slices.Equal(mapped, ids)
+		return names, mapped, changed
+	}
+
+	var courses []Course
+	if err := tx.Unscoped().Select("id", "services", "service_ids").Order("id").Find(&courses).Error; err != nil {
+		return result, err
+	}
+	for _, course := range courses {
+		names, ids, changed := remap(course.Services, course.ServiceIDs, func(u *unmappedService) { u.Courses++ })
+		if !changed {
+			continue
+		}
+		result.Courses++
+		if apply {
+			err := tx.Model(&Course{}).Unscoped().Where("id = ?", course.ID).
+				Updates(map[string]any{"services": names, "service_ids": ids}).Error
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	var users []User
+	if err := tx.Select("id", "services", "service_ids").Order("id").Find(&users).Error; err != nil {
+		return result, err
+	}
+	for _, user := range users {
+		names, ids, changed := remap(user.Services, user.ServiceIDs, func(u *unmappedService) { u.Users++ })
+		if !changed {
+			continue
+		}
+		result.Users++
+		if apply {
+			err := tx.Model(&User{}).Where("id = ?", user.ID).
+				Updates(map[string]any{"services": names, "service_ids": ids}).Error
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	for _, u := range unmapped {
+		result.Unmapped = append(result.Unmapped, *u)
+	}
+	sort.Slice(result.Unmapped, func(i, j int) bool {
+		a, b := result.Unmapped[i], result.Unmapped[j]
+		if a.Courses+a.Users != b.Courses+b.Users {
+			return a.Courses+a.Users > b.Courses+b.Users
+		}
+		return a.Value < b.Value
+	})
+	return result, nil
+}
+
+// remapServicesHandler показывает (dry_run=true) или применяет сопоставление
+// свободного ввода со справочником. Обычный порядок работы: посмотреть
+// unmapped, добавить недостающие услуги или синонимы и применить.
+func remapServicesHandler(c *gin.Context) {
+	if !adminOnly(c, "remapServices") {
+		return
+	}
+	apply := c.Query("dry_run") != "true"
+	var result remapResult
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = remapServices(tx, apply)
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(c, "remapServices: Ошибка сопоставления услуг", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	if apply {
+		suggestDirty.Store(true)
+	}
+	slog.InfoContext(c, "remapServices: Услуги сопоставлены", "apply", apply, "courses", result.Courses, "users", result.Users, "unmapped", len(result.Unmapped))
+	c.JSON(http.StatusOK, result)
+}
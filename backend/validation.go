@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	maxPrice           = 1_000_000
+	maxServices        = 10
+	maxServiceLength   = 50
+	maxTaxonomyName    = 100
+	minPasswordLength  = 8
+	maxPasswordLength  = 72 // bcrypt игнорирует байты после 72-го
+	usernamePatternStr = `^[a-zA-Z0-9_.-]{3,32}$`
+)
+
+var (
+	usernamePattern   = regexp.MustCompile(usernamePatternStr)
+	cardNumberFormat  = regexp.MustCompile(`^\d{16}$`)
+	slugPattern       = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	customValidations = map[string]validator.Func{
+		"username":    validateUsername,
+		"password":    validatePassword,
+		"notblank":    validateNotBlank,
+		"weburl":      validateWebURL,
+		"price":       validatePrice,
+		"services":    validateServices,
+		"card_number": validateCardNumber,
+		"slug":        validateSlug,
+		"localized":   validateLocalizedNames,
+	}
+)
+
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		panic("binding: unexpected validator engine")
+	}
+	// В ошибках используем имена полей из JSON или query, а не из Go-структур
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		for _, tag := range []string{"json", "form"} {
+			name := strings.SplitN(f.Tag.Get(tag), ",", 2)[0]
+			if name != "" && name != "-" {
+				return name
+			}
+		}
+		return ""
+	})
+	for tag, fn := range customValidations {
+		if err := v.RegisterValidation(tag, fn); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func validateUsername(fl validator.FieldLevel) bool {
+	return usernamePattern.MatchString(fl.Field().String())
+}
+
+func validatePassword(fl validator.FieldLevel) bool {
+	return passwordStrong(fl.Field().String())
+}
+
+// passwordStrong требует от 8 до 72 символов, хотя бы одну букву и одну цифру.
+func passwordStrong(password string) bool {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return false
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	return hasLetter && hasDigit
+}
+
+func validateNotBlank(fl validator.FieldLevel) bool {
+	return strings.TrimSpace(fl.Field().String()) != ""
+}
+
+func validateWebURL(fl validator.FieldLevel) bool {
+	u, err := url.Parse(fl.Field().String())
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validatePrice допускает не больше двух знаков после запятой: цены хранятся
+// в decimal(10,2), и 0.001 молча превратилась бы в 0.00.
+func validatePrice(fl validator.FieldLevel) bool {
+	switch fl.Field().Kind() {
+	case reflect.Float32, reflect.Float64:
+		price := decimal.NewFromFloat(fl.Field().Float())
+		return price.IsPositive() && price.Exponent() >= -2 && price.LessThanOrEqual(decimal.NewFromInt(maxPrice))
+	case reflect.Int, reflect.Int64:
+		price := fl.Field().Int()
+		return price > 0 && price <= maxPrice
+	}
+	return false
+}
+
+func validateServices(fl validator.FieldLevel) bool {
+	services, ok := fl.Field().Interface().(StringArray)
+	if !ok || len(services) > maxServices {
+		return false
+	}
+	seen := make(map[string]bool, len(services))
+	for _, s := range services {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" || len([]rune(s)) > maxServiceLength || seen[s] {
+			return false
+		}
+		seen[s] = true
+	}
+	return true
+}
+
+func validateCardNumber(fl validator.FieldLevel) bool {
+	return cardNumberFormat.MatchString(fl.Field().String())
+}
+
+func validateSlug(fl validator.FieldLevel) bool {
+	slug := fl.Field().String()
+	return len(slug) <= 64 && slugPattern.MatchString(slug)
+}
+
+// validateLocalizedNames требует русское название и допускает только языки
+// из каталога сообщений.
+func validateLocalizedNames(fl validator.FieldLevel) bool {
+	names, ok := fl.Field().Interface().(LocalizedNames)
+	if !ok || strings.TrimSpace(names["ru"]) == "" {
+		return false
+	}
+	for lang, name := range names {
+		if _, ok := messageCatalog[lang]; !ok || len([]rune(name)) > maxTaxonomyName {
+			return false
+		}
+	}
+	return true
+}
+
+// numericCodes переименовывает min/max для чисел, чтобы сообщение говорило
+// о значении, а не о длине.
+var numericCodes = map[string]string{"min": "gte", "max": "lte"}
+
+func validationFields(errs validator.ValidationErrors) []FieldError {
+	fields := make([]FieldError, len(errs))
+	for i, fe := range errs {
+		code := fe.Tag()
+		switch fe.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if numeric, ok := numericCodes[code]; ok {
+				code = numeric
+			}
+		}
+		fields[i] = FieldError{Field: fe.Field(), Code: code, Param: fe.Param()}
+	}
+	return fields
+}
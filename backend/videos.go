@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	videoStatusQueued     = "queued"
+	videoStatusProcessing = "processing"
+	videoStatusReady      = "ready"
+	videoStatusFailed     = "failed"
+
+	maxVideoUpload         = 2 << 30
+	videoURLTTL            = 4 * time.Hour
+	videoUploadURLTTL      = time.Hour
+	videoCheckInterval     = 30 * time.Second
+	videoProcessingTimeout = 3 * time.Hour
+)
+
+// QuickTime определяется через sniffContentType.
+var videoUploadTypes = []string{"video/mp4", "video/webm", "video/avi", "video/quicktime"}
+
+// videoRendition — качество HLS. Выше исходного разрешения не кодируем,
+// кроме первого качества.
+type videoRendition struct {
+	Name    string
+	Height  int
+	Bitrate string
+}
+
+var videoRenditions = []videoRendition{
+	{"360p", 360, "800k"},
+	{"720p", 720, "2800k"},
+	{"1080p", 1080, "5000k"},
+}
+
+var hlsFilePattern = regexp.MustCompile(`^(master\.m3u8|[0-9]+p/(index\.m3u8|seg_[0-9]+\.ts))$`)
+
+// Video — загруженное видео урока. Фоновая задача перекодирует исходник
+// в HLS, файлы лежат в хранилище под videos/<id>/hls.
+type Video struct {
+	ID              int         `json:"id" gorm:"primaryKey"`
+	LessonID        int         `json:"lesson_id" gorm:"index;not null"`
+	CourseID        int         `json:"course_id" gorm:"index;not null"`
+	UploadedBy      int         `json:"-"`
+	SourceKey       string      `json:"-"`
+	Status          string      `json:"status" gorm:"index;not null"`
+	Error           string      `json:"error,omitempty"`
+	DurationSeconds int         `json:"duration_seconds"`
+	Renditions      StringArray `json:"renditions" gorm:"type:jsonb"`
+	CreatedAt       time.Time   `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt       time.Time   `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func videoPrefix(id int) string {
+	return "videos/" + strconv.Itoa(id)
+}
+
+func videoSignature(videoID int, expires int64) string {
+	return signURL("hls", strconv.Itoa(videoID), strconv.FormatInt(expires, 10))
+}
+
+func videoQuery(videoID int, expires int64) string {
+	return url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {videoSignature(videoID, expires)},
+	}.Encode()
+}
+
+// signPlaylist дописывает подпись к ссылкам плейлиста, чтобы плеер
+// запрашивал вложенные плейлисты и сегменты с той же подписью.
+func signPlaylist(body []byte, query string) []byte {
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines[i] = line + "?" + query
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// removeVideoFiles удаляет HLS-файлы и необработанный исходник видео.
+func removeVideoFiles(ctx context.Context, videos []Video) {
+	for _, v := range videos {
+		if err := storage.DeletePrefix(ctx, videoPrefix(v.ID)); err != nil {
+			slog.WarnContext(ctx, "removeVideoFiles: Ошибка удаления файлов видео", "video_id", v.ID, "error", err)
+		}
+		if v.SourceKey == "" {
+			continue
+		}
+		if err := storage.Delete(ctx, v.SourceKey); err != nil {
+			slog.WarnContext(ctx, "removeVideoFiles: Ошибка удаления исходника", "video_id", v.ID, "error", err)
+		}
+	}
+}
+
+// videoSourcePrefix — место исходников урока. Ключ прямой загрузки
+// проверяется по нему, чтобы нельзя было подставить чужой файл.
+func videoSourcePrefix(lessonID int) string {
+	return fmt.Sprintf("videos/sources/%d/", lessonID)
+}
+
+// createVideoUploadURL выдаёт ссылку для загрузки исходника напрямую в
+// хранилище, минуя API. После загрузки ключ передаётся в uploadLessonVideo.
+func createVideoUploadURL(c *gin.Context) {
+	lesson, ok := loadManagedLesson(c, "createVideoUploadURL")
+	if !ok {
+		return
+	}
+	if lesson.Kind != lessonKindVideo {
+		respondError(c, errNotAVideo)
+		return
+	}
+	key := videoSourcePrefix(lesson.ID) + uuid.New().String()
+	link, err := storage.PresignPut(c, key, videoUploadURLTTL)
+	if err != nil {
+		slog.ErrorContext(c, "createVideoUploadURL: Ошибка получения ссылки", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"upload_url": link, "method": http.MethodPut, "key": key, "expires_at": time.Now().Add(videoUploadURLTTL).Truncate(time.Second)})
+}
+
+// uploadLessonVideo ставит исходник видео в очередь на перекодирование.
+// Файл передаётся в multipart или загружается заранее по ссылке из
+// createVideoUploadURL, тогда в JSON передаётся его ключ. Предыдущее видео
+// урока удаляется.
+func uploadLessonVideo(c *gin.Context) {
+	lesson, ok := loadManagedLesson(c, "uploadLessonVideo")
+	if !ok {
+		return
+	}
+	if lesson.Kind != lessonKindVideo {
+		respondError(c, errNotAVideo)
+		return
+	}
+	var sourceKey string
+	if c.ContentType() == "application/json" {
+		sourceKey, ok = checkUploadedVideo(c, lesson)
+	} else {
+		sourceKey, ok = storeVideoSource(c, lesson)
+	}
+	if !ok {
+		return
+	}
+	video := Video{
+		LessonID:   lesson.ID,
+		CourseID:   lesson.CourseID,
+		UploadedBy: c.GetInt("userID"),
+		SourceKey:  sourceKey,
+		Status:     videoStatusQueued,
+	}
+	var old []Video
+	err := reqDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id", "source_key").Where("lesson_id = ?", lesson.ID).Find(&old).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("lesson_id = ?", lesson.ID).Delete(&Video{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&video).Error
+	})
+	if err != nil {
+		slog.ErrorContext(c, "uploadLessonVideo: Ошибка сохранения видео", "error", err)
+		removeVideoSource(c, sourceKey)
+		respondError(c, errInternal)
+		return
+	}
+	removeVideoFiles(c, old)
+	slog.InfoContext(c, "uploadLessonVideo: Видео поставлено в очередь", "lesson_id", lesson.ID, "video_id", video.ID)
+	c.JSON(http.StatusOK, video)
+}
+
+func storeVideoSource(c *gin.Context, lesson Lesson) (string, bool) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		slog.WarnContext(c, "uploadLessonVideo: Ошибка получения файла", "error", err)
+		respondError(c, errFileMissing)
+		return "", false
+	}
+	if file.Size > maxVideoUpload {
+		slog.WarnContext(c, "uploadLessonVideo: Файл слишком большой", "size", file.Size)
+		respondError(c, errVideoTooLarge)
+		return "", false
+	}
+	src, _, ok := openSniffedFile(c, "uploadLessonVideo", file, videoUploadTypes)
+	if !ok {
+		return "", false
+	}
+	defer src.Close()
+	key := videoSourcePrefix(lesson.ID) + uuid.New().String()
+	if err := storage.Put(c, key, src); err != nil {
+		slog.ErrorContext(c, "uploadLessonVideo: Ошибка сохранения файла", "error", err)
+		respondError(c, errInternal)
+		return "", false
+	}
+	return key, true
+}
+
+// checkUploadedVideo проверяет размер и тип файла, загруженного по ссылке.
+// Неподходящий файл удаляется.
+func checkUploadedVideo(c *gin.Context, lesson Lesson) (string, bool) {
+	var input struct {
+		Key string `json:"key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		slog.WarnContext(c, "uploadLessonVideo: Неверные данные", "error", err)
+		respondError(c, bindError(err))
+		return "", false
+	}
+	name, found := strings.CutPrefix(input.Key, videoSourcePrefix(lesson.ID))
+	if _, err := uuid.Parse(name); !found || err != nil {
+		slog.WarnContext(c, "uploadLessonVideo: Чужой ключ файла", "key", input.Key)
+		respondError(c, errFileMissing)
+		return "", false
+	}
+	size, err := storage.Size(c, input.Key)
+	if err != nil {
+		slog.WarnContext(c, "uploadLessonVideo: Файл не загружен", "key", input.Key, "error", err)
+		respondError(c, errFileMissing)
+		return "", false
+	}
+	if size > maxVideoUpload {
+		slog.WarnContext(c, "uploadLessonVideo: Файл слишком большой", "size", size)
+		removeVideoSource(c, input.Key)
+		respondError(c, errVideoTooLarge)
+		return "", false
+	}
+	src, err := storage.Open(c, input.Key)
+	if err != nil {
+		slog.ErrorContext(c, "uploadLessonVideo: Ошибка чтения файла", "error", err)
+		respondError(c, errInternal)
+		return "", false
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(src, head)
+	src.Close()
+	if contentType := sniffContentType(head[:n]); !slices.Contains(videoUploadTypes, contentType) {
+		slog.WarnContext(c, "uploadLessonVideo: Неподдерживаемый тип файла", "content_type", contentType)
+		removeVideoSource(c, input.Key)
+		respondError(c, errUnsupportedFileType)
+		return "", false
+	}
+	return input.Key, true
+}
+
+func removeVideoSource(c *gin.Context, key string) {
+	if err := storage.Delete(c, key); err != nil {
+		slog.WarnContext(c, "removeVideoSource: Ошибка удаления файла", "key", key, "error", err)
+	}
+}
+
+type videoPlayback struct {
+	Video
+	PlaylistURL string     `json:"playlist_url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// getLessonVideo выдаёт подписанную ссылку на HLS-плейлист. Ссылка
+// действует videoURLTTL, после этого плеер должен запросить новую.
+func getLessonVideo(c *gin.Context) {
+	lesson, access, ok := loadLesson(c, "getLessonVideo")
+	if !ok {
+		return
+	}
+	var video Video
+	if err := reqDB(c).Where("lesson_id = ?", lesson.ID).Order("id DESC").First(&video).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			respondError(c, errVideoNotFound)
+		} else {
+			slog.ErrorContext(c, "getLessonVideo: Ошибка получения видео", "error", err)
+			respondError(c, errInternal)
+		}
+		return
+	}
+	if !access.manage {
+		video.Error = ""
+	}
+	resp := videoPlayback{Video: video}
+	if video.Status == videoStatusReady {
+		expires := time.Now().Add(videoURLTTL).Truncate(time.Second)
+		resp.PlaylistURL = fmt.Sprintf("/api/videos/%d/master.m3u8?%s", video.ID, videoQuery(video.ID, expires.Unix()))
+		resp.ExpiresAt = &expires
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// streamVideo отдаёт плейлисты и сегменты HLS. Авторизация — подпись в
+// ссылке, так как плеер не передаёт заголовок Authorization.
+func streamVideo(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		slog.WarnContext(c, "streamVideo: Неверный ID", "error", err)
+		respondError(c, errInvalidID)
+		return
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(c.Query("sig")), []byte(videoSignature(id, expires))) {
+		slog.WarnContext(c, "streamVideo: Неверная или устаревшая подпись", "video_id", id)
+		respondError(c, errVideoLinkInvalid)
+		return
+	}
+	name := strings.TrimPrefix(c.Param("file"), "/")
+	if !hlsFilePattern.MatchString(name) {
+		respondError(c, errVideoNotFound)
+		return
+	}
+	file, err := storage.Open(c, videoPrefix(id)+"/hls/"+name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.WarnContext(c, "streamVideo: Файл не найден", "video_id", id, "file", name)
+			respondError(c, errVideoNotFound)
+		} else {
+			slog.ErrorContext(c, "streamVideo: Ошибка чтения файла", "error", err)
+			respondError(c, errInternal)
+		}
+		return
+	}
+	defer file.Close()
+	if !strings.HasSuffix(name, ".m3u8") {
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", expires-time.Now().Unix()))
+		c.DataFromReader(http.StatusOK, -1, "video/mp2t", file, nil)
+		return
+	}
+	body, err := io.ReadAll(file)
+	if err != nil {
+		slog.ErrorContext(c, "streamVideo: Ошибка чтения плейлиста", "error", err)
+		respondError(c, errInternal)
+		return
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", signPlaylist(body, videoQuery(id, expires)))
+}
+
+// processVideos перекодирует видео из очереди по одному, пока она не
+// опустеет. Видео, зависшие в processing, берутся повторно.
+func processVideos(ctx context.Context) error {
+	for {
+		video, ok, err := claimVideo(ctx)
+		if err != nil || !ok {
+			return err
+		}
+		transcodeVideo(ctx, video)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func claimVideo(ctx context.Context) (Video, bool, error) {
+	var video Video
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? OR (status = ? AND updated_at < ?)", videoStatusQueued, videoStatusProcessing, time.Now().Add(-videoProcessingTimeout)).
+			First(&video).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&video).Update("status", videoStatusProcessing).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return video, false, nil
+	}
+	return video, err == nil, err
+}
+
+func transcodeVideo(ctx context.Context, video Video) {
+	started := time.Now()
+	duration, renditions, err := runTranscode(ctx, video)
+	if ctx.Err() != nil {
+		// Сервер останавливается: вернём видео в очередь
+		bg := context.Background()
+		db.WithContext(bg).Model(&video).Update("status", videoStatusQueued)
+		removeVideoFiles(bg, []Video{{ID: video.ID}})
+		return
+	}
+	tx := db.WithContext(ctx)
+	var lesson Lesson
+	tx.Select("id", "title").First(&lesson, video.LessonID)
+	if err != nil {
+		// Исходник остаётся в хранилище: его удалит замена или удаление
+		// видео, а если статус не сохранится, повторная обработка сможет
+		// его прочитать.
+		slog.ErrorContext(ctx, "processVideos: Ошибка перекодирования", "video_id", video.ID, "error", err)
+		// Конец сообщения ffmpeg информативнее начала. Режем по символам,
+		// чтобы не разорвать UTF-8: Postgres такую строку не примет.
+		msg := []rune(err.Error())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		res := tx.Model(&video).Updates(map[string]any{"status": videoStatusFailed, "error": string(msg)})
+		if res.Error != nil {
+			slog.ErrorContext(ctx, "processVideos: Ошибка сохранения статуса", "video_id", video.ID, "error", res.Error)
+		} else if res.RowsAffected > 0 {
+			notifyUser(ctx, tx, video.UploadedBy, "video", "Не удалось обработать видео урока "+lesson.Title)
+		}
+		removeVideoFiles(ctx, []Video{{ID: video.ID}})
+		return
+	}
+	res := tx.Model(&video).Updates(map[string]any{
+		"status":           videoStatusReady,
+		"error":            "",
+		"duration_seconds": duration,
+		"renditions":       StringArray(renditions),
+		"source_key":       "",
+	})
+	if res.Error != nil {
+		slog.ErrorContext(ctx, "processVideos: Ошибка сохранения видео", "video_id", video.ID, "error", res.Error)
+		return
+	}
+	if err := storage.Delete(ctx, video.SourceKey); err != nil {
+		slog.WarnContext(ctx, "processVideos: Ошибка удаления исходника", "video_id", video.ID, "error", err)
+	}
+	if res.RowsAffected == 0 {
+		// Видео удалили или заменили во время обработки
+		removeVideoFiles(ctx, []Video{{ID: video.ID}})
+	} else {
+		notifyUser(ctx, tx, video.UploadedBy, "video", "Видео урока "+lesson.Title+" готово к просмотру")
+	}
+	slog.InfoContext(ctx, "processVideos: Видео обработано", "video_id", video.ID, "renditions", renditions,
+		"duration_ms", time.Since(started).Milliseconds())
+}
+
+// runTranscode скачивает исходник во временную директорию, кодирует его
+// ffmpeg и загружает HLS-файлы в хранилище.
+func runTranscode(ctx context.Context, video Video) (int, []string, error) {
+	dir, err := os.MkdirTemp("", "video-")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "source")
+	if err := copyFromStorage(ctx, video.SourceKey, src); err != nil {
+		return 0, nil, fmt.Errorf("Ошибка чтения исходника: %w", err)
+	}
+	probe, err := probeVideo(ctx, src)
+	if err != nil {
+		return 0, nil, err
+	}
+	var renditions []videoRendition
+	for i, r := range videoRenditions {
+		if i == 0 || r.Height <= probe.height {
+			renditions = append(renditions, r)
+		}
+	}
+	out := filepath.Join(dir, "hls")
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath, ffmpegHLSArgs(src, out, renditions, probe.audio)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	err = filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(out, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return storage.Put(ctx, videoPrefix(video.ID)+"/hls/"+filepath.ToSlash(rel), f)
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("Ошибка загрузки HLS в хранилище: %w", err)
+	}
+	names := make([]string, len(renditions))
+	for i, r := range renditions {
+		names[i] = r.Name
+	}
+	return probe.duration, names, nil
+}
+
+func copyFromStorage(ctx context.Context, key, dst string) error {
+	src, err := storage.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type videoProbe struct {
+	height   int
+	duration int
+	audio    bool
+}
+
+func probeVideo(ctx context.Context, path string) (videoProbe, error) {
+	var probe videoProbe
+	out, err := exec.CommandContext(ctx, cfg.FFprobePath, "-v", "error", "-print_format", "json",
+		"-show_entries", "stream=codec_type,height:format=duration", path).Output()
+	if err != nil {
+		return probe, fmt.Errorf("ffprobe: %w", err)
+	}
+	var result struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return probe, fmt.Errorf("ffprobe: %w", err)
+	}
+	for _, s := range result.Streams {
+		switch s.CodecType {
+		case "video":
+			probe.height = max(probe.height, s.Height)
+		case "audio":
+			probe.audio = true
+		}
+	}
+	if probe.height == 0 {
+		return probe, errors.New("В файле нет видеодорожки")
+	}
+	seconds, _ := strconv.ParseFloat(result.Format.Duration, 64)
+	probe.duration = int(seconds + 0.5)
+	return probe, nil
+}
+
+// ffmpegHLSArgs собирает команду, которая за один проход кодирует все
+// качества и пишет master.m3u8 с вариантами <качество>/index.m3u8.
+func ffmpegHLSArgs(src, out string, renditions []videoRendition, audio bool) []string {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, r := range renditions {
+		fmt.Fprintf(&filter, ";[v%d]scale=-2:%d[o%d]", i, r.Height, i)
+	}
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-filter_complex", filter.String()}
+	streams := make([]string, len(renditions))
+	for i, r := range renditions {
+		args = append(args, "-map", fmt.Sprintf("[o%d]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264", fmt.Sprintf("-b:v:%d", i), r.Bitrate)
+		streams[i] = fmt.Sprintf("v:%d,name:%s", i, r.Name)
+		if audio {
+			args = append(args, "-map", "0:a:0")
+			streams[i] = fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.Name)
+		}
+	}
+	args = append(args, "-preset", "veryfast", "-pix_fmt", "yuv420p", "-g", "48", "-sc_threshold", "0")
+	if audio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k", "-ac", "2")
+	}
+	return append(args,
+		"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(out, "%v", "seg_%03d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(streams, " "),
+		filepath.Join(out, "%v", "index.m3u8"))
+}
@@ -72,6 +72,10 @@ export default defineNuxtConfig({
           target: process.env.API_BASE_URL || 'http://localhost:8080',
           changeOrigin: true,
           rewrite: (path) => path.replace(/^\/avatars/, '/avatars')
+        },
+        '/covers': {
+          target: process.env.API_BASE_URL || 'http://localhost:8080',
+          changeOrigin: true
         }
       }
     },
@@ -1,11 +1,13 @@
 import { defineStore } from 'pinia'
 import { ref } from 'vue'
 import { useRuntimeConfig } from 'nuxt/app'
+import { fetchPage, fetchAllPages } from '~/utils/pagination'
 
 export const useChatStore = defineStore('chat', {
   state: () => ({
     dialogs: [],
     messages: {}, // Храним сообщения как { [receiverId]: Message[] }
+    olderMessages: {}, // Ссылка на страницу более ранних сообщений: { [receiverId]: url | null }
     loading: false,
     error: null,
     websocket: null,
@@ -71,12 +73,12 @@ export const useChatStore = defineStore('chat', {
       const config = useRuntimeConfig()
       const headers = { Authorization: `Bearer ${localStorage.getItem('token')}` }
       try {
-        const data = await $fetch(`${config.public.apiBase}/api/chats`, { headers })
-        this.dialogs = data ? data.sort((a, b) => {
+        const data = await fetchAllPages(`${config.public.apiBase}/api/chats?limit=100`, { headers })
+        this.dialogs = data.sort((a, b) => {
           const aTime = a.last_message_at ? new Date(a.last_message_at) : new Date(a.created_at || 0)
           const bTime = b.last_message_at ? new Date(b.last_message_at) : new Date(b.created_at || 0)
           return bTime - aTime
-        }) : []
+        })
         this.unreadCount = this.getUnreadCount
       } catch (error) {
         console.error('Ошибка fetchDialogs:', error)
@@ -92,10 +94,12 @@ export const useChatStore = defineStore('chat', {
       const config = useRuntimeConfig()
       const headers = { Authorization: `Bearer ${localStorage.getItem('token')}` }
       try {
-        const data = await $fetch(`${config.public.apiBase}/api/messages?receiver_id=${receiverId}`, { headers })
-        this.messages[receiverId] = data ? data.filter((msg, index, self) => 
+        // Первая страница — самые новые сообщения, next ведёт к более ранним
+        const page = await fetchPage(`${config.public.apiBase}/api/messages?receiver_id=${receiverId}`, { headers })
+        this.messages[receiverId] = page.items.filter((msg, index, self) => 
           index === self.findIndex((t) => t.id === msg.id)
-        ) : []
+        )
+        this.olderMessages[receiverId] = page.next
       } catch (error) {
         console.error('Ошибка fetchMessages:', error)
         this.error = error.message || 'Ошибка загрузки сообщений'
@@ -104,6 +108,22 @@ export const useChatStore = defineStore('chat', {
         this.loading = false
       }
     },
+    async fetchOlderMessages(receiverId) {
+      const url = this.olderMessages[receiverId]
+      if (!url) return
+      const headers = { Authorization: `Bearer ${localStorage.getItem('token')}` }
+      try {
+        const page = await fetchPage(url, { headers })
+        const current = this.messages[receiverId] || []
+        const older = page.items.filter(msg => !current.some(m => m.id === msg.id))
+        this.messages[receiverId] = [...older, ...current]
+        this.olderMessages[receiverId] = page.next
+      } catch (error) {
+        console.error('Ошибка fetchOlderMessages:', error)
+        this.error = error.message || 'Ошибка загрузки сообщений'
+        throw error
+      }
+    },
     async sendMessage(receiverId, content) {
       const config = useRuntimeConfig()
       const headers = { 
@@ -195,6 +215,7 @@ export const useChatStore = defineStore('chat', {
     unsubscribeFromMessages(receiverId) {
       this.subscriptions.delete(receiverId)
       delete this.messages[receiverId]
+      delete this.olderMessages[receiverId]
     }
   }
 })
\ No newline at end of file
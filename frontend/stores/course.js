@@ -1,5 +1,6 @@
 import { defineStore } from 'pinia'
 import { useRuntimeConfig } from 'nuxt/app'
+import { fetchAllPages } from '~/utils/pagination'
 
 export const useCourseStore = defineStore('course', {
   state: () => ({
@@ -48,8 +49,8 @@ export const useCourseStore = defineStore('course', {
       const config = useRuntimeConfig()
       const headers = { Authorization: `Bearer ${localStorage.getItem('token')}` }
       try {
-        const data = await $fetch(`${config.public.apiBase}/api/enrolled`, { headers })
-        this.isPaid = data && Array.isArray(data) ? data.some(e => e.course_id === parseInt(this.course.id)) : false
+        const data = await fetchAllPages(`${config.public.apiBase}/api/enrolled?limit=100`, { headers })
+        this.isPaid = data.some(e => e.course_id === parseInt(this.course.id))
         this.canReview = this.isPaid
       } catch (error) {
         this.error = error.message || 'Неизвестная ошибка'
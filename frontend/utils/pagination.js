@@ -0,0 +1,37 @@
+import { useRuntimeConfig } from 'nuxt/app'
+
+// Списки API отдаются постранично: ссылки на соседние страницы приходят
+// в заголовке Link как <uri>; rel="next" и <uri>; rel="prev"
+export function parseLinkHeader(header) {
+  const links = {}
+  if (!header) return links
+  for (const part of header.split(',')) {
+    const match = part.match(/<([^>]+)>\s*;\s*rel="([^"]+)"/)
+    if (match) links[match[2]] = match[1]
+  }
+  return links
+}
+
+// Загружает одну страницу. next и prev — полные URL соседних страниц или null
+export async function fetchPage(url, options = {}) {
+  const config = useRuntimeConfig()
+  const response = await $fetch.raw(url, options)
+  const links = parseLinkHeader(response.headers.get('link'))
+  return {
+    items: response._data || [],
+    next: links.next ? `${config.public.apiBase}${links.next}` : null,
+    prev: links.prev ? `${config.public.apiBase}${links.prev}` : null
+  }
+}
+
+// Загружает все страницы списка, переходя по rel="next"
+export async function fetchAllPages(url, options = {}) {
+  const items = []
+  let next = url
+  while (next) {
+    const page = await fetchPage(next, options)
+    items.push(...page.items)
+    next = page.next
+  }
+  return items
+}